@@ -0,0 +1,92 @@
+package authclient
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+type contextKey struct{}
+
+type viaCookieKey struct{}
+
+// NewContext returns a copy of ctx carrying the verified claims
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims stored by the middleware
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok && claims != nil
+}
+
+// UserID returns the ID of the authenticated user
+func UserID(ctx context.Context) (uint, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return parseID(claims.UserID)
+}
+
+// Role returns the authenticated user's role
+func Role(ctx context.Context) (string, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return claims.Role, true
+}
+
+// SessionID returns the server-side session the token was issued for
+func SessionID(ctx context.Context) (uint, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || claims.SessionID == "" {
+		return 0, false
+	}
+	return parseID(claims.SessionID)
+}
+
+// ActorID returns the admin acting as the user when the token is for impersonation
+func ActorID(ctx context.Context) (uint, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || !claims.IsImpersonation() {
+		return 0, false
+	}
+	return parseID(claims.Act.UserID)
+}
+
+// AuthTime returns when the user last authenticated, which may be well before
+// the token was issued
+func AuthTime(ctx context.Context) (time.Time, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || claims.AuthTime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.AuthTime, 0), true
+}
+
+// AuthMethods returns how the user authenticated, e.g. "pwd" or "fed"
+func AuthMethods(ctx context.Context) []string {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return claims.AMR
+}
+
+// ViaCookie reports whether the request was authenticated by the session
+// cookie rather than a bearer token
+func ViaCookie(ctx context.Context) bool {
+	viaCookie, _ := ctx.Value(viaCookieKey{}).(bool)
+	return viaCookie
+}
+
+func parseID(value string) (uint, bool) {
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
@@ -0,0 +1,172 @@
+package authclient
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheTTL is how long keys are cached when the JWKS response has no max-age
+	DefaultCacheTTL = 5 * time.Minute
+	// MinRefreshInterval limits how often a token with an unknown key ID can
+	// make the key set be fetched again
+	MinRefreshInterval = 30 * time.Second
+)
+
+var maxAgePattern = regexp.MustCompile(`max-age=(\d+)`)
+
+// KeySet fetches and caches the public keys published in a JWKS. Keys are
+// refreshed once the cache expires, and early when a token names a key that
+// is not cached yet, as happens right after the auth service rotates its key.
+// Only one request fetches the JWKS at a time; the others keep using the
+// cached keys, or wait for the fetch when they need a key it may bring.
+type KeySet struct {
+	URL    string
+	Client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expiresAt time.Time
+	fetchedAt time.Time
+	// refreshing is closed when the fetch in progress finishes
+	refreshing chan struct{}
+	refreshErr error
+}
+
+func NewKeySet(url string) *KeySet {
+	return &KeySet{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Key returns the public key with the given key ID
+func (s *KeySet) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	key, known := s.keys[kid]
+	stale := time.Now().After(s.expiresAt)
+	canRefresh := s.refreshing != nil || time.Since(s.fetchedAt) >= MinRefreshInterval
+	if (!stale && known) || !canRefresh {
+		s.mu.Unlock()
+		if !known {
+			return nil, ErrUnknownKey
+		}
+		return key, nil
+	}
+
+	done := s.refreshing
+	if done == nil {
+		done = make(chan struct{})
+		s.refreshing = done
+		s.fetchedAt = time.Now()
+		s.mu.Unlock()
+		s.refresh(ctx, done)
+	} else {
+		s.mu.Unlock()
+		// A stale key stays good while another request refreshes the set
+		if known {
+			return key, nil
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v", ErrKeySetUnavailable, ctx.Err())
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, known = s.keys[kid]
+	if !known {
+		// Keep verifying with the cached keys while the auth service is
+		// unreachable, but a key it never published cannot be trusted
+		if s.refreshErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKeySetUnavailable, s.refreshErr)
+		}
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// refresh fetches the JWKS without holding s.mu, then replaces the cached keys
+// and closes done
+func (s *KeySet) refresh(ctx context.Context, done chan struct{}) {
+	keys, ttl, err := s.fetch(ctx)
+	if err != nil {
+		log.Printf("authclient: refreshing %s: %v", s.URL, err)
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		s.keys = keys
+		s.expiresAt = time.Now().Add(ttl)
+	}
+	s.refreshErr = err
+	s.refreshing = nil
+	s.mu.Unlock()
+	close(done)
+}
+
+// fetch downloads the JWKS and returns its RSA signing keys and how long to cache them
+func (s *KeySet) fetch(ctx context.Context) (map[string]*rsa.PublicKey, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType  string `json:"kty"`
+			KeyID    string `json:"kid"`
+			Use      string `json:"use"`
+			Modulus  string `json:"n"`
+			Exponent string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, 0, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.Modulus)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.Exponent)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	ttl := DefaultCacheTTL
+	if match := maxAgePattern.FindStringSubmatch(resp.Header.Get("Cache-Control")); match != nil {
+		if seconds, err := strconv.Atoi(match[1]); err == nil {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+	return keys, ttl, nil
+}
@@ -0,0 +1,195 @@
+package authclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer publishes the public halves of keys, keyed by key ID
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches atomic.Int32
+	// block, when set, holds every response until it is closed
+	block chan struct{}
+}
+
+func newJWKSServer(t *testing.T, kids ...string) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: map[string]*rsa.PrivateKey{}}
+	for _, kid := range kids {
+		s.addKey(t, kid)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		block := s.block
+		type jwk struct {
+			KeyType  string `json:"kty"`
+			KeyID    string `json:"kid"`
+			Use      string `json:"use"`
+			Modulus  string `json:"n"`
+			Exponent string `json:"e"`
+		}
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range s.keys {
+			set.Keys = append(set.Keys, jwk{
+				KeyType:  "RSA",
+				KeyID:    kid,
+				Use:      "sig",
+				Modulus:  base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				Exponent: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		s.mu.Unlock()
+
+		if block != nil {
+			<-block
+		}
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.keys[kid] = key
+	s.mu.Unlock()
+	return key
+}
+
+func (s *jwksServer) key(kid string) *rsa.PrivateKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[kid]
+}
+
+func TestKeySetCachesAndRefreshesForNewKeys(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	keys := NewKeySet(server.URL)
+	ctx := context.Background()
+
+	key, err := keys.Key(ctx, "k1")
+	if err != nil || key.N.Cmp(server.key("k1").N) != 0 {
+		t.Fatalf("Key(k1) = %v, %v", key, err)
+	}
+	if _, err := keys.Key(ctx, "k1"); err != nil || server.fetches.Load() != 1 {
+		t.Errorf("cached key: err = %v, fetches = %d", err, server.fetches.Load())
+	}
+
+	// A rotated key is fetched as soon as a token names it
+	server.addKey(t, "k2")
+	keys.fetchedAt = time.Now().Add(-MinRefreshInterval)
+	if _, err := keys.Key(ctx, "k2"); err != nil {
+		t.Errorf("Key(k2): %v", err)
+	}
+
+	// Unknown key IDs cannot make every request fetch the set
+	if _, err := keys.Key(ctx, "k3"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Key(k3): err = %v, want ErrUnknownKey", err)
+	}
+	if fetches := server.fetches.Load(); fetches != 2 {
+		t.Errorf("fetches = %d, want 2", fetches)
+	}
+}
+
+func TestKeySetKeepsCachedKeysWhenUnreachable(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	keys := NewKeySet(server.URL)
+	ctx := context.Background()
+	if _, err := keys.Key(ctx, "k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	keys.expiresAt = time.Now().Add(-time.Second)
+	keys.fetchedAt = time.Now().Add(-MinRefreshInterval)
+	if _, err := keys.Key(ctx, "k1"); err != nil {
+		t.Errorf("cached key while unreachable: %v", err)
+	}
+	keys.fetchedAt = time.Now().Add(-MinRefreshInterval)
+	if _, err := keys.Key(ctx, "k2"); !errors.Is(err, ErrKeySetUnavailable) {
+		t.Errorf("unknown key while unreachable: err = %v, want ErrKeySetUnavailable", err)
+	}
+}
+
+func TestKeySetFetchesOutsideTheLock(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	keys := NewKeySet(server.URL)
+	ctx := context.Background()
+	if _, err := keys.Key(ctx, "k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the next fetch, started by a token with a new key ID
+	server.addKey(t, "k2")
+	block := make(chan struct{})
+	server.mu.Lock()
+	server.block = block
+	server.mu.Unlock()
+	keys.expiresAt = time.Now().Add(-time.Second)
+	keys.fetchedAt = time.Now().Add(-MinRefreshInterval)
+
+	var wg sync.WaitGroup
+	results := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.Key(ctx, "k2")
+			results <- err
+		}()
+	}
+	for server.fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Tokens signed with a cached key are not held up by the fetch
+	start := time.Now()
+	if _, err := keys.Key(ctx, "k1"); err != nil {
+		t.Errorf("Key(k1) during refresh: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Key(k1) waited %v for the refresh", elapsed)
+	}
+
+	// Waiting requests give up with their context
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := keys.Key(canceled, "k2"); !errors.Is(err, ErrKeySetUnavailable) {
+		t.Errorf("canceled wait: err = %v, want ErrKeySetUnavailable", err)
+	}
+
+	close(block)
+	wg.Wait()
+	close(results)
+	for err := range results {
+		if err != nil {
+			t.Errorf("Key(k2): %v", err)
+		}
+	}
+	if fetches := server.fetches.Load(); fetches != 2 {
+		t.Errorf("fetches = %d, want 2", fetches)
+	}
+}
@@ -0,0 +1,208 @@
+package authclient
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	gcontext "github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// Cookies the auth service sets for browser clients, which services on the
+// same COOKIE_DOMAIN receive too. Frontends echo the CSRF cookie back in the
+// X-CSRF-Token header.
+const (
+	SessionCookieName = "session"
+	CSRFCookieName    = "csrf_token"
+	CSRFHeaderName    = "X-CSRF-Token"
+)
+
+// Middleware authenticates requests by their bearer token, or by the session
+// cookie when there is no Authorization header, and stores the claims in the
+// request context. Its signature fits both net/http handler chains and
+// mux.Router.Use.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, viaCookie, status, err := v.authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		ctx := NewContext(r.Context(), claims)
+		if viaCookie {
+			ctx = context.WithValue(ctx, viaCookieKey{}, true)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// MuxMiddleware is Middleware for services whose handlers still read the
+// auth service's gorilla/context keys (user_id, role, session_id, auth_time,
+// amr, token_id, actor_id and auth_via_cookie), so they can drop their copy
+// of AuthMiddleware.
+func (v *Verifier) MuxMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer gcontext.Clear(r)
+
+			claims, _ := ClaimsFromContext(r.Context())
+			userID, _ := UserID(r.Context())
+			gcontext.Set(r, "user_id", userID)
+			gcontext.Set(r, "role", claims.Role)
+			gcontext.Set(r, "token_id", claims.Id)
+			gcontext.Set(r, "auth_time", claims.AuthTime)
+			gcontext.Set(r, "amr", claims.AMR)
+			gcontext.Set(r, "auth_via_cookie", ViaCookie(r.Context()))
+			if sessionID, ok := SessionID(r.Context()); ok {
+				gcontext.Set(r, "session_id", sessionID)
+			}
+			if actorID, ok := ActorID(r.Context()); ok {
+				gcontext.Set(r, "actor_id", actorID)
+			}
+
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+func (v *Verifier) authenticate(r *http.Request) (*Claims, bool, int, error) {
+	token, viaCookie, err := extractToken(r)
+	if err != nil {
+		return nil, false, http.StatusUnauthorized, err
+	}
+
+	claims, err := v.Verify(r.Context(), token)
+	if errors.Is(err, ErrKeySetUnavailable) {
+		return nil, false, http.StatusServiceUnavailable, errors.New("Authentication service unavailable")
+	}
+	if err != nil {
+		return nil, false, http.StatusUnauthorized, errors.New("Invalid token")
+	}
+
+	// Browsers send cookies on cross-site requests too, so state-changing
+	// requests must echo the CSRF cookie, as the auth service requires
+	if viaCookie && !isSafeMethod(r.Method) && !v.validCSRF(r, claims) {
+		return nil, false, http.StatusForbidden, errors.New("Invalid CSRF token")
+	}
+	return claims, viaCookie, http.StatusOK, nil
+}
+
+// extractToken reads the bearer token, falling back to the session cookie
+// used by browser clients
+func extractToken(r *http.Request) (string, bool, error) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		bearerToken := strings.Split(authHeader, " ")
+		if len(bearerToken) != 2 {
+			return "", false, errors.New("Invalid token format")
+		}
+		return bearerToken[1], false, nil
+	}
+
+	if cookie, err := r.Cookie(SessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, true, nil
+	}
+	return "", false, errors.New("Unauthorized")
+}
+
+// validCSRF checks that the X-CSRF-Token header matches the CSRF cookie. With
+// HMACSecret set it also checks that the auth service issued the token for
+// the token's session, which the cookie comparison alone cannot.
+func (v *Verifier) validCSRF(r *http.Request, claims *Claims) bool {
+	cookie, err := r.Cookie(CSRFCookieName)
+	header := r.Header.Get(CSRFHeaderName)
+	if err != nil || header == "" || !hmac.Equal([]byte(header), []byte(cookie.Value)) {
+		return false
+	}
+	if len(v.HMACSecret) == 0 {
+		return true
+	}
+
+	// Tokens are "<base64url value>.<base64url HMAC-SHA256 of the value>"
+	parts := strings.Split(header, ".")
+	if len(parts) != 2 || claims.SessionID == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, v.HMACSecret)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal([]byte(parts[1]), []byte(base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))) {
+		return false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && string(value) == "csrf:"+claims.SessionID
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Role hierarchy of the auth service: Admin > Editor > Viewer
+var roleHierarchy = map[string]int{
+	"Viewer": 1,
+	"Editor": 2,
+	"Admin":  3,
+}
+
+// RoleSatisfies reports whether userRole is requiredRole or ranks above it
+func RoleSatisfies(userRole, requiredRole string) bool {
+	return roleHierarchy[userRole] >= roleHierarchy[requiredRole]
+}
+
+// HasRole reports whether the authenticated user has requiredRole or a higher one
+func HasRole(ctx context.Context, requiredRole string) bool {
+	role, ok := Role(ctx)
+	return ok && RoleSatisfies(role, requiredRole)
+}
+
+// RequireRole allows the request when the user has requiredRole or a higher
+// one, like the auth service's RBACMiddleware. Permissions cannot be checked
+// from the token; see the package documentation.
+func RequireRole(requiredRole string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasRole(r.Context(), requiredRole) {
+				http.Error(w, "Insufficient permissions", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRecentAuth demands that the user authenticated within maxAge, even
+// when the token itself is still valid. Clients recover by calling the auth
+// service's /auth/reauthenticate.
+func RequireRecentAuth(maxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authTime, ok := AuthTime(r.Context())
+			if !ok || time.Since(authTime) > maxAge {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_user_authentication", max_age=%d`, int(maxAge.Seconds())))
+				http.Error(w, "Recent authentication required", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NoImpersonation blocks sensitive actions for impersonation tokens
+func NoImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ActorID(r.Context()); ok {
+			http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,167 @@
+package authclient
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var testHMACSecret = []byte("test-secret")
+
+func signRS256(t *testing.T, server *jwksServer, kid string, claims *Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(server.key(kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func testClaims(role string) *Claims {
+	return &Claims{
+		UserID:    "7",
+		Role:      role,
+		SessionID: "3",
+		AuthTime:  time.Now().Unix(),
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    DefaultIssuer,
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+}
+
+// csrfToken is the auth service's CSRF token for the session
+func csrfToken(sessionID string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte("csrf:" + sessionID))
+	mac := hmac.New(sha256.New, testHMACSecret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	verifier := NewVerifier(server.URL)
+	token := signRS256(t, server, "k1", testClaims("Editor"))
+
+	var viaCookie bool
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserID(r.Context())
+		sessionID, _ := SessionID(r.Context())
+		if userID != 7 || sessionID != 3 {
+			t.Errorf("user_id = %d, session_id = %d", userID, sessionID)
+		}
+		viaCookie = ViaCookie(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if w := serve(handler, r); w.Code != http.StatusOK || viaCookie {
+		t.Errorf("bearer: status = %d, viaCookie = %v", w.Code, viaCookie)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: SessionCookieName, Value: token})
+	if w := serve(handler, r); w.Code != http.StatusOK || !viaCookie {
+		t.Errorf("cookie: status = %d, viaCookie = %v", w.Code, viaCookie)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{name: "no authentication", status: http.StatusUnauthorized},
+		{name: "malformed header", header: "Bearer", status: http.StatusUnauthorized},
+		{name: "invalid token", header: "Bearer " + token + "x", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if w := serve(handler, r); w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+func TestMiddlewareCSRF(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	token := signRS256(t, server, "k1", testClaims("Viewer"))
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	tests := []struct {
+		name   string
+		secret []byte
+		cookie string
+		header string
+		status int
+	}{
+		{name: "missing header", cookie: "abc", status: http.StatusForbidden},
+		{name: "mismatch", cookie: "abc", header: "abd", status: http.StatusForbidden},
+		{name: "double submit", cookie: "abc", header: "abc", status: http.StatusOK},
+		{name: "unsigned with secret", secret: testHMACSecret, cookie: "abc", header: "abc", status: http.StatusForbidden},
+		{name: "other session", secret: testHMACSecret, cookie: csrfToken("4"), header: csrfToken("4"), status: http.StatusForbidden},
+		{name: "signed for session", secret: testHMACSecret, cookie: csrfToken("3"), header: csrfToken("3"), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		verifier := NewVerifier(server.URL)
+		verifier.HMACSecret = tt.secret
+
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.AddCookie(&http.Cookie{Name: SessionCookieName, Value: token})
+		r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: tt.cookie})
+		if tt.header != "" {
+			r.Header.Set(CSRFHeaderName, tt.header)
+		}
+		if w := serve(verifier.Middleware(ok), r); w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+func TestRequireRoleAndNoImpersonation(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	verifier := NewVerifier(server.URL)
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	impersonation := testClaims("Admin")
+	impersonation.Act = &Actor{UserID: "1"}
+	stale := testClaims("Admin")
+	stale.AuthTime = time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		claims  *Claims
+		handler http.Handler
+		status  int
+	}{
+		{name: "role below", claims: testClaims("Viewer"), handler: RequireRole("Editor")(ok), status: http.StatusForbidden},
+		{name: "role above", claims: testClaims("Admin"), handler: RequireRole("Editor")(ok), status: http.StatusOK},
+		{name: "impersonating", claims: impersonation, handler: NoImpersonation(ok), status: http.StatusForbidden},
+		{name: "not impersonating", claims: testClaims("Admin"), handler: NoImpersonation(ok), status: http.StatusOK},
+		{name: "stale auth", claims: stale, handler: RequireRecentAuth(5 * time.Minute)(ok), status: http.StatusUnauthorized},
+		{name: "recent auth", claims: testClaims("Viewer"), handler: RequireRecentAuth(5 * time.Minute)(ok), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+signRS256(t, server, "k1", tt.claims))
+		if w := serve(verifier.Middleware(tt.handler), r); w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
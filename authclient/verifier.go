@@ -0,0 +1,128 @@
+// Package authclient lets other services authenticate requests carrying tokens
+// issued by this service. Tokens are verified against the service's JWKS at
+// /.well-known/jwks.json, so services need no shared secret.
+//
+//	verifier := authclient.NewVerifier("https://auth.example.com/.well-known/jwks.json")
+//	router.Use(verifier.Middleware)
+//	router.Handle("/reports", authclient.RequireRole("Editor")(reports))
+//
+// Browser requests without an Authorization header are authenticated by the
+// auth service's session cookie, with the same CSRF check for unsafe methods.
+//
+// Verification is stateless: unlike the auth service itself, it cannot tell
+// that a token's session was revoked or its user suspended before the token
+// expires. Endpoints that need that guarantee should go through the service's
+// /auth/verify forward-auth endpoint instead.
+//
+// For the same reason there is no counterpart to the service's
+// PermissionMiddleware. Tokens carry the user's role, but permissions are
+// granted to roles and groups in the service's database, so only RequireRole
+// can be checked here. Endpoints that need more should be routed through
+// /auth/verify with a FORWARD_AUTH_RULES role for their host.
+package authclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// DefaultIssuer is the iss claim of tokens issued by the auth service
+const DefaultIssuer = "BlogPlatform"
+
+var (
+	// ErrInvalidToken is returned for tokens that are malformed, expired or not
+	// signed by the auth service
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrUnknownKey is returned when the token's key ID is not in the JWKS
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrKeySetUnavailable is returned when the token's key is not cached and
+	// the JWKS could not be fetched
+	ErrKeySetUnavailable = errors.New("signing keys unavailable")
+)
+
+// Claims are the claims of the auth service's access tokens
+type Claims struct {
+	UserID   string   `json:"user_id"`
+	Role     string   `json:"role"`
+	Act      *Actor   `json:"act,omitempty"`
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	// SessionID is the server-side session the token was issued for
+	SessionID string `json:"sid,omitempty"`
+	jwt.StandardClaims
+}
+
+// Actor identifies the real user acting on behalf of the token subject
+type Actor struct {
+	UserID string `json:"sub"`
+}
+
+// IsImpersonation reports whether the token was issued to an admin acting as another user
+func (c *Claims) IsImpersonation() bool {
+	return c.Act != nil
+}
+
+// Verifier checks tokens issued by the auth service
+type Verifier struct {
+	// Keys are the auth service's RS256 signing keys
+	Keys *KeySet
+	// HMACSecret, when set, also accepts HS256 tokens signed with the auth
+	// service's JWT_SECRET, for deployments that have not moved to RS256 yet
+	HMACSecret []byte
+	// Issuer is the required iss claim; any issuer is accepted when empty
+	Issuer string
+}
+
+// NewVerifier returns a verifier for tokens signed with the keys published at jwksURL
+func NewVerifier(jwksURL string) *Verifier {
+	return &Verifier{Keys: NewKeySet(jwksURL), Issuer: DefaultIssuer}
+}
+
+// Verify checks the token's signature, expiry and issuer and returns its claims
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA:
+			if v.Keys == nil {
+				return nil, ErrUnknownKey
+			}
+			kid, _ := token.Header["kid"].(string)
+			return v.Keys.Key(ctx, kid)
+		case *jwt.SigningMethodHMAC:
+			if len(v.HMACSecret) > 0 {
+				return v.HMACSecret, nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	})
+	if err != nil {
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && validationErr.Inner != nil &&
+			(errors.Is(validationErr.Inner, ErrUnknownKey) || errors.Is(validationErr.Inner, ErrKeySetUnavailable)) {
+			return nil, validationErr.Inner
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	if v.Issuer != "" && !claims.VerifyIssuer(v.Issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	// The auth service only honours tokens for numeric user IDs
+	if _, err := strconv.ParseUint(claims.UserID, 10, 64); err != nil {
+		return nil, fmt.Errorf("%w: invalid user_id", ErrInvalidToken)
+	}
+	if claims.IsImpersonation() {
+		if _, err := strconv.ParseUint(claims.Act.UserID, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: invalid act", ErrInvalidToken)
+		}
+	}
+	return claims, nil
+}
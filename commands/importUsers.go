@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hells/services"
+)
+
+// ImportUsers bulk-creates users from a CSV or JSON file and prints the per-row
+// report as JSON:
+//
+//	hells import-users -file users.csv [-format csv|json] [-dry-run]
+func ImportUsers(args []string) error {
+	flags := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	file := flags.String("file", "", "CSV or JSON file to import")
+	format := flags.String("format", "", "input format, csv or json (default: from the file extension)")
+	dryRun := flags.Bool("dry-run", false, "validate and report without creating users")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*file)), ".")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rows, err := services.ParseUserImport(f, *format)
+	if err != nil {
+		return err
+	}
+
+	report, err := services.ImportUsers(rows, services.UserImportOptions{DryRun: *dryRun, IPAddress: "cli"})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+
+	if report.Invalid > 0 {
+		return fmt.Errorf("import rejected: %d invalid rows", report.Invalid)
+	}
+	return nil
+}
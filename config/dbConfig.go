@@ -44,23 +44,47 @@ func InitDatabase() (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to connect to database: %v", err)
 	}
 
-	if err := InitializeRoles(db); err != nil {
-		return nil, fmt.Errorf("failed to initialize roles: %v", err)
+	if err := MigrateDatabase(db); err != nil {
+		return nil, err
 	}
 
+	return db, nil
+}
+
+// MigrateDatabase creates the tables and default roles
+func MigrateDatabase(db *gorm.DB) error {
 	// Auto migrate models
-	err = db.AutoMigrate(
+	err := db.AutoMigrate(
 		&models.User{},
 		&models.Role{},
 		&models.Post{},
 		&models.Permission{},
 		&models.PasswordReset{},
+		&models.Organization{},
+		&models.OrganizationMember{},
+		&models.Invitation{},
+		&models.Group{},
+		&models.AuditLog{},
+		&models.ImpersonationSession{},
+		&models.Session{},
+		&models.LoginThrottle{},
+		&models.RateLimitCounter{},
+		&models.EmailChange{},
+		&models.AccountDeletion{},
+		&models.DataExport{},
+		&models.Suspension{},
+		&models.SAMLProvider{},
+		&models.SAMLIdentity{},
+		&models.SAMLRequest{},
 	)
 	if err != nil {
-		return nil, fmt.Errorf("database migration failed: %v", err)
+		return fmt.Errorf("database migration failed: %v", err)
 	}
 
-	return db, nil
+	if err := InitializeRoles(db); err != nil {
+		return fmt.Errorf("failed to initialize roles: %v", err)
+	}
+	return nil
 }
 
 func SeedDatabase(db *gorm.DB) error {
@@ -102,7 +126,19 @@ func SeedDatabase(db *gorm.DB) error {
 	return nil
 }
 
+// testDB replaces the MySQL connection in tests, see UseDatabase
+var testDB *gorm.DB
+
+// UseDatabase makes GetDB return db instead of connecting to MySQL. Tests use
+// it with an in-memory database; pass nil to restore the default.
+func UseDatabase(db *gorm.DB) {
+	testDB = db
+}
+
 func GetDB() *gorm.DB {
+	if testDB != nil {
+		return testDB
+	}
 	db, _ := InitDatabase()
 	return db
 }
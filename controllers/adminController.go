@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+func Impersonate(w http.ResponseWriter, r *http.Request) {
+	subjectID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	// Reason is optional, so an empty body is accepted
+	json.NewDecoder(r.Body).Decode(&req)
+
+	actorID := context.Get(r, "user_id").(uint)
+	token, session, err := services.StartImpersonation(actorID, subjectID, req.Reason, r.UserAgent(), utils.ClientIP(r))
+	if errors.Is(err, services.ErrImpersonationNotAllowed) {
+		utils.SendErrorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"subject_id": session.SubjectID,
+		"expires_at": session.ExpiresAt,
+	})
+}
+
+func EndImpersonation(w http.ResponseWriter, r *http.Request) {
+	if _, ok := context.GetOk(r, "actor_id"); !ok {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Not an impersonation token")
+		return
+	}
+
+	tokenID := context.Get(r, "token_id").(string)
+	if err := services.EndImpersonation(tokenID, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Impersonation ended"})
+}
+
+// UnlockUser lifts a login lockout on the user's account
+func UnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	user, err := services.FindUserByID(userID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	actorID := auditActorID(r)
+	if err := services.UnlockAccount(user, actorID, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to unlock user")
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "User unlocked"})
+}
+
+// DeleteUser deletes a user's account, starting the restore grace period
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	// Reason is optional, so an empty body is accepted
+	json.NewDecoder(r.Body).Decode(&req)
+
+	actorID := auditActorID(r)
+	deletion, err := services.DeleteAccount(userID, actorID, req.Reason, utils.ClientIP(r))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, deletion)
+}
+
+func RestoreUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	actorID := auditActorID(r)
+	if err := services.RestoreAccount(userID, actorID, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "User restored"})
+}
+
+func SuspendUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Reason string     `json:"reason"`
+		Until  *time.Time `json:"until"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "A reason is required")
+		return
+	}
+
+	actorID := auditActorID(r)
+	suspension, err := services.SuspendUser(userID, actorID, req.Reason, req.Until, utils.ClientIP(r))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, suspension)
+}
+
+func ReactivateUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	actorID := auditActorID(r)
+	if err := services.ReactivateUser(userID, actorID, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "User reactivated"})
+}
+
+func ListAuditLogs(w http.ResponseWriter, r *http.Request) {
+	page := 1
+	limit := 50
+	if pageNum, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && pageNum > 0 {
+		page = pageNum
+	}
+	if limitNum, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limitNum > 0 {
+		limit = min(limitNum, services.MaxAuditLogPageSize)
+	}
+
+	entries, total, err := services.ListAuditLogs(page, limit)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve audit logs")
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
+
+// ImportUsers bulk-creates users from a CSV or JSON body. The format comes from
+// the format query parameter or the Content-Type, and dry_run=true only reports
+// what would happen.
+func ImportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = "csv"
+		case "application/json":
+			format = "json"
+		}
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	rows, err := services.ParseUserImport(http.MaxBytesReader(w, r.Body, 10<<20), format)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report, err := services.ImportUsers(rows, services.UserImportOptions{
+		DryRun:    dryRun,
+		ActorID:   auditActorID(r),
+		IPAddress: utils.ClientIP(r),
+	})
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Import failed: "+err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	if report.Invalid > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	utils.SendJSONResponse(w, status, report)
+}
+
+// auditActorID is the user to record as the actor of an action: the admin
+// behind an impersonation token, otherwise the authenticated user
+func auditActorID(r *http.Request) uint {
+	if actorID, ok := context.GetOk(r, "actor_id"); ok {
+		return actorID.(uint)
+	}
+	return context.Get(r, "user_id").(uint)
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"hells/models"
+	"hells/services"
+	"hells/testutil"
+)
+
+func TestListAuditLogsCapsLimit(t *testing.T) {
+	db := testutil.NewDB(t)
+	for i := 0; i < services.MaxAuditLogPageSize+5; i++ {
+		db.Create(&models.AuditLog{Action: "user.login"})
+	}
+
+	w := httptest.NewRecorder()
+	ListAuditLogs(w, httptest.NewRequest("GET", "/admin/audit-logs?limit=100000", nil))
+	var body struct {
+		Entries []models.AuditLog `json:"entries"`
+		Limit   int               `json:"limit"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if body.Limit != services.MaxAuditLogPageSize || len(body.Entries) != services.MaxAuditLogPageSize {
+		t.Errorf("limit = %d, entries = %d", body.Limit, len(body.Entries))
+	}
+}
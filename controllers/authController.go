@@ -2,7 +2,11 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"hells/models"
@@ -10,18 +14,21 @@ import (
 	"hells/utils"
 
 	"github.com/gorilla/context"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Username        string `json:"username"`
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	InvitationToken string `json:"invitation_token"`
 }
 
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// UseCookie selects cookie mode: the token is set as an HttpOnly cookie
+	// instead of being returned in the response body
+	UseCookie bool `json:"use_cookie"`
 }
 
 func Register(w http.ResponseWriter, r *http.Request) {
@@ -32,8 +39,28 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Validate invitation before creating the account
+	if req.InvitationToken != "" {
+		invitation, err := services.FindInvitationByToken(req.InvitationToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !strings.EqualFold(invitation.Email, req.Email) {
+			http.Error(w, "Invitation was sent to a different email address", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Enforce password policy
+	var policyErr *utils.PasswordPolicyError
+	if err := utils.DefaultPasswordPolicy().Validate(req.Password, req.Username, req.Email); errors.As(err, &policyErr) {
+		utils.SendPasswordPolicyError(w, policyErr)
+		return
+	}
+
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
 		http.Error(w, "Password hashing failed", http.StatusInternalServerError)
 		return
@@ -43,12 +70,13 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	user := models.User{
 		Username:     req.Username,
 		Email:        req.Email,
-		PasswordHash: string(hashedPassword),
+		PasswordHash: hashedPassword,
 		RoleID:       2, // Default to Viewer role
 		IsActive:     true,
 	}
 
-	if err := services.CreateUser(&user); err != nil {
+	// Create the account and join the inviting organization together
+	if err := services.RegisterUser(&user, req.InvitationToken); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -65,29 +93,55 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := services.FindUserByEmail(req.Email)
-	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	// Refuse attempts while the account or IP is backing off or locked
+	ipAddress := utils.ClientIP(r)
+	if wait := services.LoginRetryAfter(req.Email, ipAddress); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
 		return
 	}
 
-	// Check password
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password))
+	// Check credentials with the configured authentication backends
+	user, err := services.Authenticate(req.Email, req.Password)
+	if errors.Is(err, services.ErrAuthBackendUnavailable) {
+		http.Error(w, "Authentication service unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
+		var userID uint
+		if user != nil {
+			userID = user.ID
+		}
+		services.RecordLoginFailure(req.Email, ipAddress, userID)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	services.RecordLoginSuccess(req.Email)
+
+	// Suspended accounts may not sign in
+	if !user.IsActive {
+		http.Error(w, "Account is suspended", http.StatusForbidden)
+		return
+	}
 
-	// Generate JWT token
-	token, err := utils.GenerateJWT(string(user.ID), user.Role.Name)
+	session, token, err := startLoginSession(r, user, "pwd")
 	if err != nil {
-		http.Error(w, "Token generation failed", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Update last login
-	user.LastLogin = time.Now()
-	services.UpdateUser(user)
+	if req.UseCookie {
+		csrfToken := utils.GenerateCSRFToken(strconv.FormatUint(uint64(session.ID), 10))
+		utils.SetSessionCookies(w, token, csrfToken, session.ExpiresAt)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"csrf_token": csrfToken,
+			"username":   user.Username,
+			"role":       user.Role.Name,
+		})
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -97,6 +151,152 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// startLoginSession creates the server-side session for a user who has just
+// signed in and returns it with its JWT. amr records how they authenticated.
+func startLoginSession(r *http.Request, user *models.User, amr string) (*models.Session, string, error) {
+	session, err := services.CreateSession(user.ID, r.UserAgent(), utils.ClientIP(r), utils.AccessTokenTTL)
+	if err != nil {
+		return nil, "", errors.New("Session creation failed")
+	}
+
+	token, err := utils.GenerateJWT(
+		strconv.FormatUint(uint64(user.ID), 10),
+		user.Role.Name,
+		strconv.FormatUint(uint64(session.ID), 10),
+		amr,
+	)
+	if err != nil {
+		return nil, "", errors.New("Token generation failed")
+	}
+
+	// Update last login
+	user.LastLogin = time.Now()
+	services.UpdateUser(user)
+	return session, token, nil
+}
+
+// Logout revokes the current session and clears the session cookies
+func Logout(w http.ResponseWriter, r *http.Request) {
+	userID := context.Get(r, "user_id").(uint)
+	if sessionID, ok := context.GetOk(r, "session_id"); ok {
+		if err := services.RevokeSession(userID, sessionID.(uint), userID, utils.ClientIP(r)); err != nil {
+			utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to end session")
+			return
+		}
+	}
+
+	utils.ClearSessionCookies(w)
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Logged out"})
+}
+
+// Reauthenticate confirms the current user's password and returns a short-lived
+// token with a fresh auth_time for sensitive operations
+func Reauthenticate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := services.FindUserByID(context.Get(r, "user_id").(uint))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	// SAML users have no password here; they step up through their IdP
+	if user.AuthSource == "saml" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Re-authenticate with your identity provider at /auth/reauthenticate/saml")
+		return
+	}
+
+	if err := services.VerifyUserPassword(user, req.Password); err != nil {
+		utils.SendErrorResponse(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	// The elevated token stays tied to the current session
+	claims := &utils.Claims{
+		UserID:    strconv.FormatUint(uint64(user.ID), 10),
+		Role:      user.Role.Name,
+		AuthTime:  time.Now().Unix(),
+		AMR:       []string{"pwd"},
+		SessionID: strconv.FormatUint(uint64(context.Get(r, "session_id").(uint)), 10),
+	}
+	token, err := utils.SignClaims(claims, stepUpTokenTTL())
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Token generation failed")
+		return
+	}
+
+	// Cookie clients get the elevated token as their session cookie
+	if viaCookie, _ := context.Get(r, "auth_via_cookie").(bool); viaCookie {
+		expiresAt := time.Unix(claims.ExpiresAt, 0)
+		utils.SetSessionCookies(w, token, utils.GenerateCSRFToken(claims.SessionID), expiresAt)
+		utils.SendJSONResponse(w, http.StatusOK, map[string]interface{}{"expires_at": expiresAt})
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"expires_at": time.Unix(claims.ExpiresAt, 0),
+	})
+}
+
+// ReauthenticateSAML starts a forced sign-in at the user's SAML identity
+// provider. The browser is sent to redirect_url and comes back through the ACS
+// with an elevated session cookie, landing on return_to.
+func ReauthenticateSAML(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ReturnTo string `json:"return_to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID := context.Get(r, "user_id").(uint)
+	sessionID := context.Get(r, "session_id").(uint)
+	redirect, err := services.StartSAMLReauthentication(userID, sessionID, req.ReturnTo)
+	if errors.Is(err, services.ErrSAMLNotConfigured) {
+		utils.SendErrorResponse(w, http.StatusNotFound, "No identity provider to re-authenticate with")
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to start re-authentication")
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"redirect_url": redirect})
+}
+
+func stepUpTokenTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("STEP_UP_TOKEN_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 10 * time.Minute
+}
+
+// UnlockAccount lifts a lockout using the link emailed when the account was locked
+func UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := services.UnlockAccountWithToken(req.Token, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Account unlocked"})
+}
+
 func ResetPassword(w http.ResponseWriter, r *http.Request) {
 	type ResetRequest struct {
 		Email       string `json:"email"`
@@ -113,6 +313,11 @@ func ResetPassword(w http.ResponseWriter, r *http.Request) {
 
 	// Verify reset token and reset password
 	err = services.ResetUserPassword(req.Email, req.Token, req.NewPassword)
+	var policyErr *utils.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		utils.SendPasswordPolicyError(w, policyErr)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -122,14 +327,9 @@ func ResetPassword(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successful"})
 }
 
-func GetProfile(w http.ResponseWriter, r *http.Request) {
-	userID := context.Get(r, "user_id").(uint)
-	user, err := services.FindUserByID(userID)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
+// GetJWKS publishes the public keys tokens are signed with, so other services
+// can verify them without sharing JWT_SECRET
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.SendJSONResponse(w, http.StatusOK, utils.PublicKeySet())
 }
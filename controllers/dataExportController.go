@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+func RequestMyDataExport(w http.ResponseWriter, r *http.Request) {
+	userID := context.Get(r, "user_id").(uint)
+	requestDataExport(w, r, userID)
+}
+
+func GetMyDataExport(w http.ResponseWriter, r *http.Request) {
+	getDataExport(w, r, context.Get(r, "user_id").(uint))
+}
+
+func RequestUserDataExport(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+	requestDataExport(w, r, userID)
+}
+
+func GetUserDataExport(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+	getDataExport(w, r, userID)
+}
+
+// DownloadDataExport serves an export archive through its signed, expiring URL.
+// The archive is deleted once it has been sent.
+func DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	exportID, ok := parseIDParam(w, r, "id", "Invalid export ID")
+	if !ok {
+		return
+	}
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusForbidden, "Invalid download link")
+		return
+	}
+
+	export, err := services.OpenDataExport(exportID, expires, r.URL.Query().Get("signature"))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	file, err := os.Open(export.FilePath)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusGone, "Export is no longer available")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		services.ReleaseDataExport(export)
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to read export")
+		return
+	}
+
+	// The whole archive is sent in one response; range requests would let a
+	// client fetch it piece by piece after it has been deleted
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="data-export-%d.zip"`, export.ID))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("Error sending export %d: %v", export.ID, err)
+		services.ReleaseDataExport(export)
+		return
+	}
+
+	file.Close()
+	services.FinishDataExportDownload(export)
+}
+
+func requestDataExport(w http.ResponseWriter, r *http.Request, userID uint) {
+	requestedByID := auditActorID(r)
+	export, err := services.RequestDataExport(userID, requestedByID, utils.ClientIP(r))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusAccepted, export)
+}
+
+func getDataExport(w http.ResponseWriter, r *http.Request, userID uint) {
+	exportID, ok := parseIDParam(w, r, "exportId", "Invalid export ID")
+	if !ok {
+		return
+	}
+
+	export, err := services.FindDataExport(userID, exportID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, export)
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const exportContent = "PK fake archive contents"
+
+func createReadyExport(t *testing.T, db *gorm.DB) (*models.DataExport, string) {
+	t.Helper()
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	path := filepath.Join(t.TempDir(), "export.zip")
+	if err := os.WriteFile(path, []byte(exportContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	export := models.DataExport{UserID: user.ID, Status: "ready", FilePath: path, ExpiresAt: &expiresAt}
+	if err := db.Create(&export).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	query := url.Values{
+		"expires":   {strconv.FormatInt(expiresAt.Unix(), 10)},
+		"signature": {utils.SignValue(fmt.Sprintf("export:%d:%d", export.ID, expiresAt.Unix()))},
+	}
+	return &export, query.Encode()
+}
+
+func downloadExport(export *models.DataExport, query string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/exports/"+strconv.FormatUint(uint64(export.ID), 10)+"/download?"+query, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.FormatUint(uint64(export.ID), 10)})
+	w := httptest.NewRecorder()
+	DownloadDataExport(w, r)
+	return w
+}
+
+func TestDownloadDataExportOnce(t *testing.T) {
+	db := testutil.NewDB(t)
+	export, query := createReadyExport(t, db)
+
+	// A range request still gets the whole archive
+	w := downloadExport(export, query, http.Header{"Range": {"bytes=0-1"}})
+	if w.Code != http.StatusOK || w.Body.String() != exportContent {
+		t.Fatalf("first download: %d %q", w.Code, w.Body)
+	}
+	if w.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("Accept-Ranges = %q", w.Header().Get("Accept-Ranges"))
+	}
+	if _, err := os.Stat(export.FilePath); !os.IsNotExist(err) {
+		t.Error("archive was not deleted")
+	}
+
+	if w := downloadExport(export, query, nil); w.Code != http.StatusForbidden {
+		t.Errorf("second download: %d", w.Code)
+	}
+	db.First(export, export.ID)
+	if export.Status != "downloaded" || export.DownloadedAt == nil {
+		t.Errorf("export = %+v", export)
+	}
+}
+
+func TestDownloadDataExportConcurrent(t *testing.T) {
+	db := testutil.NewDB(t)
+	export, query := createReadyExport(t, db)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	served := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := downloadExport(export, query, nil); w.Code == http.StatusOK {
+				mu.Lock()
+				served++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if served != 1 {
+		t.Errorf("served %d times, want once", served)
+	}
+}
+
+func TestDownloadDataExportInvalidLink(t *testing.T) {
+	db := testutil.NewDB(t)
+	export, _ := createReadyExport(t, db)
+
+	query := url.Values{
+		"expires":   {strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)},
+		"signature": {utils.SignValue(fmt.Sprintf("export:%d:%d", export.ID+1, time.Now().Add(time.Hour).Unix()))},
+	}
+	if w := downloadExport(export, query.Encode(), nil); w.Code != http.StatusForbidden {
+		t.Errorf("status = %d", w.Code)
+	}
+	db.First(export, export.ID)
+	if export.Status != "ready" {
+		t.Errorf("status = %s, an invalid link claimed the export", export.Status)
+	}
+}
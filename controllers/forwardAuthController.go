@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"hells/middleware"
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+// VerifyForwardAuth answers forward-auth subrequests from reverse proxies (nginx
+// auth_request, Traefik and Caddy forward_auth). It authenticates the request
+// like AuthMiddleware and passes the user on in X-User-* headers, which the
+// proxy copies to the upstream.
+//
+// Hosts listed in FORWARD_AUTH_RULES additionally require a minimum role. With
+// ?redirect=true, browsers without a valid session are sent to the login page
+// instead of receiving a 401.
+func VerifyForwardAuth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if status, err := middleware.AuthenticateForwardedRequest(r, forwardedMethod(r), forwardedURL(r)); err != nil {
+		if status == http.StatusUnauthorized && r.URL.Query().Get("redirect") == "true" && acceptsHTML(r) {
+			http.Redirect(w, r, forwardAuthLoginURL(r), http.StatusFound)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	role := context.Get(r, "role").(string)
+	if required := forwardAuthRequiredRole(forwardedHost(r)); required != "" && !middleware.HasRole(r, required) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	userID := context.Get(r, "user_id").(uint)
+	user, err := services.FindUserByID(userID)
+	if err != nil {
+		http.Error(w, "Account is not active", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("X-User-Id", strconv.FormatUint(uint64(userID), 10))
+	w.Header().Set("X-User-Role", role)
+	w.Header().Set("X-User-Email", user.Email)
+	w.WriteHeader(http.StatusOK)
+}
+
+// forwardAuthRequiredRole returns the role required for host by the
+// FORWARD_AUTH_RULES list of host=Role pairs, e.g.
+// "grafana.example.com=Admin,*.internal.example.com=Editor". Exact hosts take
+// precedence over wildcards.
+func forwardAuthRequiredRole(host string) string {
+	host = strings.ToLower(host)
+	wildcardRole := ""
+	for _, rule := range strings.Split(os.Getenv("FORWARD_AUTH_RULES"), ",") {
+		pattern, role, ok := strings.Cut(rule, "=")
+		if !ok {
+			continue
+		}
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		role = strings.TrimSpace(role)
+
+		if pattern == host {
+			return role
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasSuffix(host, suffix) && wildcardRole == "" {
+			wildcardRole = role
+		}
+	}
+	return wildcardRole
+}
+
+// forwardedHeader returns the proxy header name, or "" when the request did not
+// come from a trusted proxy and the client could have set it
+func forwardedHeader(r *http.Request, name string) string {
+	if !utils.FromTrustedProxy(r) {
+		return ""
+	}
+	return r.Header.Get(name)
+}
+
+// forwardedMethod is the method of the request the proxy is authorizing, so that
+// cookie clients still need a CSRF token for unsafe methods. Browsers cannot set
+// these headers on cross-site requests, so they are honoured from any client.
+func forwardedMethod(r *http.Request) string {
+	for _, name := range []string{"X-Forwarded-Method", "X-Original-Method"} {
+		if method := r.Header.Get(name); method != "" {
+			return strings.ToUpper(method)
+		}
+	}
+	return r.Method
+}
+
+// forwardedHost is the host of the request the proxy is authorizing, without its port
+func forwardedHost(r *http.Request) string {
+	host := forwardedHeader(r, "X-Forwarded-Host")
+	if host == "" {
+		if original, err := url.Parse(forwardedHeader(r, "X-Original-URL")); err == nil && original.Host != "" {
+			host = original.Host
+		} else {
+			host = r.Host
+		}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// forwardedURL rebuilds the URL the browser asked the proxy for. nginx passes it
+// in X-Original-URL; Traefik and Caddy send X-Forwarded-Proto/Host/Uri. Like
+// forwardedHost, it ignores these headers unless a trusted proxy sent them.
+func forwardedURL(r *http.Request) string {
+	if original := forwardedHeader(r, "X-Original-URL"); original != "" {
+		return original
+	}
+
+	proto := forwardedHeader(r, "X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	host := forwardedHeader(r, "X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	uri := forwardedHeader(r, "X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+	}
+	return proto + "://" + host + uri
+}
+
+// forwardAuthLoginURL is FORWARD_AUTH_LOGIN_URL, or the frontend login page,
+// with the original URL to return to after signing in
+func forwardAuthLoginURL(r *http.Request) string {
+	loginURL := os.Getenv("FORWARD_AUTH_LOGIN_URL")
+	if loginURL == "" {
+		loginURL = utils.FrontendURL("/login")
+	}
+
+	separator := "?"
+	if strings.Contains(loginURL, "?") {
+		separator = "&"
+	}
+	return loginURL + separator + "return_to=" + url.QueryEscape(forwardedURL(r))
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/services"
+	"hells/testutil"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+func TestVerifyForwardAuth(t *testing.T) {
+	t.Setenv("FORWARD_AUTH_RULES", "grafana.example.com=Admin, *.internal.example.com=Editor")
+	t.Setenv("FORWARD_AUTH_LOGIN_URL", "https://auth.example.com/login")
+	t.Setenv("TRUSTED_PROXIES", "192.0.2.1")
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Editor")
+	session, err := services.CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := utils.GenerateJWT(strconv.FormatUint(uint64(user.ID), 10), "Editor", strconv.FormatUint(uint64(session.ID), 10), "pwd")
+
+	tests := []struct {
+		name     string
+		token    string
+		host     string
+		query    string
+		accept   string
+		status   int
+		location string
+	}{
+		{name: "no rule", token: token, host: "blog.example.com", status: http.StatusOK},
+		{name: "wildcard rule", token: token, host: "wiki.internal.example.com:8443", status: http.StatusOK},
+		{name: "role too low", token: token, host: "grafana.example.com", status: http.StatusForbidden},
+		{name: "no token", host: "blog.example.com", status: http.StatusUnauthorized},
+		{name: "no token, api", host: "blog.example.com", query: "?redirect=true", accept: "application/json", status: http.StatusUnauthorized},
+		{
+			name: "no token, browser", host: "blog.example.com", query: "?redirect=true", accept: "text/html",
+			status: http.StatusFound, location: "https://auth.example.com/login?return_to=https%3A%2F%2Fblog.example.com%2Fposts%3Fpage%3D2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/auth/verify"+tt.query, nil)
+			defer context.Clear(r)
+			r.Header.Set("X-Forwarded-Host", tt.host)
+			r.Header.Set("X-Forwarded-Uri", "/posts?page=2")
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+
+			VerifyForwardAuth(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.location != "" && w.Header().Get("Location") != tt.location {
+				t.Errorf("Location = %s", w.Header().Get("Location"))
+			}
+			if tt.status == http.StatusOK {
+				if w.Header().Get("X-User-Id") != strconv.FormatUint(uint64(user.ID), 10) ||
+					w.Header().Get("X-User-Role") != "Editor" || w.Header().Get("X-User-Email") != user.Email {
+					t.Errorf("headers = %v", w.Header())
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyForwardAuthOriginalRequest(t *testing.T) {
+	t.Setenv("FORWARD_AUTH_LOGIN_URL", "https://auth.example.com/login")
+	t.Setenv("TRUSTED_PROXIES", "192.0.2.1")
+	db := testutil.NewDB(t)
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	session, _ := services.CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+	sessionID := strconv.FormatUint(uint64(session.ID), 10)
+	token, _ := utils.GenerateJWT(strconv.FormatUint(uint64(user.ID), 10), "Viewer", sessionID, "pwd")
+	csrf := utils.GenerateCSRFToken(sessionID)
+
+	verify := func(remote string, headers map[string]string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/auth/verify?redirect=true", nil)
+		defer context.Clear(r)
+		r.RemoteAddr = remote + ":1234"
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		VerifyForwardAuth(w, r)
+		return w
+	}
+	sessionCookie := &http.Cookie{Name: utils.SessionCookieName, Value: token}
+
+	// Cookie clients need a CSRF token for the unsafe method the proxy received
+	if w := verify("192.0.2.1", map[string]string{"X-Forwarded-Method": "POST"}, sessionCookie); w.Code != http.StatusForbidden {
+		t.Errorf("POST without CSRF token: status = %d, want 403", w.Code)
+	}
+	headers := map[string]string{"X-Original-Method": "DELETE", utils.CSRFHeaderName: csrf}
+	if w := verify("192.0.2.1", headers, sessionCookie, &http.Cookie{Name: utils.CSRFCookieName, Value: csrf}); w.Code != http.StatusOK {
+		t.Errorf("DELETE with CSRF token: status = %d, want 200", w.Code)
+	}
+
+	// Only trusted proxies choose the URL to return to
+	forwarded := map[string]string{"Accept": "text/html", "X-Forwarded-Host": "evil.example.net", "X-Forwarded-Uri": "/phish"}
+	if w := verify("203.0.113.9", forwarded); w.Header().Get("Location") != "https://auth.example.com/login?return_to=https%3A%2F%2Fexample.com%2F" {
+		t.Errorf("untrusted proxy: Location = %s", w.Header().Get("Location"))
+	}
+
+	// Impersonated requests are audited with the URL the proxy received
+	impersonation, _, err := services.StartImpersonation(admin.ID, user.ID, "support", "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded = map[string]string{
+		"Authorization":      "Bearer " + impersonation,
+		"X-Forwarded-Method": "GET",
+		"X-Forwarded-Host":   "wiki.example.com",
+		"X-Forwarded-Uri":    "/private",
+	}
+	if w := verify("192.0.2.1", forwarded); w.Code != http.StatusOK {
+		t.Fatalf("impersonated request: status = %d", w.Code)
+	}
+	var audit models.AuditLog
+	db.Where("action = ?", "impersonation.request").Last(&audit)
+	if !strings.HasSuffix(audit.Details, "GET https://wiki.example.com/private") {
+		t.Errorf("audit details = %q", audit.Details)
+	}
+}
+
+func TestForwardAuthRequiredRole(t *testing.T) {
+	t.Setenv("FORWARD_AUTH_RULES", "*.example.com=Viewer,admin.example.com=Admin")
+
+	tests := map[string]string{
+		"admin.example.com": "Admin",
+		"ADMIN.example.com": "Admin",
+		"blog.example.com":  "Viewer",
+		"example.org":       "",
+	}
+	for host, want := range tests {
+		if got := forwardAuthRequiredRole(host); got != want {
+			t.Errorf("forwardAuthRequiredRole(%s) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"hells/models"
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/mux"
+)
+
+func ListGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := services.ListGroups()
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve groups")
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, groups)
+}
+
+func CreateGroup(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	group := models.Group{Name: req.Name, Description: req.Description}
+	if err := services.CreateGroup(&group); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusCreated, group)
+}
+
+func GetGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := parseIDParam(w, r, "id", "Invalid group ID")
+	if !ok {
+		return
+	}
+
+	group, err := services.FindGroupByID(groupID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	// Clear sensitive data before sending
+	for i := range group.Members {
+		group.Members[i].PasswordHash = ""
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, group)
+}
+
+func DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := parseIDParam(w, r, "id", "Invalid group ID")
+	if !ok {
+		return
+	}
+
+	if err := services.DeleteGroup(groupID); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Group deleted"})
+}
+
+func AddGroupMember(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := parseIDParam(w, r, "id", "Invalid group ID")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := services.AddGroupMember(groupID, req.UserID); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Member added"})
+}
+
+func RemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := parseIDParam(w, r, "id", "Invalid group ID")
+	if !ok {
+		return
+	}
+	userID, ok := parseIDParam(w, r, "userId", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	if err := services.RemoveGroupMember(groupID, userID); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Member removed"})
+}
+
+func GrantGroupRole(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := parseIDParam(w, r, "id", "Invalid group ID")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		RoleID uint `json:"role_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RoleID == 0 {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := services.GrantGroupRole(groupID, req.RoleID); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Role granted"})
+}
+
+func RevokeGroupRole(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := parseIDParam(w, r, "id", "Invalid group ID")
+	if !ok {
+		return
+	}
+	roleID, ok := parseIDParam(w, r, "roleId", "Invalid role ID")
+	if !ok {
+		return
+	}
+
+	if err := services.RevokeGroupRole(groupID, roleID); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Role revoked"})
+}
+
+func GrantGroupPermission(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := parseIDParam(w, r, "id", "Invalid group ID")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		PermissionID uint `json:"permission_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PermissionID == 0 {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := services.GrantGroupPermission(groupID, req.PermissionID); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Permission granted"})
+}
+
+func RevokeGroupPermission(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := parseIDParam(w, r, "id", "Invalid group ID")
+	if !ok {
+		return
+	}
+	permissionID, ok := parseIDParam(w, r, "permissionId", "Invalid permission ID")
+	if !ok {
+		return
+	}
+
+	if err := services.RevokeGroupPermission(groupID, permissionID); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Permission revoked"})
+}
+
+func GetUserPermissions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	grants, err := services.EffectivePermissions(userID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, grants)
+}
+
+// GetPermissionHolders answers "who has permission X and why"
+func GetPermissionHolders(w http.ResponseWriter, r *http.Request) {
+	holders, err := services.WhoHasPermission(mux.Vars(r)["name"])
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, holders)
+}
+
+func parseIDParam(w http.ResponseWriter, r *http.Request, name, message string) (uint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)[name], 10, 64)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, message)
+		return 0, false
+	}
+	return uint(id), true
+}
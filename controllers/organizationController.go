@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"hells/middleware"
+	"hells/models"
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+func CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	org := models.Organization{Name: req.Name}
+	if err := services.CreateOrganization(&org); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusCreated, org)
+}
+
+func CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := authorizeOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email  string `json:"email"`
+		RoleID uint   `json:"role_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" || req.RoleID == 0 {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	currentUserID := context.Get(r, "user_id").(uint)
+	invitation, err := services.CreateInvitation(orgID, req.RoleID, currentUserID, req.Email)
+	if errors.Is(err, services.ErrInvitationEmailFailed) {
+		utils.SendErrorResponse(w, http.StatusBadGateway, "Invitation created but email delivery failed")
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusCreated, invitation)
+}
+
+func ListInvitations(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := authorizeOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	invitations, err := services.ListInvitations(orgID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve invitations")
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, invitations)
+}
+
+func ResendInvitation(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := authorizeOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	invitationID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+
+	invitation, err := services.ResendInvitation(orgID, uint(invitationID))
+	if errors.Is(err, services.ErrInvitationEmailFailed) {
+		utils.SendErrorResponse(w, http.StatusBadGateway, "Invitation renewed but email delivery failed")
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, invitation)
+}
+
+func RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := authorizeOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	invitationID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+
+	if err := services.RevokeInvitation(orgID, uint(invitationID)); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Invitation revoked"})
+}
+
+// AcceptInvitation lets a signed-in user join an organization they were invited to.
+// New users accept by passing invitation_token to Register instead.
+func AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := services.FindUserByID(context.Get(r, "user_id").(uint))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if err := services.AcceptInvitation(req.Token, user); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Invitation accepted"})
+}
+
+// authorizeOrganizationAdmin parses the organization ID and checks that the current
+// user is a platform admin or an admin of that organization
+func authorizeOrganizationAdmin(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	orgID, err := strconv.ParseUint(mux.Vars(r)["orgId"], 10, 64)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid organization ID")
+		return 0, false
+	}
+
+	currentUserID := context.Get(r, "user_id").(uint)
+	if !middleware.HasRole(r, "Admin") && !services.IsOrganizationAdmin(uint(orgID), currentUserID) {
+		utils.SendErrorResponse(w, http.StatusForbidden, "Unauthorized to manage this organization")
+		return 0, false
+	}
+
+	return uint(orgID), true
+}
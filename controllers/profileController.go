@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"hells/middleware"
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+func GetProfile(w http.ResponseWriter, r *http.Request) {
+	userID := context.Get(r, "user_id").(uint)
+	user, err := services.FindUserByID(userID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, user)
+}
+
+// UpdateProfile applies self-service changes. Only the fields below may be changed
+// here; email, role and status go through their own flows.
+func UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name      *string `json:"name"`
+		Username  *string `json:"username"`
+		AvatarURL *string `json:"avatar_url"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body: only name, username and avatar_url can be updated")
+		return
+	}
+
+	userID := context.Get(r, "user_id").(uint)
+
+	// Validate each provided field
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if len([]rune(name)) > 100 {
+			utils.SendErrorResponse(w, http.StatusBadRequest, "Name must be at most 100 characters")
+			return
+		}
+		req.Name = &name
+	}
+	if req.Username != nil {
+		if !utils.ValidUsername(*req.Username) {
+			utils.SendErrorResponse(w, http.StatusBadRequest, "Username must be 3-30 letters, digits, dots, dashes or underscores")
+			return
+		}
+		if services.UsernameTaken(*req.Username, userID) {
+			utils.SendErrorResponse(w, http.StatusConflict, "Username already exists")
+			return
+		}
+	}
+	if req.AvatarURL != nil && *req.AvatarURL != "" {
+		avatarURL, err := url.Parse(*req.AvatarURL)
+		if err != nil || avatarURL.Scheme != "https" || avatarURL.Host == "" || len(*req.AvatarURL) > 2048 {
+			utils.SendErrorResponse(w, http.StatusBadRequest, "Avatar URL must be an https URL")
+			return
+		}
+	}
+
+	user, err := services.UpdateProfile(userID, req.Name, req.Username, req.AvatarURL)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to update profile")
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, user)
+}
+
+// DeleteProfile deletes the current user's account after confirming their password
+// or a recent re-authentication. The account can be restored until the grace period ends.
+func DeleteProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	// The password is optional for a recently re-authenticated session
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID := context.Get(r, "user_id").(uint)
+	user, err := services.FindUserByID(userID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	// Confirm with the password against the account's own backend, or with a
+	// recent step-up, the only option for SAML accounts
+	if req.Password != "" {
+		err := services.VerifyUserPassword(user, req.Password)
+		if errors.Is(err, services.ErrAuthBackendUnavailable) {
+			utils.SendErrorResponse(w, http.StatusServiceUnavailable, "Authentication service unavailable")
+			return
+		}
+		if err != nil {
+			utils.SendErrorResponse(w, http.StatusForbidden, "Password is incorrect")
+			return
+		}
+	} else if !middleware.AuthenticatedWithin(r, middleware.StepUpMaxAge) {
+		middleware.RequestRecentAuth(w, middleware.StepUpMaxAge)
+		return
+	}
+
+	deletion, err := services.DeleteAccount(user.ID, user.ID, "", utils.ClientIP(r))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to delete account")
+		return
+	}
+
+	utils.ClearSessionCookies(w)
+	utils.SendJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"message":     "Account deleted",
+		"purge_after": deletion.PurgeAfter,
+	})
+}
+
+// RequestEmailChange stages a new email for the current user until it is confirmed
+func RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := services.FindUserByID(context.Get(r, "user_id").(uint))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	change, err := services.RequestEmailChange(user, req.Email, utils.ClientIP(r))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusAccepted, map[string]interface{}{
+		"message":       "Confirmation sent to the new email address",
+		"pending_email": change.NewEmail,
+		"expires_at":    change.ExpiresAt,
+	})
+}
+
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	handleEmailChangeToken(w, r, services.ConfirmEmailChange, "Email address updated")
+}
+
+func CancelEmailChange(w http.ResponseWriter, r *http.Request) {
+	handleEmailChangeToken(w, r, services.CancelEmailChange, "Email change cancelled")
+}
+
+func handleEmailChangeToken(w http.ResponseWriter, r *http.Request, apply func(token, ipAddress string) error, message string) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := apply(req.Token, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": message})
+}
+
+// RestoreAccount restores a deleted account using the link emailed on deletion
+func RestoreAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := services.RestoreAccountWithToken(req.Token, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Account restored"})
+}
+
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CurrentPassword == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID := context.Get(r, "user_id").(uint)
+	sessionID, _ := context.Get(r, "session_id").(uint)
+	err := services.ChangePassword(userID, sessionID, req.CurrentPassword, req.NewPassword, utils.ClientIP(r))
+
+	var policyErr *utils.PasswordPolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		utils.SendPasswordPolicyError(w, policyErr)
+	case errors.Is(err, services.ErrInvalidCurrentPassword):
+		utils.SendErrorResponse(w, http.StatusForbidden, "Current password is incorrect")
+	case errors.Is(err, services.ErrExternalPassword):
+		utils.SendErrorResponse(w, http.StatusConflict, err.Error())
+	case err != nil:
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to change password")
+	default:
+		utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Password changed"})
+	}
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+func TestDeleteProfileConfirmation(t *testing.T) {
+	t.Setenv("PASSWORD_HASHER", "bcrypt")
+	t.Setenv("PASSWORD_BCRYPT_COST", "4")
+	hash, err := utils.HashPassword("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		authSource string
+		body       string
+		authAge    time.Duration
+		status     int
+	}{
+		{"password", "local", `{"password":"correct horse battery"}`, time.Hour, http.StatusOK},
+		{"wrong password", "local", `{"password":"wrong"}`, time.Minute, http.StatusForbidden},
+		{"recent login", "local", `{}`, time.Minute, http.StatusOK},
+		{"stale login", "local", ``, time.Hour, http.StatusUnauthorized},
+		{"saml after step-up", "saml", ``, time.Minute, http.StatusOK},
+		{"saml without step-up", "saml", `{}`, time.Hour, http.StatusUnauthorized},
+		{"saml password", "saml", `{"password":"correct horse battery"}`, time.Hour, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testutil.NewDB(t)
+			user := testutil.CreateUser(t, db, "alice", "Viewer")
+			db.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+				"password_hash": hash,
+				"auth_source":   tt.authSource,
+			})
+
+			r := httptest.NewRequest("DELETE", "/me", strings.NewReader(tt.body))
+			defer context.Clear(r)
+			context.Set(r, "user_id", user.ID)
+			context.Set(r, "auth_time", time.Now().Add(-tt.authAge).Unix())
+			w := httptest.NewRecorder()
+
+			DeleteProfile(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			var deletions int64
+			db.Model(&models.AccountDeletion{}).Where("user_id = ?", user.ID).Count(&deletions)
+			if deleted := deletions > 0; deleted != (tt.status == http.StatusOK) {
+				t.Errorf("account deleted = %v", deleted)
+			}
+		})
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	db.Model(&models.User{}).Where("id = ?", user.ID).Update("name", "Alice")
+	testutil.CreateUser(t, db, "bob", "Viewer")
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"username", `{"username":"alice2"}`, http.StatusOK},
+		{"taken username", `{"username":"bob"}`, http.StatusConflict},
+		{"invalid username", `{"username":"a b"}`, http.StatusBadRequest},
+		{"http avatar", `{"avatar_url":"http://example.com/a.png"}`, http.StatusBadRequest},
+		{"email", `{"email":"mallory@example.com"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/me", strings.NewReader(tt.body))
+			defer context.Clear(r)
+			context.Set(r, "user_id", user.ID)
+			w := httptest.NewRecorder()
+
+			UpdateProfile(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	var reloaded models.User
+	db.First(&reloaded, user.ID)
+	if reloaded.Username != "alice2" || reloaded.Name != "Alice" || reloaded.Email != user.Email {
+		t.Errorf("user = %+v", reloaded)
+	}
+}
@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hells/models"
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// SAMLMetadata serves the organization's service provider metadata for its IdP admins
+func SAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := samlOrganizationID(w, r)
+	if !ok {
+		return
+	}
+
+	metadata, err := services.SAMLMetadata(orgID)
+	if errors.Is(err, services.ErrSAMLNotConfigured) {
+		utils.SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to build SAML metadata")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(metadata)
+}
+
+// SAMLLogin redirects the browser to the organization's IdP. return_to is the
+// frontend path to come back to once signed in.
+func SAMLLogin(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := samlOrganizationID(w, r)
+	if !ok {
+		return
+	}
+
+	redirect, err := services.StartSAMLLogin(orgID, r.URL.Query().Get("return_to"))
+	if errors.Is(err, services.ErrSAMLNotConfigured) {
+		utils.SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to start SAML sign-in")
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// SAMLACS is the assertion consumer service the IdP posts its response to. A
+// valid response signs the user in with session cookies, as in cookie mode
+// login, and sends them on to the frontend. A response to a re-authentication
+// request elevates the user's existing session instead.
+func SAMLACS(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := samlOrganizationID(w, r)
+	if !ok {
+		return
+	}
+
+	login, err := services.CompleteSAMLLogin(orgID, r)
+	if errors.Is(err, services.ErrSAMLNotConfigured) {
+		utils.SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	user := login.User
+
+	// Suspended accounts may not sign in
+	if !user.IsActive {
+		utils.SendErrorResponse(w, http.StatusForbidden, "Account is suspended")
+		return
+	}
+
+	if login.SessionID != 0 {
+		completeSAMLReauthentication(w, r, orgID, login)
+		return
+	}
+
+	session, token, err := startLoginSession(r, user, "fed")
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	services.RecordAudit(models.AuditLog{
+		Action:    "saml.login",
+		ActorID:   user.ID,
+		SubjectID: user.ID,
+		IPAddress: utils.ClientIP(r),
+		Details:   "organization_id=" + strconv.FormatUint(uint64(orgID), 10),
+	})
+
+	csrfToken := utils.GenerateCSRFToken(strconv.FormatUint(uint64(session.ID), 10))
+	utils.SetSessionCookies(w, token, csrfToken, session.ExpiresAt)
+	http.Redirect(w, r, utils.FrontendURL(login.ReturnTo), http.StatusSeeOther)
+}
+
+// completeSAMLReauthentication gives the re-authenticated session an elevated
+// session cookie, as Reauthenticate does for cookie clients
+func completeSAMLReauthentication(w http.ResponseWriter, r *http.Request, orgID uint, login *services.SAMLLogin) {
+	if err := services.TouchSession(login.SessionID, login.User.ID, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	claims := &utils.Claims{
+		UserID:    strconv.FormatUint(uint64(login.User.ID), 10),
+		Role:      login.User.Role.Name,
+		AuthTime:  login.AuthTime.Unix(),
+		AMR:       []string{"fed"},
+		SessionID: strconv.FormatUint(uint64(login.SessionID), 10),
+	}
+	token, err := utils.SignClaims(claims, stepUpTokenTTL())
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Token generation failed")
+		return
+	}
+
+	services.RecordAudit(models.AuditLog{
+		Action:    "saml.reauthenticate",
+		ActorID:   login.User.ID,
+		SubjectID: login.User.ID,
+		IPAddress: utils.ClientIP(r),
+		Details:   "organization_id=" + strconv.FormatUint(uint64(orgID), 10),
+	})
+
+	utils.SetSessionCookies(w, token, utils.GenerateCSRFToken(claims.SessionID), time.Unix(claims.ExpiresAt, 0))
+	http.Redirect(w, r, utils.FrontendURL(login.ReturnTo), http.StatusSeeOther)
+}
+
+func GetSAMLProvider(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := authorizeOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	provider, err := services.FindSAMLProvider(orgID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, "SAML is not configured for this organization")
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, provider)
+}
+
+// UpdateSAMLProvider configures the organization's IdP from its metadata XML or
+// a metadata_url to fetch it from
+func UpdateSAMLProvider(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := authorizeOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		models.SAMLProvider
+		MetadataURL string `json:"metadata_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.IdPMetadataXML == "" && req.MetadataURL == "" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "idp_metadata_xml or metadata_url is required")
+		return
+	}
+
+	provider := models.SAMLProvider{
+		Enabled:           req.Enabled,
+		IdPMetadataXML:    req.IdPMetadataXML,
+		EmailAttribute:    req.EmailAttribute,
+		UsernameAttribute: req.UsernameAttribute,
+		NameAttribute:     req.NameAttribute,
+		RoleAttribute:     req.RoleAttribute,
+		RoleMappings:      req.RoleMappings,
+		DefaultRoleID:     req.DefaultRoleID,
+	}
+	if err := services.SaveSAMLProvider(orgID, &provider, req.MetadataURL); err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	services.RecordAudit(models.AuditLog{
+		Action:    "saml.provider_update",
+		ActorID:   context.Get(r, "user_id").(uint),
+		IPAddress: utils.ClientIP(r),
+		Details:   "organization_id=" + strconv.FormatUint(uint64(orgID), 10) + " idp_entity_id=" + provider.IdPEntityID,
+	})
+
+	utils.SendJSONResponse(w, http.StatusOK, provider)
+}
+
+func samlOrganizationID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	orgID, err := strconv.ParseUint(mux.Vars(r)["orgId"], 10, 64)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid organization ID")
+		return 0, false
+	}
+	return uint(orgID), true
+}
@@ -0,0 +1,353 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/mux"
+)
+
+func ListScimUsers(w http.ResponseWriter, r *http.Request) {
+	response, err := services.ListScimUsers(scimListQuery(r))
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	utils.SendScimResponse(w, http.StatusOK, response)
+}
+
+func GetScimUser(w http.ResponseWriter, r *http.Request) {
+	user, err := services.GetScimUser(mux.Vars(r)["id"])
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	utils.SendScimResponse(w, http.StatusOK, user)
+}
+
+func CreateScimUser(w http.ResponseWriter, r *http.Request) {
+	var resource services.ScimUser
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+		utils.SendScimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+		return
+	}
+
+	user, err := services.CreateScimUser(resource, utils.ClientIP(r))
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	w.Header().Set("Location", user.Meta.Location)
+	utils.SendScimResponse(w, http.StatusCreated, user)
+}
+
+func ReplaceScimUser(w http.ResponseWriter, r *http.Request) {
+	var resource services.ScimUser
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+		utils.SendScimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+		return
+	}
+
+	user, err := services.ReplaceScimUser(mux.Vars(r)["id"], resource, utils.ClientIP(r))
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	utils.SendScimResponse(w, http.StatusOK, user)
+}
+
+func PatchScimUser(w http.ResponseWriter, r *http.Request) {
+	patch, ok := decodeScimPatch(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := services.PatchScimUser(mux.Vars(r)["id"], patch, utils.ClientIP(r))
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	utils.SendScimResponse(w, http.StatusOK, user)
+}
+
+func DeleteScimUser(w http.ResponseWriter, r *http.Request) {
+	if err := services.DeleteScimUser(mux.Vars(r)["id"], utils.ClientIP(r)); err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ListScimGroups(w http.ResponseWriter, r *http.Request) {
+	withMembers := !strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members")
+	response, err := services.ListScimGroups(scimListQuery(r), withMembers)
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	utils.SendScimResponse(w, http.StatusOK, response)
+}
+
+func GetScimGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := services.GetScimGroup(mux.Vars(r)["id"])
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	utils.SendScimResponse(w, http.StatusOK, group)
+}
+
+func CreateScimGroup(w http.ResponseWriter, r *http.Request) {
+	var resource services.ScimGroup
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+		utils.SendScimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+		return
+	}
+
+	group, err := services.CreateScimGroup(resource, utils.ClientIP(r))
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	w.Header().Set("Location", group.Meta.Location)
+	utils.SendScimResponse(w, http.StatusCreated, group)
+}
+
+func ReplaceScimGroup(w http.ResponseWriter, r *http.Request) {
+	var resource services.ScimGroup
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+		utils.SendScimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+		return
+	}
+
+	group, err := services.ReplaceScimGroup(mux.Vars(r)["id"], resource, utils.ClientIP(r))
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	utils.SendScimResponse(w, http.StatusOK, group)
+}
+
+func PatchScimGroup(w http.ResponseWriter, r *http.Request) {
+	patch, ok := decodeScimPatch(w, r)
+	if !ok {
+		return
+	}
+
+	group, err := services.PatchScimGroup(mux.Vars(r)["id"], patch, utils.ClientIP(r))
+	if err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	utils.SendScimResponse(w, http.StatusOK, group)
+}
+
+func DeleteScimGroup(w http.ResponseWriter, r *http.Request) {
+	if err := services.DeleteScimGroup(mux.Vars(r)["id"], utils.ClientIP(r)); err != nil {
+		sendScimServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetScimServiceProviderConfig describes the SCIM features this server supports
+func GetScimServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	utils.SendScimResponse(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": services.MaxScimResults},
+		"changePassword": map[string]bool{"supported": true},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "Static bearer token issued to the provisioning client",
+			"primary":     true,
+		}},
+		"meta": map[string]string{
+			"resourceType": "ServiceProviderConfig",
+			"location":     utils.AppURL("/scim/v2/ServiceProviderConfig"),
+		},
+	})
+}
+
+func ListScimResourceTypes(w http.ResponseWriter, r *http.Request) {
+	resourceTypes := []map[string]interface{}{
+		scimResourceType("User", "/Users", services.ScimUserSchema),
+		scimResourceType("Group", "/Groups", services.ScimGroupSchema),
+	}
+	utils.SendScimResponse(w, http.StatusOK, services.ScimListResponse{
+		Schemas:      []string{services.ScimListSchema},
+		TotalResults: len(resourceTypes),
+		StartIndex:   1,
+		ItemsPerPage: len(resourceTypes),
+		Resources:    resourceTypes,
+	})
+}
+
+func ListScimSchemas(w http.ResponseWriter, r *http.Request) {
+	schemas := []map[string]interface{}{scimUserSchema(), scimGroupSchema()}
+	utils.SendScimResponse(w, http.StatusOK, services.ScimListResponse{
+		Schemas:      []string{services.ScimListSchema},
+		TotalResults: len(schemas),
+		StartIndex:   1,
+		ItemsPerPage: len(schemas),
+		Resources:    schemas,
+	})
+}
+
+func GetScimSchema(w http.ResponseWriter, r *http.Request) {
+	switch mux.Vars(r)["id"] {
+	case services.ScimUserSchema:
+		utils.SendScimResponse(w, http.StatusOK, scimUserSchema())
+	case services.ScimGroupSchema:
+		utils.SendScimResponse(w, http.StatusOK, scimGroupSchema())
+	default:
+		utils.SendScimError(w, http.StatusNotFound, "", "Schema not found")
+	}
+}
+
+func scimListQuery(r *http.Request) services.ScimListQuery {
+	query := services.ScimListQuery{Filter: r.URL.Query().Get("filter"), StartIndex: 1, Count: services.MaxScimResults}
+	if startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex")); err == nil {
+		query.StartIndex = startIndex
+	}
+	if count, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil {
+		query.Count = count
+	}
+	return query
+}
+
+func decodeScimPatch(w http.ResponseWriter, r *http.Request) (services.ScimPatchRequest, bool) {
+	var patch services.ScimPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || len(patch.Operations) == 0 {
+		utils.SendScimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid PATCH request")
+		return patch, false
+	}
+	return patch, true
+}
+
+func sendScimServiceError(w http.ResponseWriter, err error) {
+	var scimErr *services.ScimError
+	if errors.As(err, &scimErr) {
+		utils.SendScimError(w, scimErr.Status, scimErr.ScimType, scimErr.Detail)
+		return
+	}
+	log.Printf("SCIM request failed: %v", err)
+	utils.SendScimError(w, http.StatusInternalServerError, "", "Internal server error")
+}
+
+func scimResourceType(name, endpoint, schema string) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+		"id":       name,
+		"name":     name,
+		"endpoint": endpoint,
+		"schema":   schema,
+		"meta": map[string]string{
+			"resourceType": "ResourceType",
+			"location":     utils.AppURL("/scim/v2/ResourceTypes/" + name),
+		},
+	}
+}
+
+// scimAttribute describes a simple attribute in a schema definition
+func scimAttribute(name, attrType string, required bool, mutability, uniqueness string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"type":        attrType,
+		"multiValued": false,
+		"required":    required,
+		"caseExact":   false,
+		"mutability":  mutability,
+		"returned":    "default",
+		"uniqueness":  uniqueness,
+	}
+}
+
+// scimMultiValuedAttribute describes a multi-valued complex attribute such as emails
+func scimMultiValuedAttribute(name, mutability string, subAttributes ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"name":          name,
+		"type":          "complex",
+		"multiValued":   true,
+		"required":      false,
+		"mutability":    mutability,
+		"returned":      "default",
+		"subAttributes": subAttributes,
+	}
+}
+
+func scimUserSchema() map[string]interface{} {
+	password := scimAttribute("password", "string", false, "writeOnly", "none")
+	password["returned"] = "never"
+
+	return map[string]interface{}{
+		"id":          services.ScimUserSchema,
+		"name":        "User",
+		"description": "User Account",
+		"attributes": []map[string]interface{}{
+			scimAttribute("userName", "string", true, "readWrite", "server"),
+			scimAttribute("externalId", "string", false, "readWrite", "none"),
+			{
+				"name":        "name",
+				"type":        "complex",
+				"multiValued": false,
+				"required":    false,
+				"mutability":  "readWrite",
+				"returned":    "default",
+				"subAttributes": []map[string]interface{}{
+					scimAttribute("formatted", "string", false, "readWrite", "none"),
+					scimAttribute("givenName", "string", false, "readWrite", "none"),
+					scimAttribute("familyName", "string", false, "readWrite", "none"),
+				},
+			},
+			scimAttribute("displayName", "string", false, "readWrite", "none"),
+			scimMultiValuedAttribute("emails", "readWrite",
+				scimAttribute("value", "string", true, "readWrite", "server"),
+				scimAttribute("type", "string", false, "readWrite", "none"),
+				scimAttribute("primary", "boolean", false, "readWrite", "none"),
+			),
+			scimAttribute("active", "boolean", false, "readWrite", "none"),
+			password,
+			scimMultiValuedAttribute("groups", "readOnly",
+				scimAttribute("value", "string", false, "readOnly", "none"),
+				scimAttribute("display", "string", false, "readOnly", "none"),
+				scimAttribute("$ref", "reference", false, "readOnly", "none"),
+			),
+		},
+		"meta": map[string]string{
+			"resourceType": "Schema",
+			"location":     utils.AppURL("/scim/v2/Schemas/" + services.ScimUserSchema),
+		},
+	}
+}
+
+func scimGroupSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          services.ScimGroupSchema,
+		"name":        "Group",
+		"description": "Group, backed by a role",
+		"attributes": []map[string]interface{}{
+			scimAttribute("displayName", "string", true, "readWrite", "server"),
+			scimMultiValuedAttribute("members", "readWrite",
+				scimAttribute("value", "string", false, "immutable", "none"),
+				scimAttribute("display", "string", false, "readOnly", "none"),
+				scimAttribute("$ref", "reference", false, "immutable", "none"),
+			),
+		},
+		"meta": map[string]string{
+			"resourceType": "Schema",
+			"location":     utils.AppURL("/scim/v2/Schemas/" + services.ScimGroupSchema),
+		},
+	}
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"net/http"
+
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+func ListMySessions(w http.ResponseWriter, r *http.Request) {
+	listSessions(w, r, context.Get(r, "user_id").(uint))
+}
+
+func RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	revokeSession(w, r, context.Get(r, "user_id").(uint))
+}
+
+func ListUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+	listSessions(w, r, userID)
+}
+
+func RevokeUserSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseIDParam(w, r, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+	revokeSession(w, r, userID)
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request, userID uint) {
+	sessions, err := services.ListActiveSessions(userID)
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve sessions")
+		return
+	}
+
+	// Flag the session the request was made with
+	if currentSessionID, ok := context.GetOk(r, "session_id"); ok {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == currentSessionID.(uint)
+		}
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, sessions)
+}
+
+func revokeSession(w http.ResponseWriter, r *http.Request, userID uint) {
+	sessionID, ok := parseIDParam(w, r, "sessionId", "Invalid session ID")
+	if !ok {
+		return
+	}
+
+	actorID := auditActorID(r)
+	if err := services.RevokeSession(userID, sessionID, actorID, utils.ClientIP(r)); err != nil {
+		utils.SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Session revoked"})
+}
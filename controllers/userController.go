@@ -2,9 +2,13 @@ package controllers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"hells/middleware"
 	"hells/models"
 	"hells/services"
 	"hells/utils"
@@ -14,26 +18,127 @@ import (
 )
 
 func ListUsers(w http.ResponseWriter, r *http.Request) {
-	// Get page and limit from query parameters
-	pageStr := r.URL.Query().Get("page")
-	limitStr := r.URL.Query().Get("limit")
+	params := r.URL.Query()
+
+	// Search matches emails, and account status and login times are not for
+	// every signed-in user to see, so those are for admins only
+	isAdmin := middleware.HasRole(r, "Admin")
+	if !isAdmin {
+		for _, name := range []string{"q", "is_active", "last_login_after", "last_login_before"} {
+			if params.Get(name) != "" {
+				utils.SendErrorResponse(w, http.StatusForbidden, name+" requires the Admin role")
+				return
+			}
+		}
+	}
 
 	// Default values
-	page := 1
-	limit := 10
+	query := services.UserListQuery{Page: 1, Limit: 10, Role: params.Get("role"), Search: strings.TrimSpace(params.Get("q"))}
+
+	// Offset pagination is the default; clients opt in to keyset cursors with
+	// pagination=cursor and then follow the cursor they are given
+	pagination := params.Get("pagination")
+	if pagination != "" && pagination != "offset" && pagination != "cursor" {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "pagination must be offset or cursor")
+		return
+	}
+	cursorMode := pagination == "cursor" || (pagination == "" && params.Get("cursor") != "")
+	if cursorMode && (params.Get("page") != "" || params.Get("sort") != "") {
+		utils.SendErrorResponse(w, http.StatusBadRequest, "cursor pagination cannot be combined with page or sort")
+		return
+	}
+	var cursor *services.Cursor
+	if value := params.Get("cursor"); cursorMode && value != "" {
+		decoded, err := services.DecodeCursor("users", value)
+		if err != nil {
+			utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		cursor = decoded
+	}
 
 	// Parse page
-	if pageNum, err := strconv.Atoi(pageStr); err == nil && pageNum > 0 {
-		page = pageNum
+	if pageNum, err := strconv.Atoi(params.Get("page")); err == nil && pageNum > 0 {
+		query.Page = pageNum
+	}
+
+	// Parse limit, capped at the maximum page size
+	if limitNum, err := strconv.Atoi(params.Get("limit")); err == nil && limitNum > 0 {
+		query.Limit = limitNum
+	}
+	if query.Limit > services.MaxUserPageSize {
+		query.Limit = services.MaxUserPageSize
+	}
+
+	// Parse filters
+	if value := params.Get("role_id"); value != "" {
+		roleID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid role_id")
+			return
+		}
+		query.RoleID = uint(roleID)
+	}
+	if value := params.Get("is_active"); value != "" {
+		isActive, err := strconv.ParseBool(value)
+		if err != nil {
+			utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid is_active")
+			return
+		}
+		query.IsActive = &isActive
+	}
+	timeFilters := map[string]**time.Time{
+		"created_after":     &query.CreatedAfter,
+		"created_before":    &query.CreatedBefore,
+		"last_login_after":  &query.LastLoginAfter,
+		"last_login_before": &query.LastLoginBefore,
 	}
+	for name, target := range timeFilters {
+		if value := params.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				utils.SendErrorResponse(w, http.StatusBadRequest, "Invalid "+name+", expected an RFC 3339 timestamp")
+				return
+			}
+			*target = &parsed
+		}
+	}
+
+	// Parse sort order
+	sorts, err := services.ParseUserSort(params.Get("sort"))
+	if err != nil {
+		utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, sort := range sorts {
+		// The order alone would reveal emails and login times
+		if !isAdmin && (sort.Field == "email" || sort.Field == "last_login") {
+			utils.SendErrorResponse(w, http.StatusForbidden, "sorting by "+sort.Field+" requires the Admin role")
+			return
+		}
+	}
+	query.Sort = sorts
 
-	// Parse limit
-	if limitNum, err := strconv.Atoi(limitStr); err == nil && limitNum > 0 {
-		limit = limitNum
+	if cursorMode {
+		result, total, err := services.ListUsersByCursor(query, cursor)
+		if err != nil {
+			utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		}
+
+		utils.SetPaginationLinks(w, r, result.NextCursor, result.PrevCursor)
+		utils.SendJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"users":       userListItems(result.Items, isAdmin),
+			"total":       total,
+			"limit":       query.Limit,
+			"next_cursor": result.NextCursor,
+			"prev_cursor": result.PrevCursor,
+		})
+		return
 	}
 
 	// Call service to list users
-	users, total, err := services.ListUsers(page, limit)
+	users, total, err := services.ListUsers(query)
 	if err != nil {
 		utils.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve users")
 		return
@@ -41,15 +146,28 @@ func ListUsers(w http.ResponseWriter, r *http.Request) {
 
 	// Prepare response
 	response := map[string]interface{}{
-		"users": users,
+		"users": userListItems(users, isAdmin),
 		"total": total,
-		"page":  page,
-		"limit": limit,
+		"page":  query.Page,
+		"limit": query.Limit,
 	}
 
 	utils.SendJSONResponse(w, http.StatusOK, response)
 }
 
+// userListItems returns users as they may be listed: in full for admins and
+// without email, account status and login times for everyone else
+func userListItems(users []models.User, isAdmin bool) interface{} {
+	if isAdmin {
+		return users
+	}
+	items := make([]models.PublicUser, len(users))
+	for i := range users {
+		items[i] = users[i].Public()
+	}
+	return items
+}
+
 func GetUser(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from URL parameters
 	vars := mux.Vars(r)
@@ -92,10 +210,10 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 
 	// Get current user from context (set by AuthMiddleware)
 	currentUserID := context.Get(r, "user_id").(uint)
-	currentUserRole := context.Get(r, "role").(string)
+	isAdmin := middleware.HasRole(r, "Admin")
 
 	// Validate update permissions
-	if currentUserID != uint(userID) && currentUserRole != "Admin" {
+	if currentUserID != uint(userID) && !isAdmin {
 		utils.SendErrorResponse(w, http.StatusForbidden, "Unauthorized to update this user")
 		return
 	}
@@ -111,13 +229,23 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	if updateData.Name != "" {
 		existingUser.Name = updateData.Name
 	}
-	if updateData.Email != "" {
-		existingUser.Email = updateData.Email
+
+	// Email changes wait for confirmation from the new address
+	if updateData.Email != "" && !strings.EqualFold(updateData.Email, existingUser.Email) {
+		change, err := services.RequestEmailChange(existingUser, updateData.Email, utils.ClientIP(r))
+		if err != nil {
+			utils.SendErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		existingUser.PendingEmail = change.NewEmail
 	}
 
 	// Prevent role change for non-admins
-	if currentUserRole == "Admin" && updateData.RoleID != 0 {
+	oldRoleID := existingUser.RoleID
+	if isAdmin && updateData.RoleID != 0 {
 		existingUser.RoleID = updateData.RoleID
+		// Drop the preloaded role so saving does not reset RoleID from it
+		existingUser.Role = models.Role{}
 	}
 
 	// Save updates
@@ -126,6 +254,17 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Role changes make up the user's role history
+	if existingUser.RoleID != oldRoleID {
+		services.RecordAudit(models.AuditLog{
+			Action:    "user.role_change",
+			ActorID:   auditActorID(r),
+			SubjectID: existingUser.ID,
+			IPAddress: utils.ClientIP(r),
+			Details:   fmt.Sprintf("old_role_id=%d new_role_id=%d", oldRoleID, existingUser.RoleID),
+		})
+	}
+
 	// Clear sensitive data before sending
 	existingUser.PasswordHash = ""
 
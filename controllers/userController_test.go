@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"hells/models"
+	"hells/testutil"
+
+	"github.com/gorilla/context"
+)
+
+func listUsers(t *testing.T, role, query string) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/users?"+query, nil)
+	defer context.Clear(r)
+	// A caller outside the test users, so only the role in the token counts
+	context.Set(r, "user_id", uint(999))
+	context.Set(r, "role", role)
+	w := httptest.NewRecorder()
+	ListUsers(w, r)
+
+	var body map[string]json.RawMessage
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, body
+}
+
+func TestListUsersSensitiveFiltersRequireAdmin(t *testing.T) {
+	db := testutil.NewDB(t)
+	testutil.CreateUser(t, db, "alice", "Admin")
+	testutil.CreateUser(t, db, "bob", "Viewer")
+
+	tests := []struct {
+		role   string
+		query  string
+		status int
+	}{
+		{"Viewer", "", http.StatusOK},
+		{"Viewer", "role=Admin", http.StatusOK},
+		{"Viewer", "q=alice", http.StatusForbidden},
+		{"Viewer", "is_active=false", http.StatusForbidden},
+		{"Viewer", "last_login_after=2024-01-01T00:00:00Z", http.StatusForbidden},
+		{"Viewer", "sort=email", http.StatusForbidden},
+		{"Editor", "sort=-last_login", http.StatusForbidden},
+		{"Viewer", "sort=username", http.StatusOK},
+		{"Admin", "q=alice&is_active=true&sort=email", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.query, func(t *testing.T) {
+			if w, _ := listUsers(t, tt.role, tt.query); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	_, body := listUsers(t, "Admin", "q=alice%40example")
+	var users []models.User
+	json.Unmarshal(body["users"], &users)
+	if len(users) != 1 || users[0].Username != "alice" {
+		t.Errorf("search results = %+v", users)
+	}
+
+	// Wildcards and the escape character in the search match only themselves
+	testutil.CreateUser(t, db, "100_percent!", "Viewer")
+	for query, want := range map[string]int{"_": 1, "%25": 0, "!": 1, "t!": 1, "a_i": 0} {
+		_, body := listUsers(t, "Admin", "q="+query)
+		var users []models.User
+		json.Unmarshal(body["users"], &users)
+		if len(users) != want {
+			t.Errorf("q=%s: %d results, want %d", query, len(users), want)
+		}
+	}
+}
+
+func TestListUsersHidesAccountDetailsFromNonAdmins(t *testing.T) {
+	db := testutil.NewDB(t)
+	testutil.CreateUser(t, db, "alice", "Viewer")
+
+	for _, query := range []string{"", "pagination=cursor"} {
+		_, body := listUsers(t, "Editor", query)
+		var users []map[string]json.RawMessage
+		json.Unmarshal(body["users"], &users)
+		if len(users) != 1 || users[0]["username"] == nil {
+			t.Fatalf("%q: users = %s", query, body["users"])
+		}
+		for _, field := range []string{"email", "last_login", "is_active"} {
+			if users[0][field] != nil {
+				t.Errorf("%q: non-admin sees %s", query, field)
+			}
+		}
+	}
+
+	_, body := listUsers(t, "Admin", "")
+	var users []map[string]json.RawMessage
+	json.Unmarshal(body["users"], &users)
+	if len(users) != 1 || users[0]["email"] == nil {
+		t.Errorf("admin users = %s", body["users"])
+	}
+}
+
+func TestListUsersPaginationModes(t *testing.T) {
+	db := testutil.NewDB(t)
+	for i := 0; i < 3; i++ {
+		testutil.CreateUser(t, db, testutil.Email("user", i), "Viewer")
+	}
+
+	// Offset pagination stays the default
+	w, body := listUsers(t, "Viewer", "limit=2")
+	if w.Code != http.StatusOK || body["page"] == nil || body["next_cursor"] != nil {
+		t.Errorf("default listing: %d %s", w.Code, w.Body)
+	}
+
+	w, body = listUsers(t, "Viewer", "limit=2&pagination=cursor")
+	var next string
+	json.Unmarshal(body["next_cursor"], &next)
+	if w.Code != http.StatusOK || next == "" || w.Header().Get("Link") == "" {
+		t.Fatalf("cursor listing: %d %s", w.Code, w.Body)
+	}
+
+	// Following the cursor stays in cursor mode
+	w, body = listUsers(t, "Viewer", "limit=2&cursor="+next)
+	var users []models.User
+	json.Unmarshal(body["users"], &users)
+	if w.Code != http.StatusOK || len(users) != 1 || body["page"] != nil {
+		t.Errorf("next page: %d %s", w.Code, w.Body)
+	}
+
+	for _, query := range []string{"pagination=cursor&page=2", "cursor=" + next + "&sort=username", "pagination=pages", "cursor=forged"} {
+		if w, _ := listUsers(t, "Viewer", query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d", query, w.Code)
+		}
+	}
+}
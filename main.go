@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
+	"hells/commands"
 	configs "hells/config"
 	"hells/routes"
+	"hells/services"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -23,11 +27,34 @@ func main() {
 	db, err := configs.InitDatabase()
 
 	if err != nil {
-		fmt.Errorf("Database initialiaztion failed: %v", err)
 		log.Fatalf("Database initialiaztion failed: %v", err)
 	}
 	fmt.Println(db)
 
+	// Run a one-off command instead of the server, e.g. "import-users"
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Purge deleted accounts once their grace period ends
+	go services.RunAccountPurgeJob(time.Hour)
+
+	// Lift suspensions once their end date passes
+	go services.RunSuspensionExpiryJob(time.Minute)
+
+	// Exports that were being built when the server last stopped never finish
+	if failed, err := services.FailInterruptedDataExports(); err != nil {
+		log.Printf("Error failing interrupted data exports: %v", err)
+	} else if failed > 0 {
+		log.Printf("Marked %d interrupted data exports as failed", failed)
+	}
+
+	// Delete data export archives whose download link expired unused
+	go services.RunDataExportCleanupJob(time.Hour)
+
 	// Create router
 	router := mux.NewRouter()
 
@@ -39,3 +66,12 @@ func main() {
 	fmt.Printf("Server starting on port %s\n", port)
 	log.Fatal(http.ListenAndServe(port, router))
 }
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "import-users":
+		return commands.ImportUsers(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
@@ -1,9 +1,15 @@
 package middleware
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"hells/services"
 	"hells/utils"
 
 	"github.com/gorilla/context"
@@ -11,46 +17,141 @@ import (
 
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if status, err := AuthenticateRequest(r); err != nil {
+			http.Error(w, err.Error(), status)
 			return
 		}
 
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthenticateRequest validates the request's token or session cookie and sets
+// the user context. On failure it returns the status code to respond with.
+func AuthenticateRequest(r *http.Request) (int, error) {
+	return AuthenticateForwardedRequest(r, r.Method, r.URL.Path)
+}
+
+// AuthenticateForwardedRequest is AuthenticateRequest for a request a proxy
+// received with method and path, which decide the CSRF check and are recorded
+// for impersonated requests.
+func AuthenticateForwardedRequest(r *http.Request, method, path string) (int, error) {
+	token, viaCookie, err := extractToken(r)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+
+	claims, err := utils.ValidateJWT(token)
+	if err != nil {
+		return http.StatusUnauthorized, errors.New("Invalid token")
+	}
+
+	userID, err := strconv.ParseUint(claims.UserID, 10, 64)
+	if err != nil {
+		return http.StatusUnauthorized, errors.New("Invalid token")
+	}
+
+	// Cookies are sent automatically by browsers, so state-changing
+	// requests must prove they came from our frontend
+	if viaCookie && !isSafeMethod(method) {
+		csrfCookie, err := r.Cookie(utils.CSRFCookieName)
+		csrfHeader := r.Header.Get(utils.CSRFHeaderName)
+		if err != nil || csrfHeader == "" || csrfHeader != csrfCookie.Value || !utils.ValidCSRFToken(csrfHeader, claims.SessionID) {
+			return http.StatusForbidden, errors.New("Invalid CSRF token")
+		}
+	}
+
+	// Every token belongs to a session; reject those whose session was
+	// revoked or expired
+	sessionID, err := strconv.ParseUint(claims.SessionID, 10, 64)
+	if err != nil {
+		return http.StatusUnauthorized, errors.New("Invalid token")
+	}
+	if services.TouchSession(uint(sessionID), uint(userID), utils.ClientIP(r)) != nil {
+		return http.StatusUnauthorized, errors.New("Session expired or revoked")
+	}
+	context.Set(r, "session_id", uint(sessionID))
+
+	// Tokens of suspended or deleted users are no longer honoured
+	if !services.IsUserActive(uint(userID)) {
+		return http.StatusUnauthorized, errors.New("Account is not active")
+	}
+
+	// Set user context for further use
+	context.Set(r, "user_id", uint(userID))
+	context.Set(r, "role", claims.Role)
+	context.Set(r, "token_id", claims.Id)
+	context.Set(r, "auth_time", claims.AuthTime)
+	context.Set(r, "amr", claims.AMR)
+	context.Set(r, "auth_via_cookie", viaCookie)
+
+	if claims.IsImpersonation() {
+		actorID, err := strconv.ParseUint(claims.Act.UserID, 10, 64)
+		if err != nil || !services.IsImpersonationActive(claims.Id) {
+			return http.StatusUnauthorized, errors.New("Invalid token")
+		}
+		context.Set(r, "actor_id", uint(actorID))
+		log.Printf("[impersonation] actor=%d subject=%d %s %s", actorID, userID, method, path)
+		services.RecordImpersonatedRequest(uint(actorID), uint(userID), claims.Id, method, path, utils.ClientIP(r))
+	}
+
+	return http.StatusOK, nil
+}
+
+// extractToken reads the bearer token, falling back to the session cookie
+// used by browser clients
+func extractToken(r *http.Request) (string, bool, error) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
 		bearerToken := strings.Split(authHeader, " ")
 		if len(bearerToken) != 2 {
-			http.Error(w, "Invalid token format", http.StatusUnauthorized)
-			return
+			return "", false, errors.New("Invalid token format")
 		}
+		return bearerToken[1], false, nil
+	}
 
-		token := bearerToken[1]
-		claims, err := utils.ValidateJWT(token)
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
+	if cookie, err := r.Cookie(utils.SessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, true, nil
+	}
 
-		// Set user context for further use
-		context.Set(r, "user_id", claims.UserID)
-		context.Set(r, "role", claims.Role)
+	return "", false, errors.New("Unauthorized")
+}
 
-		next.ServeHTTP(w, r)
-	})
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// HasRole reports whether the signed-in user has requiredRole or a higher one,
+// through the role in their token or a role granted to one of their groups
+func HasRole(r *http.Request, requiredRole string) bool {
+	// Role hierarchy: Admin > Editor > Viewer
+	if role, _ := context.Get(r, "role").(string); utils.HasRole(role, requiredRole) {
+		return true
+	}
+	userID, ok := context.Get(r, "user_id").(uint)
+	return ok && services.UserHasRole(userID, requiredRole)
 }
 
 func RBACMiddleware(requiredRole string) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			userRole := context.Get(r, "role").(string)
-
-			// Role hierarchy: Admin > Editor > Viewer
-			roleHierarchy := map[string]int{
-				"Viewer": 1,
-				"Editor": 2,
-				"Admin":  3,
+			if !HasRole(r, requiredRole) {
+				http.Error(w, "Insufficient permissions", http.StatusForbidden)
+				return
 			}
 
-			if roleHierarchy[userRole] < roleHierarchy[requiredRole] {
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// PermissionMiddleware allows the request when the user holds the permission
+// directly through their role or through any of their groups
+func PermissionMiddleware(permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			userID := context.Get(r, "user_id").(uint)
+
+			if !services.HasPermission(userID, permission) {
 				http.Error(w, "Insufficient permissions", http.StatusForbidden)
 				return
 			}
@@ -59,3 +160,46 @@ func RBACMiddleware(requiredRole string) func(http.HandlerFunc) http.HandlerFunc
 		}
 	}
 }
+
+// NoImpersonationMiddleware blocks sensitive actions for impersonation tokens
+func NoImpersonationMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := context.GetOk(r, "actor_id"); ok {
+			http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// StepUpMaxAge is how recent a login or re-authentication must be for
+// sensitive operations
+const StepUpMaxAge = 5 * time.Minute
+
+// RequireRecentAuth demands that the user authenticated within maxAge, even when
+// the token itself is still valid. Clients recover by calling /auth/reauthenticate.
+func RequireRecentAuth(maxAge time.Duration) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !AuthenticatedWithin(r, maxAge) {
+				RequestRecentAuth(w, maxAge)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// AuthenticatedWithin reports whether the token's auth_time is at most maxAge old
+func AuthenticatedWithin(r *http.Request, maxAge time.Duration) bool {
+	authTime, _ := context.Get(r, "auth_time").(int64)
+	return authTime != 0 && time.Since(time.Unix(authTime, 0)) <= maxAge
+}
+
+// RequestRecentAuth answers 401 asking the client to re-authenticate
+func RequestRecentAuth(w http.ResponseWriter, maxAge time.Duration) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_user_authentication", max_age=%d`, int(maxAge.Seconds())))
+	http.Error(w, "Recent authentication required", http.StatusUnauthorized)
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/services"
+	"hells/testutil"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/me", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestAuthenticateRequestRequiresSession(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	userID := strconv.FormatUint(uint64(user.ID), 10)
+
+	session, err := services.CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSession, _ := utils.GenerateJWT(userID, "Viewer", strconv.FormatUint(uint64(session.ID), 10), "pwd")
+	withoutSession, _ := utils.SignClaims(&utils.Claims{UserID: userID, Role: "Admin", AuthTime: time.Now().Unix()}, time.Hour)
+	unknownSession, _ := utils.GenerateJWT(userID, "Viewer", "999", "pwd")
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"active session", withSession, http.StatusOK},
+		{"no sid", withoutSession, http.StatusUnauthorized},
+		{"unknown session", unknownSession, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bearerRequest(tt.token)
+			defer context.Clear(r)
+			if status, err := AuthenticateRequest(r); status != tt.status {
+				t.Errorf("status = %d (%v), want %d", status, err, tt.status)
+			}
+		})
+	}
+
+	services.RevokeSession(user.ID, session.ID, user.ID, "127.0.0.1")
+	r := bearerRequest(withSession)
+	defer context.Clear(r)
+	if status, _ := AuthenticateRequest(r); status != http.StatusUnauthorized {
+		t.Errorf("revoked session: status = %d", status)
+	}
+}
+
+func TestAuthenticateRequestImpersonation(t *testing.T) {
+	db := testutil.NewDB(t)
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	viewer := testutil.CreateUser(t, db, "viewer", "Viewer")
+
+	token, impersonation, err := services.StartImpersonation(admin.ID, viewer.ID, "support", "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bearerRequest(token)
+	if status, err := AuthenticateRequest(r); status != http.StatusOK {
+		t.Fatalf("status = %d (%v)", status, err)
+	}
+	if actorID, _ := context.Get(r, "actor_id").(uint); actorID != admin.ID {
+		t.Errorf("actor_id = %v, want %d", context.Get(r, "actor_id"), admin.ID)
+	}
+	if sessionID, _ := context.Get(r, "session_id").(uint); sessionID != impersonation.SessionID {
+		t.Errorf("session_id = %v, want %d", context.Get(r, "session_id"), impersonation.SessionID)
+	}
+	context.Clear(r)
+
+	var count int64
+	db.Table("audit_logs").Where("action = ? AND actor_id = ? AND subject_id = ?", "impersonation.request", admin.ID, viewer.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("impersonated requests audited = %d, want 1", count)
+	}
+
+	// Ending impersonation revokes the token's session
+	if err := services.EndImpersonation(impersonation.TokenID, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	r = bearerRequest(token)
+	defer context.Clear(r)
+	if status, _ := AuthenticateRequest(r); status != http.StatusUnauthorized {
+		t.Errorf("after end: status = %d", status)
+	}
+}
+
+func TestAuthenticateRequestCSRF(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	session, err := services.CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := strconv.FormatUint(uint64(session.ID), 10)
+	token, _ := utils.GenerateJWT(strconv.FormatUint(uint64(user.ID), 10), "Viewer", sessionID, "pwd")
+	csrf := utils.GenerateCSRFToken(sessionID)
+	otherCSRF := utils.GenerateCSRFToken("999")
+
+	tests := []struct {
+		name   string
+		method string
+		cookie string
+		header string
+		bearer bool
+		status int
+	}{
+		{"safe method needs no token", "GET", "", "", false, http.StatusOK},
+		{"valid token", "POST", csrf, csrf, false, http.StatusOK},
+		{"missing header", "POST", csrf, "", false, http.StatusForbidden},
+		{"missing cookie", "POST", "", csrf, false, http.StatusForbidden},
+		{"header does not match cookie", "POST", csrf, otherCSRF, false, http.StatusForbidden},
+		{"token of another session", "DELETE", otherCSRF, otherCSRF, false, http.StatusForbidden},
+		{"bearer tokens are not checked", "POST", "", "", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/me", nil)
+			defer context.Clear(r)
+			if tt.bearer {
+				r.Header.Set("Authorization", "Bearer "+token)
+			} else {
+				r.AddCookie(&http.Cookie{Name: utils.SessionCookieName, Value: token})
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: utils.CSRFCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(utils.CSRFHeaderName, tt.header)
+			}
+
+			if status, err := AuthenticateRequest(r); status != tt.status {
+				t.Errorf("status = %d (%v), want %d", status, err, tt.status)
+			}
+		})
+	}
+}
+
+func TestRBACMiddlewareGroupRoles(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	group := models.Group{Name: "admins"}
+	if err := services.CreateGroup(&group); err != nil {
+		t.Fatal(err)
+	}
+	handler := RBACMiddleware("Admin")(func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func() int {
+		r := httptest.NewRequest("GET", "/admin/audit-logs", nil)
+		defer context.Clear(r)
+		context.Set(r, "user_id", user.ID)
+		context.Set(r, "role", "Viewer")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	if status := request(); status != http.StatusForbidden {
+		t.Errorf("viewer: status = %d", status)
+	}
+	services.AddGroupMember(group.ID, user.ID)
+	services.GrantGroupRole(group.ID, testutil.Role(t, db, "Admin").ID)
+	if status := request(); status != http.StatusOK {
+		t.Errorf("member of a group with the Admin role: status = %d", status)
+	}
+}
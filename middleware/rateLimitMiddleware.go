@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"hells/config"
+	"hells/services"
+	"hells/utils"
+
+	"github.com/gorilla/context"
+)
+
+// RateLimitKeyFunc picks the identity a request is counted against
+type RateLimitKeyFunc func(r *http.Request) string
+
+// KeyByIP counts requests per client IP
+func KeyByIP(r *http.Request) string {
+	return "ip:" + utils.ClientIP(r)
+}
+
+// KeyByUser counts requests per authenticated user, falling back to the client IP.
+// It must run after AuthMiddleware.
+func KeyByUser(r *http.Request) string {
+	if userID, ok := context.GetOk(r, "user_id"); ok {
+		return fmt.Sprintf("user:%d", userID.(uint))
+	}
+	return KeyByIP(r)
+}
+
+// KeyByClient counts requests per calling application of the authenticated
+// user, identified by the X-Client-ID header. Anyone can send any header, so
+// it is ignored on unauthenticated requests, which are counted per client IP.
+// It must run after AuthMiddleware.
+func KeyByClient(r *http.Request) string {
+	userID, ok := context.GetOk(r, "user_id")
+	if !ok {
+		return KeyByIP(r)
+	}
+	clientID := r.Header.Get("X-Client-ID")
+	if clientID == "" || len(clientID) > 64 {
+		return KeyByUser(r)
+	}
+	return fmt.Sprintf("client:%d:%s", userID.(uint), clientID)
+}
+
+// RateLimit describes the limit applied to one route
+type RateLimit struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Key    RateLimitKeyFunc
+}
+
+// NewRateLimitStore builds the store selected by RATE_LIMIT_STORE: "database"
+// shares limits across instances, anything else keeps them in memory
+func NewRateLimitStore() services.RateLimitStore {
+	if os.Getenv("RATE_LIMIT_STORE") == "database" {
+		if db := config.GetDB(); db != nil {
+			return services.NewDatabaseRateLimitStore(db)
+		}
+		log.Printf("Rate limit database unavailable, falling back to memory store")
+	}
+	return services.NewMemoryRateLimitStore()
+}
+
+// RateLimitMiddleware enforces a sliding-window limit, answering 429 with
+// Retry-After once the limit is exceeded
+func RateLimitMiddleware(store services.RateLimitStore, limit RateLimit) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			current, previous, err := store.Increment(limit.Name+":"+limit.Key(r), limit.Window, now)
+			if err != nil {
+				// Fail open rather than lock everyone out when storage is down
+				log.Printf("Rate limit store error for %s: %v", limit.Name, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Weight the previous window by how much of it still overlaps the sliding window
+			elapsed := time.Duration(now.UnixNano() % int64(limit.Window))
+			weight := 1 - float64(elapsed)/float64(limit.Window)
+			used := int(math.Ceil(float64(previous)*weight)) + current
+			reset := int(math.Ceil((limit.Window - elapsed).Seconds()))
+
+			remaining := limit.Limit - used
+			if remaining < 0 {
+				remaining = 0
+			}
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Limit, int(limit.Window.Seconds())))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(reset))
+
+			if used > limit.Limit {
+				w.Header().Set("Retry-After", strconv.Itoa(reset))
+				utils.SendErrorResponse(w, http.StatusTooManyRequests, "Too many requests")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/context"
+)
+
+func TestKeyByClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   uint
+		clientID string
+		want     string
+	}{
+		{"anonymous client", 0, "mobile", "ip:192.0.2.1"},
+		{"anonymous", 0, "", "ip:192.0.2.1"},
+		{"authenticated client", 7, "mobile", "client:7:mobile"},
+		{"authenticated without client", 7, "", "user:7"},
+		{"overlong client", 7, strings.Repeat("x", 65), "user:7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			defer context.Clear(r)
+			if tt.userID != 0 {
+				context.Set(r, "user_id", tt.userID)
+			}
+			if tt.clientID != "" {
+				r.Header.Set("X-Client-ID", tt.clientID)
+			}
+			if got := KeyByClient(r); got != tt.want {
+				t.Errorf("KeyByClient() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
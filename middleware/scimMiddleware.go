@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"hells/utils"
+)
+
+// ScimAuthMiddleware admits the identity provider's provisioning client, which
+// authenticates with the static bearer token in SCIM_BEARER_TOKEN. SCIM is
+// disabled while the token is unset.
+func ScimAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := os.Getenv("SCIM_BEARER_TOKEN")
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if expected == "" || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			utils.SendScimError(w, http.StatusUnauthorized, "", "Unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// EmailChange is a pending email address change awaiting confirmation from the new address
+type EmailChange struct {
+	gorm.Model
+	UserID      uint       `gorm:"not null;index" json:"user_id"`
+	OldEmail    string     `gorm:"not null" json:"old_email"`
+	NewEmail    string     `gorm:"not null" json:"new_email"`
+	Nonce       string     `gorm:"not null" json:"-"`
+	ExpiresAt   time.Time  `gorm:"not null" json:"expires_at"`
+	ConfirmedAt *time.Time `json:"confirmed_at"`
+	CancelledAt *time.Time `json:"cancelled_at"`
+}
+
+// IsPending reports whether the change can still be confirmed or cancelled
+func (c *EmailChange) IsPending() bool {
+	return c.ConfirmedAt == nil && c.CancelledAt == nil && time.Now().Before(c.ExpiresAt)
+}
+
+// AccountDeletion tracks a deleted account through its grace period until it is purged or restored
+type AccountDeletion struct {
+	gorm.Model
+	UserID        uint       `gorm:"not null;index" json:"user_id"`
+	RequestedByID uint       `json:"requested_by_id"`
+	Reason        string     `json:"reason"`
+	PurgeAfter    time.Time  `gorm:"not null;index" json:"purge_after"`
+	RestoreNonce  string     `json:"-"` // empty unless the user deleted the account themselves
+	RestoredAt    *time.Time `json:"restored_at"`
+	PurgedAt      *time.Time `json:"purged_at"`
+}
+
+// DataExport is an asynchronous export of everything stored about a user
+type DataExport struct {
+	gorm.Model
+	UserID        uint       `gorm:"not null;index" json:"user_id"`
+	RequestedByID uint       `json:"requested_by_id"`
+	Status        string     `gorm:"not null;default:'pending'" json:"status"` // pending, running, ready, failed, downloaded, expired
+	FilePath      string     `json:"-"`
+	Error         string     `json:"error,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	DownloadedAt  *time.Time `json:"downloaded_at"`
+	DownloadURL   string     `gorm:"-" json:"download_url,omitempty"`
+}
+
+// Suspension blocks a user from signing in until it ends or is lifted. Admins
+// and the SCIM identity provider each lift only their own suspensions, so a
+// user can hold one of each.
+type Suspension struct {
+	gorm.Model
+	UserID        uint       `gorm:"not null;index" json:"user_id"`
+	Source        string     `gorm:"not null;default:'admin'" json:"source"` // admin, scim
+	SuspendedByID uint       `json:"suspended_by_id"`
+	Reason        string     `gorm:"type:text" json:"reason"`
+	EndsAt        *time.Time `gorm:"index" json:"ends_at"` // nil suspends until reactivated
+	LiftedAt      *time.Time `json:"lifted_at"`
+	LiftedByID    uint       `json:"lifted_by_id"` // zero when the suspension expired
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type AuditLog struct {
+	gorm.Model
+	Action    string `gorm:"not null;index" json:"action"`
+	ActorID   uint   `gorm:"index" json:"actor_id"`
+	SubjectID uint   `gorm:"index" json:"subject_id"`
+	IPAddress string `json:"ip_address"`
+	Details   string `gorm:"type:text" json:"details"`
+}
+
+type ImpersonationSession struct {
+	gorm.Model
+	TokenID   string     `gorm:"unique;not null" json:"token_id"`
+	ActorID   uint       `gorm:"not null;index" json:"actor_id"`
+	SubjectID uint       `gorm:"not null;index" json:"subject_id"`
+	Reason    string     `json:"reason"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	EndedAt   *time.Time `json:"ended_at"`
+	// SessionID is the subject's session the impersonation token is tied to
+	SessionID uint `json:"session_id"`
+}
+
+// LoginThrottle tracks failed logins for one account or client IP
+type LoginThrottle struct {
+	gorm.Model
+	Key           string     `gorm:"column:throttle_key;unique;not null" json:"key"` // account:<email> or ip:<address>
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// RateLimitCounter counts requests for one rate limit key in one fixed window
+type RateLimitCounter struct {
+	gorm.Model
+	Key         string `gorm:"column:bucket_key;not null;uniqueIndex:idx_rate_limit_window" json:"key"`
+	WindowStart int64  `gorm:"not null;uniqueIndex:idx_rate_limit_window" json:"window_start"`
+	Count       int    `gorm:"not null" json:"count"`
+}
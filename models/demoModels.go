@@ -8,11 +8,15 @@ import (
 
 type User struct {
 	gorm.Model
-	UserId       uint      `gorm:"unique;not null" json:"userId"`
+	UserId       *uint     `gorm:"unique" json:"userId,omitempty"` // legacy, never set
 	Username     string    `gorm:"unique;not null" json:"username"`
+	ExternalID   string    `gorm:"index" json:"external_id,omitempty"`
 	Name         string    `json:"name"`
+	AvatarURL    string    `json:"avatar_url"`
 	Email        string    `gorm:"unique;not null" json:"email"`
+	PendingEmail string    `gorm:"-" json:"pending_email,omitempty"`
 	PasswordHash string    `gorm:"not null" json:"-"`
+	AuthSource   string    `gorm:"default:'local'" json:"auth_source"` // local, ldap, saml, scim
 	RoleID       uint      `json:"role_id"`
 	Role         Role      `gorm:"foreignkey:RoleID" json:"role"`
 	Posts        []Post    `gorm:"foreignkey:UserID" json:"posts"`
@@ -20,6 +24,31 @@ type User struct {
 	IsActive     bool      `gorm:"default:true" json:"is_active"`
 }
 
+// PublicUser is the part of a user every signed-in user may see. Email,
+// account status and login times are for admins only.
+type PublicUser struct {
+	ID        uint      `json:"ID"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	Username  string    `json:"username"`
+	Name      string    `json:"name"`
+	AvatarURL string    `json:"avatar_url"`
+	RoleID    uint      `json:"role_id"`
+	Role      Role      `json:"role"`
+}
+
+// Public returns the fields of the user every signed-in user may see
+func (u *User) Public() PublicUser {
+	return PublicUser{
+		ID:        u.ID,
+		CreatedAt: u.CreatedAt,
+		Username:  u.Username,
+		Name:      u.Name,
+		AvatarURL: u.AvatarURL,
+		RoleID:    u.RoleID,
+		Role:      u.Role,
+	}
+}
+
 type Post struct {
 	gorm.Model
 	Title   string `gorm:"not null" json:"title"`
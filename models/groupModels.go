@@ -0,0 +1,30 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+type Group struct {
+	gorm.Model
+	Name        string       `gorm:"unique;not null" json:"name"`
+	Description string       `json:"description"`
+	Members     []User       `gorm:"many2many:group_members" json:"members"`
+	Roles       []Role       `gorm:"many2many:group_roles" json:"roles"`
+	Permissions []Permission `gorm:"many2many:group_permissions" json:"permissions"`
+}
+
+// PermissionGrant explains where a user's permission comes from
+type PermissionGrant struct {
+	Permission string `json:"permission"`
+	Source     string `json:"source"` // role, group_role, group
+	Role       string `json:"role,omitempty"`
+	Group      string `json:"group,omitempty"`
+}
+
+// PermissionHolder is a user holding a permission together with every grant that gives it to them
+type PermissionHolder struct {
+	UserID   uint              `json:"user_id"`
+	Username string            `json:"username"`
+	Email    string            `json:"email"`
+	Grants   []PermissionGrant `json:"grants"`
+}
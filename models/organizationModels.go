@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type Organization struct {
+	gorm.Model
+	Name    string               `gorm:"unique;not null" json:"name"`
+	Members []OrganizationMember `gorm:"foreignkey:OrganizationID" json:"members,omitempty"`
+}
+
+type OrganizationMember struct {
+	gorm.Model
+	OrganizationID uint `gorm:"not null;index" json:"organization_id"`
+	UserID         uint `gorm:"not null;index" json:"user_id"`
+	User           User `gorm:"foreignkey:UserID" json:"user"`
+	RoleID         uint `json:"role_id"`
+	Role           Role `gorm:"foreignkey:RoleID" json:"role"`
+}
+
+type Invitation struct {
+	gorm.Model
+	OrganizationID uint         `gorm:"not null;index" json:"organization_id"`
+	Organization   Organization `gorm:"foreignkey:OrganizationID" json:"-"`
+	Email          string       `gorm:"not null;index" json:"email"`
+	RoleID         uint         `gorm:"not null" json:"role_id"`
+	Role           Role         `gorm:"foreignkey:RoleID" json:"role"`
+	InvitedByID    uint         `json:"invited_by_id"`
+	Nonce          string       `gorm:"not null" json:"-"`
+	ExpiresAt      time.Time    `gorm:"not null" json:"expires_at"`
+	AcceptedAt     *time.Time   `json:"accepted_at"`
+	RevokedAt      *time.Time   `json:"revoked_at"`
+}
+
+// IsPending reports whether the invitation can still be accepted
+func (i *Invitation) IsPending() bool {
+	return i.AcceptedAt == nil && i.RevokedAt == nil && time.Now().Before(i.ExpiresAt)
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SAMLProvider is the SAML identity provider an organization's users sign in with
+type SAMLProvider struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"not null;uniqueIndex" json:"organization_id"`
+	Enabled        bool   `json:"enabled"`
+	IdPMetadataXML string `gorm:"type:text;not null" json:"idp_metadata_xml"`
+	IdPEntityID    string `json:"idp_entity_id"`
+	// Assertion attributes read into the user; the email falls back to the NameID
+	EmailAttribute    string `json:"email_attribute"`
+	UsernameAttribute string `json:"username_attribute"`
+	NameAttribute     string `json:"name_attribute"`
+	RoleAttribute     string `json:"role_attribute"`
+	// RoleMappings are checked in order; members matching none get DefaultRoleID
+	RoleMappings  []SAMLRoleMapping `gorm:"serializer:json;type:text" json:"role_mappings"`
+	DefaultRoleID uint              `json:"default_role_id"`
+}
+
+// SAMLRoleMapping gives the role to members whose role attribute contains Value
+type SAMLRoleMapping struct {
+	Value string `json:"value"`
+	Role  string `json:"role"`
+}
+
+// SAMLIdentity links an identity provider's subject (NameID) to a local user
+type SAMLIdentity struct {
+	gorm.Model
+	ProviderID uint   `gorm:"not null;uniqueIndex:idx_saml_identity" json:"provider_id"`
+	NameID     string `gorm:"size:255;not null;uniqueIndex:idx_saml_identity" json:"name_id"`
+	UserID     uint   `gorm:"not null;index" json:"user_id"`
+}
+
+// SAMLRequest tracks an AuthnRequest until its response arrives, so only
+// responses to requests we sent are accepted, and each only once
+type SAMLRequest struct {
+	gorm.Model
+	ProviderID uint       `gorm:"not null" json:"provider_id"`
+	RequestID  string     `gorm:"size:191;not null" json:"request_id"`
+	RelayState string     `gorm:"size:191;not null;uniqueIndex" json:"-"`
+	ReturnTo   string     `json:"return_to"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at"`
+	// UserID and SessionID are set when a signed-in user re-authenticates
+	// with the IdP rather than signing in
+	UserID    uint `json:"user_id"`
+	SessionID uint `json:"session_id"`
+}
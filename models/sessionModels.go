@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type Session struct {
+	gorm.Model
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Device     string     `json:"device"`
+	UserAgent  string     `gorm:"type:text" json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	Current    bool       `gorm:"-" json:"current"`
+}
+
+// IsActive reports whether tokens issued for the session are still accepted
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
@@ -1,6 +1,9 @@
 package routes
 
 import (
+	"net/http"
+	"time"
+
 	"hells/controllers"
 	"hells/middleware"
 
@@ -8,17 +11,138 @@ import (
 )
 
 func SetupRoutes(router *mux.Router) {
+	// Sensitive operations require a login or re-authentication this recent.
+	// There are no API tokens yet; creating them must go through stepUp too.
+	stepUp := middleware.RequireRecentAuth(middleware.StepUpMaxAge)
+
+	// Rate limits for endpoints open to brute force and spam
+	rateLimitStore := middleware.NewRateLimitStore()
+	rateLimit := func(name string, limit int, window time.Duration, key middleware.RateLimitKeyFunc) func(http.HandlerFunc) http.HandlerFunc {
+		return middleware.RateLimitMiddleware(rateLimitStore, middleware.RateLimit{Name: name, Limit: limit, Window: window, Key: key})
+	}
+
 	// Authentication Routes
-	router.HandleFunc("/register", controllers.Register).Methods("POST")
-	router.HandleFunc("/login", controllers.Login).Methods("POST")
-	router.HandleFunc("/reset-password", controllers.ResetPassword).Methods("POST")
+	router.HandleFunc("/register", rateLimit("register", 5, time.Hour, middleware.KeyByIP)(controllers.Register)).Methods("POST")
+	router.HandleFunc("/login", rateLimit("login", 20, time.Minute, middleware.KeyByIP)(controllers.Login)).Methods("POST")
+	router.HandleFunc("/reset-password", rateLimit("reset-password", 5, 15*time.Minute, middleware.KeyByIP)(controllers.ResetPassword)).Methods("POST")
+	router.HandleFunc("/email-change/confirm", rateLimit("email-change", 10, 15*time.Minute, middleware.KeyByIP)(controllers.ConfirmEmailChange)).Methods("POST")
+	router.HandleFunc("/email-change/cancel", rateLimit("email-change", 10, 15*time.Minute, middleware.KeyByIP)(controllers.CancelEmailChange)).Methods("POST")
+	router.HandleFunc("/account/restore", rateLimit("account-restore", 5, 15*time.Minute, middleware.KeyByIP)(controllers.RestoreAccount)).Methods("POST")
+	router.HandleFunc("/exports/{id}/download", rateLimit("export-download", 10, 15*time.Minute, middleware.KeyByIP)(controllers.DownloadDataExport)).Methods("GET")
+	router.HandleFunc("/unlock-account", rateLimit("unlock-account", 5, 15*time.Minute, middleware.KeyByIP)(controllers.UnlockAccount)).Methods("POST")
+
+	// Token signing keys for services verifying tokens themselves
+	router.HandleFunc("/.well-known/jwks.json", controllers.GetJWKS).Methods("GET")
+
+	// Forward-auth subrequests from reverse proxies; authenticates by itself so
+	// it can redirect browsers to the login page
+	router.HandleFunc("/auth/verify", controllers.VerifyForwardAuth).Methods("GET")
+
+	authRoutes := router.PathPrefix("/auth").Subrouter()
+	authRoutes.Use(middleware.AuthMiddleware)
+	authRoutes.HandleFunc("/logout", controllers.Logout).Methods("POST")
+	authRoutes.HandleFunc("/reauthenticate", middleware.NoImpersonationMiddleware(rateLimit("reauthenticate", 5, 15*time.Minute, middleware.KeyByUser)(controllers.Reauthenticate))).Methods("POST")
+	authRoutes.HandleFunc("/reauthenticate/saml", middleware.NoImpersonationMiddleware(rateLimit("reauthenticate", 5, 15*time.Minute, middleware.KeyByUser)(controllers.ReauthenticateSAML))).Methods("POST")
+
+	// Current User Routes
+	meRoutes := router.PathPrefix("/me").Subrouter()
+	meRoutes.Use(middleware.AuthMiddleware)
+	meRoutes.HandleFunc("", controllers.GetProfile).Methods("GET")
+	meRoutes.HandleFunc("", middleware.NoImpersonationMiddleware(controllers.UpdateProfile)).Methods("PATCH")
+	meRoutes.HandleFunc("", middleware.NoImpersonationMiddleware(rateLimit("delete-account", 5, 15*time.Minute, middleware.KeyByUser)(controllers.DeleteProfile))).Methods("DELETE")
+	meRoutes.HandleFunc("/email", middleware.NoImpersonationMiddleware(stepUp(controllers.RequestEmailChange))).Methods("POST")
+	meRoutes.HandleFunc("/password", middleware.NoImpersonationMiddleware(rateLimit("change-password", 5, 15*time.Minute, middleware.KeyByUser)(controllers.ChangePassword))).Methods("POST")
+	meRoutes.HandleFunc("/export", middleware.NoImpersonationMiddleware(rateLimit("export", 3, 24*time.Hour, middleware.KeyByUser)(controllers.RequestMyDataExport))).Methods("POST")
+	meRoutes.HandleFunc("/exports/{exportId}", middleware.NoImpersonationMiddleware(controllers.GetMyDataExport)).Methods("GET")
+	meRoutes.HandleFunc("/sessions", controllers.ListMySessions).Methods("GET")
+	meRoutes.HandleFunc("/sessions/{sessionId}", middleware.NoImpersonationMiddleware(controllers.RevokeMySession)).Methods("DELETE")
 
 	// User Routes
 	userRoutes := router.PathPrefix("/users").Subrouter()
 	userRoutes.Use(middleware.AuthMiddleware)
 	userRoutes.HandleFunc("", controllers.ListUsers).Methods("GET")
 	userRoutes.HandleFunc("/{id}", controllers.GetUser).Methods("GET")
-	userRoutes.HandleFunc("/{id}", middleware.RBACMiddleware("Admin")(controllers.UpdateUser)).Methods("PUT")
+	userRoutes.HandleFunc("/{id}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(stepUp(controllers.UpdateUser)))).Methods("PUT")
+	userRoutes.HandleFunc("/{id}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(stepUp(controllers.DeleteUser)))).Methods("DELETE")
+	userRoutes.HandleFunc("/{id}/permissions", middleware.RBACMiddleware("Admin")(controllers.GetUserPermissions)).Methods("GET")
+	userRoutes.HandleFunc("/{id}/sessions", middleware.RBACMiddleware("Admin")(controllers.ListUserSessions)).Methods("GET")
+	userRoutes.HandleFunc("/{id}/sessions/{sessionId}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.RevokeUserSession))).Methods("DELETE")
+
+	// Group Routes
+	groupRoutes := router.PathPrefix("/groups").Subrouter()
+	groupRoutes.Use(middleware.AuthMiddleware)
+	groupRoutes.HandleFunc("", middleware.RBACMiddleware("Admin")(controllers.ListGroups)).Methods("GET")
+	groupRoutes.HandleFunc("", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.CreateGroup))).Methods("POST")
+	groupRoutes.HandleFunc("/{id}", middleware.RBACMiddleware("Admin")(controllers.GetGroup)).Methods("GET")
+	groupRoutes.HandleFunc("/{id}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.DeleteGroup))).Methods("DELETE")
+	groupRoutes.HandleFunc("/{id}/members", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.AddGroupMember))).Methods("POST")
+	groupRoutes.HandleFunc("/{id}/members/{userId}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.RemoveGroupMember))).Methods("DELETE")
+	groupRoutes.HandleFunc("/{id}/roles", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.GrantGroupRole))).Methods("POST")
+	groupRoutes.HandleFunc("/{id}/roles/{roleId}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.RevokeGroupRole))).Methods("DELETE")
+	groupRoutes.HandleFunc("/{id}/permissions", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.GrantGroupPermission))).Methods("POST")
+	groupRoutes.HandleFunc("/{id}/permissions/{permissionId}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.RevokeGroupPermission))).Methods("DELETE")
+
+	// Permission Routes
+	permissionRoutes := router.PathPrefix("/permissions").Subrouter()
+	permissionRoutes.Use(middleware.AuthMiddleware)
+	permissionRoutes.HandleFunc("/{name}/holders", middleware.RBACMiddleware("Admin")(controllers.GetPermissionHolders)).Methods("GET")
+
+	// Organization Routes
+	orgRoutes := router.PathPrefix("/organizations").Subrouter()
+	orgRoutes.Use(middleware.AuthMiddleware)
+	orgRoutes.HandleFunc("", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.CreateOrganization))).Methods("POST")
+	orgRoutes.HandleFunc("/{orgId}/invitations", middleware.NoImpersonationMiddleware(controllers.CreateInvitation)).Methods("POST")
+	orgRoutes.HandleFunc("/{orgId}/invitations", controllers.ListInvitations).Methods("GET")
+	orgRoutes.HandleFunc("/{orgId}/invitations/{id}/resend", middleware.NoImpersonationMiddleware(controllers.ResendInvitation)).Methods("POST")
+	orgRoutes.HandleFunc("/{orgId}/invitations/{id}", middleware.NoImpersonationMiddleware(controllers.RevokeInvitation)).Methods("DELETE")
+	orgRoutes.HandleFunc("/{orgId}/saml", controllers.GetSAMLProvider).Methods("GET")
+	orgRoutes.HandleFunc("/{orgId}/saml", middleware.NoImpersonationMiddleware(stepUp(controllers.UpdateSAMLProvider))).Methods("PUT")
+
+	// SAML single sign-on routes, one service provider per organization
+	router.HandleFunc("/saml/{orgId}/metadata", controllers.SAMLMetadata).Methods("GET")
+	router.HandleFunc("/saml/{orgId}/login", rateLimit("saml-login", 20, time.Minute, middleware.KeyByIP)(controllers.SAMLLogin)).Methods("GET")
+	router.HandleFunc("/saml/{orgId}/acs", rateLimit("saml-login", 20, time.Minute, middleware.KeyByIP)(controllers.SAMLACS)).Methods("POST")
+
+	// Invitation Routes
+	invitationRoutes := router.PathPrefix("/invitations").Subrouter()
+	invitationRoutes.Use(middleware.AuthMiddleware)
+	invitationRoutes.HandleFunc("/accept", middleware.NoImpersonationMiddleware(controllers.AcceptInvitation)).Methods("POST")
+
+	// Admin Routes
+	adminRoutes := router.PathPrefix("/admin").Subrouter()
+	adminRoutes.Use(middleware.AuthMiddleware)
+	adminRoutes.HandleFunc("/impersonate/end", controllers.EndImpersonation).Methods("POST")
+	adminRoutes.HandleFunc("/impersonate/{id}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.Impersonate))).Methods("POST")
+	adminRoutes.HandleFunc("/users/import", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.ImportUsers))).Methods("POST")
+	adminRoutes.HandleFunc("/users/{id}/unlock", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.UnlockUser))).Methods("POST")
+	adminRoutes.HandleFunc("/users/{id}/suspend", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.SuspendUser))).Methods("POST")
+	adminRoutes.HandleFunc("/users/{id}/reactivate", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.ReactivateUser))).Methods("POST")
+	adminRoutes.HandleFunc("/users/{id}/restore", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.RestoreUser))).Methods("POST")
+	adminRoutes.HandleFunc("/users/{id}/export", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.RequestUserDataExport))).Methods("POST")
+	adminRoutes.HandleFunc("/users/{id}/exports/{exportId}", middleware.NoImpersonationMiddleware(middleware.RBACMiddleware("Admin")(controllers.GetUserDataExport))).Methods("GET")
+	adminRoutes.HandleFunc("/audit-logs", middleware.RBACMiddleware("Admin")(controllers.ListAuditLogs)).Methods("GET")
+
+	// SCIM 2.0 provisioning routes for identity providers. Discovery endpoints
+	// are public; resources require the provisioning client's bearer token.
+	router.HandleFunc("/scim/v2/ServiceProviderConfig", controllers.GetScimServiceProviderConfig).Methods("GET")
+	router.HandleFunc("/scim/v2/ResourceTypes", controllers.ListScimResourceTypes).Methods("GET")
+	router.HandleFunc("/scim/v2/Schemas", controllers.ListScimSchemas).Methods("GET")
+	router.HandleFunc("/scim/v2/Schemas/{id}", controllers.GetScimSchema).Methods("GET")
+
+	scimRoutes := router.PathPrefix("/scim/v2").Subrouter()
+	scimRoutes.Use(middleware.ScimAuthMiddleware)
+	scimRoutes.HandleFunc("/Users", controllers.ListScimUsers).Methods("GET")
+	scimRoutes.HandleFunc("/Users", controllers.CreateScimUser).Methods("POST")
+	scimRoutes.HandleFunc("/Users/{id}", controllers.GetScimUser).Methods("GET")
+	scimRoutes.HandleFunc("/Users/{id}", controllers.ReplaceScimUser).Methods("PUT")
+	scimRoutes.HandleFunc("/Users/{id}", controllers.PatchScimUser).Methods("PATCH")
+	scimRoutes.HandleFunc("/Users/{id}", controllers.DeleteScimUser).Methods("DELETE")
+	scimRoutes.HandleFunc("/Groups", controllers.ListScimGroups).Methods("GET")
+	scimRoutes.HandleFunc("/Groups", controllers.CreateScimGroup).Methods("POST")
+	scimRoutes.HandleFunc("/Groups/{id}", controllers.GetScimGroup).Methods("GET")
+	scimRoutes.HandleFunc("/Groups/{id}", controllers.ReplaceScimGroup).Methods("PUT")
+	scimRoutes.HandleFunc("/Groups/{id}", controllers.PatchScimGroup).Methods("PATCH")
+	scimRoutes.HandleFunc("/Groups/{id}", controllers.DeleteScimGroup).Methods("DELETE")
 
 	// Post Routes
 	// postRoutes := router.PathPrefix("/posts").Subrouter()
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+
+	"gorm.io/gorm"
+)
+
+const defaultDeletionGracePeriod = 30 * 24 * time.Hour
+
+// DeleteAccount deactivates the account and schedules it for purging once the
+// grace period ends. actorID is the user themselves or the admin deleting them.
+func DeleteAccount(userID, actorID uint, reason, ipAddress string) (*models.AccountDeletion, error) {
+	user, err := FindUserByID(userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.DeletedAt != nil {
+		return nil, errors.New("account is already deleted")
+	}
+
+	db := config.GetDB()
+	now := time.Now()
+	deletion := models.AccountDeletion{
+		UserID:        userID,
+		RequestedByID: actorID,
+		Reason:        reason,
+		PurgeAfter:    now.Add(deletionGracePeriod()),
+	}
+	// Only users who deleted their own account may undo it from the email;
+	// an admin's decision is reversed by an admin
+	if actorID == userID {
+		if deletion.RestoreNonce, err = utils.GenerateNonce(); err != nil {
+			return nil, err
+		}
+	}
+
+	tx := db.Begin()
+	err = tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"is_active":  false,
+		"deleted_at": now,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Create(&deletion).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "user.delete",
+		ActorID:   actorID,
+		SubjectID: userID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("purge_after=%s reason=%q", deletion.PurgeAfter.Format(time.RFC3339), reason),
+	})
+
+	if err := sendAccountDeletedEmail(user, &deletion); err != nil {
+		log.Printf("Error sending account deletion email: %v", err)
+	}
+	return &deletion, nil
+}
+
+// RestoreAccount reactivates an account that is still in its grace period
+func RestoreAccount(userID, actorID uint, ipAddress string) error {
+	db := config.GetDB()
+
+	var deletion models.AccountDeletion
+	err := db.Where("user_id = ? AND restored_at IS NULL AND purged_at IS NULL", userID).
+		Order("created_at desc").
+		First(&deletion).Error
+	if err != nil {
+		return errors.New("no pending deletion for this account")
+	}
+	return restoreAccount(&deletion, actorID, ipAddress)
+}
+
+func restoreAccount(deletion *models.AccountDeletion, actorID uint, ipAddress string) error {
+	// Past the grace period the account is due for purging, even if the job has not run yet
+	now := time.Now()
+	if !deletion.PurgeAfter.After(now) {
+		return errors.New("the grace period for restoring this account has ended")
+	}
+	userID := deletion.UserID
+
+	db := config.GetDB()
+	tx := db.Begin()
+	// A suspension outlives the deletion
+	err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"is_active":  activeSuspension(userID) == nil,
+		"deleted_at": nil,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Claim the deletion so the purge job cannot take it at the same time
+	result := tx.Model(&models.AccountDeletion{}).
+		Where("id = ? AND restored_at IS NULL AND purged_at IS NULL", deletion.ID).
+		Update("restored_at", now)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		tx.Rollback()
+		return errors.New("no pending deletion for this account")
+	}
+	deletion.RestoredAt = &now
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "user.restore",
+		ActorID:   actorID,
+		SubjectID: userID,
+		IPAddress: ipAddress,
+	})
+	return nil
+}
+
+// RestoreAccountWithToken restores an account using the link emailed on deletion
+func RestoreAccountWithToken(token, ipAddress string) error {
+	value, err := utils.VerifySignedValue(token)
+	if err != nil {
+		return errors.New("invalid restore token")
+	}
+
+	// Token value is restore:<deletion id>:<nonce>
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] != "restore" {
+		return errors.New("invalid restore token")
+	}
+	deletionID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("invalid restore token")
+	}
+
+	db := config.GetDB()
+	var deletion models.AccountDeletion
+	err = db.Where("restored_at IS NULL AND purged_at IS NULL").First(&deletion, uint(deletionID)).Error
+	if err != nil || deletion.RestoreNonce == "" ||
+		subtle.ConstantTimeCompare([]byte(deletion.RestoreNonce), []byte(parts[2])) != 1 {
+		return errors.New("invalid or expired restore token")
+	}
+	return restoreAccount(&deletion, deletion.UserID, ipAddress)
+}
+
+// RunAccountPurgeJob purges accounts whose grace period has ended, checking every interval
+func RunAccountPurgeJob(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if purged, err := PurgeExpiredAccounts(); err != nil {
+			log.Printf("Account purge failed: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted accounts", purged)
+		}
+		<-ticker.C
+	}
+}
+
+// PurgeExpiredAccounts hard-deletes or anonymizes every account past its grace period
+func PurgeExpiredAccounts() (int, error) {
+	db := config.GetDB()
+	if db == nil {
+		return 0, errors.New("database unavailable")
+	}
+
+	var deletions []models.AccountDeletion
+	err := db.Where("purge_after <= ? AND restored_at IS NULL AND purged_at IS NULL", time.Now()).
+		Find(&deletions).Error
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for i := range deletions {
+		if err := purgeAccount(db, &deletions[i]); err != nil {
+			log.Printf("Error purging user %d: %v", deletions[i].UserID, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeAccount removes the user's sessions, tokens and data exports, then
+// either deletes the user and their posts or anonymizes the user and keeps the
+// posts, depending on ACCOUNT_PURGE_MODE
+func purgeAccount(db *gorm.DB, deletion *models.AccountDeletion) error {
+	var user models.User
+	if err := db.First(&user, deletion.UserID).Error; err != nil {
+		return err
+	}
+	mode := purgeMode()
+
+	var exports []models.DataExport
+	if err := db.Where("user_id = ?", user.ID).Find(&exports).Error; err != nil {
+		return err
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Claim the deletion so an account restored meanwhile is left alone
+		now := time.Now()
+		result := tx.Model(&models.AccountDeletion{}).
+			Where("id = ? AND restored_at IS NULL AND purged_at IS NULL", deletion.ID).
+			Update("purged_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errors.New("account deletion was restored or already purged")
+		}
+		deletion.PurgedAt = &now
+
+		deletes := []struct {
+			query string
+			args  []interface{}
+			model interface{}
+		}{
+			{"user_id = ?", []interface{}{user.ID}, &models.Session{}},
+			{"subject_id = ?", []interface{}{user.ID}, &models.ImpersonationSession{}},
+			{"email = ?", []interface{}{user.Email}, &models.PasswordReset{}},
+			{"user_id = ?", []interface{}{user.ID}, &models.EmailChange{}},
+			{"user_id = ?", []interface{}{user.ID}, &models.OrganizationMember{}},
+			{"user_id = ?", []interface{}{user.ID}, &models.SAMLIdentity{}},
+			{"user_id = ?", []interface{}{user.ID}, &models.DataExport{}},
+			{"throttle_key = ?", []interface{}{accountThrottleKey(user.Email)}, &models.LoginThrottle{}},
+		}
+		for _, d := range deletes {
+			if err := tx.Unscoped().Where(d.query, d.args...).Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM group_members WHERE user_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+
+		if mode == "delete" {
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Post{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&user).Error
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"username":      fmt.Sprintf("deleted-user-%d", user.ID),
+			"name":          "Deleted user",
+			"email":         fmt.Sprintf("deleted-user-%d@invalid", user.ID),
+			"avatar_url":    "",
+			"password_hash": "",
+			"is_active":     false,
+		}).Error
+	})
+	if err != nil {
+		deletion.PurgedAt = nil
+		return err
+	}
+
+	for _, export := range exports {
+		if export.FilePath == "" {
+			continue
+		}
+		if err := os.Remove(export.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting export %d of purged user %d: %v", export.ID, user.ID, err)
+		}
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "user.purge",
+		SubjectID: user.ID,
+		Details:   fmt.Sprintf("mode=%s deletion_id=%d", mode, deletion.ID),
+	})
+	return nil
+}
+
+func sendAccountDeletedEmail(user *models.User, deletion *models.AccountDeletion) error {
+	body := fmt.Sprintf("Hi %s,\n\nYour account has been deleted and will be permanently removed on %s.\n\n",
+		user.Username, deletion.PurgeAfter.Format(time.RFC1123))
+	if deletion.RestoreNonce != "" {
+		token := utils.SignValue(fmt.Sprintf("restore:%d:%s", deletion.ID, deletion.RestoreNonce))
+		link := utils.FrontendURL("/account/restore?token=" + url.QueryEscape(token))
+		body += "Changed your mind? Restore it before then: " + link
+	} else {
+		body += "If you think this is a mistake, contact an administrator before then."
+	}
+	return utils.SendEmail(user.Email, "Your account has been deleted", body)
+}
+
+func deletionGracePeriod() time.Duration {
+	if period, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD")); err == nil && period >= 0 {
+		return period
+	}
+	return defaultDeletionGracePeriod
+}
+
+func purgeMode() string {
+	if os.Getenv("ACCOUNT_PURGE_MODE") == "delete" {
+		return "delete"
+	}
+	return "anonymize"
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+)
+
+// dueDeletion deletes the user's account with its grace period already over
+func dueDeletion(t *testing.T, userID uint) *models.AccountDeletion {
+	t.Helper()
+	deletion, err := DeleteAccount(userID, userID, "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.GetDB().Model(deletion).Update("purge_after", time.Now().Add(-time.Minute))
+	return deletion
+}
+
+func TestPurgeExpiredAccounts(t *testing.T) {
+	for _, mode := range []string{"anonymize", "delete"} {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv("ACCOUNT_PURGE_MODE", mode)
+			db := testutil.NewDB(t)
+			user := testutil.CreateUser(t, db, "alice", "Viewer")
+			CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+			archive := filepath.Join(t.TempDir(), "export.zip")
+			os.WriteFile(archive, []byte("zip"), 0600)
+			db.Create(&models.DataExport{UserID: user.ID, Status: "ready", FilePath: archive})
+			deletion := dueDeletion(t, user.ID)
+
+			if purged, err := PurgeExpiredAccounts(); err != nil || purged != 1 {
+				t.Fatalf("PurgeExpiredAccounts() = %d, %v", purged, err)
+			}
+
+			var sessions int64
+			db.Model(&models.Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+			if sessions != 0 {
+				t.Errorf("sessions left = %d", sessions)
+			}
+			var exports int64
+			db.Model(&models.DataExport{}).Where("user_id = ?", user.ID).Count(&exports)
+			if _, err := os.Stat(archive); exports != 0 || !os.IsNotExist(err) {
+				t.Errorf("exports left = %d, archive stat err = %v", exports, err)
+			}
+			var remaining models.User
+			err := db.First(&remaining, user.ID).Error
+			if mode == "delete" && err == nil {
+				t.Error("user was not deleted")
+			}
+			if mode == "anonymize" && (err != nil || remaining.Email == user.Email) {
+				t.Errorf("user = %+v, %v", remaining, err)
+			}
+			db.First(deletion, deletion.ID)
+			if deletion.PurgedAt == nil {
+				t.Error("deletion not marked purged")
+			}
+		})
+	}
+}
+
+func TestPurgeAccountRollsBack(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+	deletion := dueDeletion(t, user.ID)
+
+	// A step late in the purge fails
+	if err := db.Exec("DROP TABLE group_members").Error; err != nil {
+		t.Fatal(err)
+	}
+	if purged, _ := PurgeExpiredAccounts(); purged != 0 {
+		t.Fatalf("purged = %d", purged)
+	}
+
+	var sessions int64
+	db.Model(&models.Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+	if sessions != 1 {
+		t.Errorf("sessions = %d, earlier deletes were not rolled back", sessions)
+	}
+	db.First(deletion, deletion.ID)
+	if deletion.PurgedAt != nil {
+		t.Error("deletion marked purged")
+	}
+}
+
+func TestPurgeSkipsRestoredAccount(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	deletion := dueDeletion(t, user.ID)
+
+	// Restored after the purge job loaded the deletion
+	now := time.Now()
+	db.Model(&models.AccountDeletion{}).Where("id = ?", deletion.ID).Update("restored_at", now)
+	if err := purgeAccount(db, deletion); err == nil {
+		t.Error("restored account was purged")
+	}
+
+	var remaining models.User
+	if err := db.First(&remaining, user.ID).Error; err != nil || remaining.Email != user.Email {
+		t.Errorf("user = %+v, %v", remaining, err)
+	}
+}
+
+func TestRestoreAccountWithToken(t *testing.T) {
+	db := testutil.NewDB(t)
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	alice := testutil.CreateUser(t, db, "alice", "Viewer")
+	bob := testutil.CreateUser(t, db, "bob", "Viewer")
+	restoreToken := func(deletion *models.AccountDeletion) string {
+		return utils.SignValue(fmt.Sprintf("restore:%d:%s", deletion.ID, deletion.RestoreNonce))
+	}
+
+	own, err := DeleteAccount(alice.ID, alice.ID, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{
+		utils.SignValue(fmt.Sprintf("restore:%d", own.ID)),
+		utils.SignValue(fmt.Sprintf("restore:%d:guess", own.ID)),
+	} {
+		if err := RestoreAccountWithToken(token, ""); err == nil {
+			t.Errorf("restored with %q", token)
+		}
+	}
+
+	// The link stops working once the grace period is over, before the purge runs
+	db.Model(own).Update("purge_after", time.Now().Add(-time.Minute))
+	if err := RestoreAccountWithToken(restoreToken(own), ""); err == nil {
+		t.Error("restored after the grace period")
+	}
+	db.Model(own).Update("purge_after", time.Now().Add(time.Hour))
+	if err := RestoreAccountWithToken(restoreToken(own), ""); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, _ := FindUserByID(alice.ID); reloaded.DeletedAt != nil || !reloaded.IsActive {
+		t.Errorf("alice = %+v", reloaded)
+	}
+	if err := RestoreAccountWithToken(restoreToken(own), ""); err == nil {
+		t.Error("restored twice with the same link")
+	}
+
+	// Accounts deleted by an admin get no restore link
+	byAdmin, err := DeleteAccount(bob.ID, admin.ID, "abuse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byAdmin.RestoreNonce != "" {
+		t.Error("restore nonce issued for an admin deletion")
+	}
+	if err := RestoreAccountWithToken(restoreToken(byAdmin), ""); err == nil {
+		t.Error("user undid an admin deletion")
+	}
+	if err := RestoreAccount(bob.ID, admin.ID, ""); err != nil {
+		t.Errorf("admin restore: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+	"log"
+
+	"hells/config"
+	"hells/models"
+)
+
+// RecordAudit stores an audit entry. Failures are logged rather than returned so
+// that auditing never blocks the action being audited.
+func RecordAudit(entry models.AuditLog) {
+	db := config.GetDB()
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("Error recording audit entry %s: %v", entry.Action, err)
+	}
+}
+
+// MaxAuditLogPageSize caps the limit accepted by ListAuditLogs
+const MaxAuditLogPageSize = 100
+
+func ListAuditLogs(page, limit int) ([]models.AuditLog, int, error) {
+	db := config.GetDB()
+	var entries []models.AuditLog
+	var total int64
+
+	// Count total entries
+	db.Model(&models.AuditLog{}).Count(&total)
+
+	// Paginate and fetch entries
+	err := db.Order("created_at desc").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Find(&entries).Error
+
+	return entries, int(total), err
+}
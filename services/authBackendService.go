@@ -0,0 +1,155 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+)
+
+var (
+	// ErrInvalidCredentials is returned for a wrong login or password
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnknownLogin tells Authenticate to try the next backend
+	ErrUnknownLogin = errors.New("unknown login")
+	// ErrAuthBackendUnavailable is returned when no backend accepted the login
+	// and at least one of them could not be reached
+	ErrAuthBackendUnavailable = errors.New("authentication backend unavailable")
+)
+
+// AuthBackend checks a login and password against one source of accounts
+type AuthBackend interface {
+	// Name is the value of models.User.AuthSource for users of this backend
+	Name() string
+	// Authenticate returns the local user for valid credentials. It returns
+	// ErrUnknownLogin when the backend has no account for the login, and
+	// ErrInvalidCredentials together with the user, if one is known, when the
+	// password is wrong so the failure counts against the account.
+	Authenticate(login, password string) (*models.User, error)
+}
+
+var (
+	authBackends     []AuthBackend
+	authBackendsOnce sync.Once
+)
+
+// AuthBackends returns the backends listed in AUTH_BACKENDS (local, ldap) in the
+// order they are tried. Only the local backend is used by default.
+func AuthBackends() []AuthBackend {
+	authBackendsOnce.Do(func() {
+		names := os.Getenv("AUTH_BACKENDS")
+		if names == "" {
+			names = "local"
+		}
+		for _, name := range strings.Split(names, ",") {
+			switch strings.TrimSpace(name) {
+			case "local":
+				authBackends = append(authBackends, LocalAuthBackend{})
+			case "ldap":
+				authBackends = append(authBackends, NewLDAPAuthBackend())
+			default:
+				log.Printf("Ignoring unknown authentication backend %q", name)
+			}
+		}
+	})
+	return authBackends
+}
+
+// Authenticate tries each backend in turn until one knows the login
+func Authenticate(login, password string) (*models.User, error) {
+	return authenticateWith(AuthBackends(), login, password)
+}
+
+// VerifyUserPassword checks the password of a signed-in user against the
+// backend their account belongs to
+func VerifyUserPassword(user *models.User, password string) error {
+	for _, backend := range AuthBackends() {
+		if backend.Name() != authSource(user) {
+			continue
+		}
+		authenticated, err := backend.Authenticate(user.Email, password)
+		if err != nil {
+			return err
+		}
+		if authenticated.ID != user.ID {
+			return ErrInvalidCredentials
+		}
+		return nil
+	}
+	return ErrInvalidCredentials
+}
+
+func authenticateWith(backends []AuthBackend, login, password string) (*models.User, error) {
+	unavailable := false
+	for _, backend := range backends {
+		user, err := backend.Authenticate(login, password)
+		if errors.Is(err, ErrUnknownLogin) {
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidCredentials) {
+			// Let the other backends try, but do not report a wrong password
+			// for an account whose backend could not be asked
+			log.Printf("Authentication backend %s failed: %v", backend.Name(), err)
+			unavailable = true
+			continue
+		}
+		return user, err
+	}
+
+	if unavailable {
+		return nil, ErrAuthBackendUnavailable
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// authSource is the backend that checks the user's password. Users
+// provisioned through SCIM sign in with a local password.
+func authSource(user *models.User) string {
+	if user.AuthSource == "" || user.AuthSource == "scim" {
+		return "local"
+	}
+	return user.AuthSource
+}
+
+// dummyPasswordHash is compared against when no account matches the login
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+// LocalAuthBackend checks passwords against the hashes stored with each user
+type LocalAuthBackend struct{}
+
+func (LocalAuthBackend) Name() string {
+	return "local"
+}
+
+func (LocalAuthBackend) Authenticate(login, password string) (*models.User, error) {
+	user, err := FindUserByEmail(login)
+	if err != nil || authSource(user) != "local" {
+		// Spend the same time as a real password check so timing does not reveal the account
+		dummyPasswordHashOnce.Do(func() { dummyPasswordHash, _ = utils.HashPassword("dummy-password") })
+		utils.CheckPasswordHash(password, dummyPasswordHash)
+		return nil, ErrUnknownLogin
+	}
+
+	ok, needsRehash := utils.VerifyPassword(password, user.PasswordHash)
+	if !ok {
+		return user, ErrInvalidCredentials
+	}
+
+	// Upgrade hashes made with an outdated algorithm, cost or pepper
+	if needsRehash {
+		if rehashed, err := utils.HashPassword(password); err == nil {
+			user.PasswordHash = rehashed
+			db := config.GetDB()
+			db.Model(&models.User{}).Where("id = ?", user.ID).Update("password_hash", rehashed)
+		}
+	}
+	return user, nil
+}
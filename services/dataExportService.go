@@ -0,0 +1,367 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+)
+
+const exportDownloadTTL = 24 * time.Hour
+
+// exportDataset is one file pair (JSON and CSV) in the export archive
+type exportDataset struct {
+	name   string
+	data   interface{}
+	header []string
+	rows   [][]string
+}
+
+// RequestDataExport queues an export of everything stored about the user and
+// builds it in the background
+func RequestDataExport(userID, requestedByID uint, ipAddress string) (*models.DataExport, error) {
+	if _, err := FindUserByID(userID); err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	db := config.GetDB()
+	export := models.DataExport{UserID: userID, RequestedByID: requestedByID, Status: "pending"}
+	if err := db.Create(&export).Error; err != nil {
+		return nil, err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "user.export",
+		ActorID:   requestedByID,
+		SubjectID: userID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("export_id=%d", export.ID),
+	})
+
+	go buildDataExport(export.ID)
+	return &export, nil
+}
+
+// FindDataExport returns the export with a signed download URL once it is ready
+func FindDataExport(userID, exportID uint) (*models.DataExport, error) {
+	db := config.GetDB()
+	var export models.DataExport
+	if err := db.Where("user_id = ?", userID).First(&export, exportID).Error; err != nil {
+		return nil, errors.New("export not found")
+	}
+	if export.Status == "ready" && export.ExpiresAt != nil {
+		export.DownloadURL = exportDownloadURL(&export)
+	}
+	return &export, nil
+}
+
+// OpenDataExport checks a signed download URL and claims the export, so each
+// archive is served once. The caller must call FinishDataExportDownload once
+// the file has been sent, or ReleaseDataExport if sending it failed.
+func OpenDataExport(exportID uint, expires int64, signature string) (*models.DataExport, error) {
+	value, err := utils.VerifySignedValue(signature)
+	if err != nil || value != fmt.Sprintf("export:%d:%d", exportID, expires) {
+		return nil, errors.New("invalid download link")
+	}
+	if time.Now().Unix() > expires {
+		return nil, errors.New("download link has expired")
+	}
+
+	// Claim the export so concurrent requests cannot download it again
+	db := config.GetDB()
+	result := db.Model(&models.DataExport{}).
+		Where("id = ? AND status = ?", exportID, "ready").
+		Updates(map[string]interface{}{"status": "downloaded", "downloaded_at": time.Now()})
+	if result.Error != nil || result.RowsAffected != 1 {
+		return nil, errors.New("export is not available")
+	}
+
+	var export models.DataExport
+	if err := db.First(&export, exportID).Error; err != nil {
+		return nil, errors.New("export is not available")
+	}
+	return &export, nil
+}
+
+// FinishDataExportDownload deletes the archive after it has been retrieved
+func FinishDataExportDownload(export *models.DataExport) {
+	if err := os.Remove(export.FilePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error deleting export %d: %v", export.ID, err)
+	}
+
+	db := config.GetDB()
+	db.Model(export).Update("file_path", "")
+}
+
+// ReleaseDataExport makes a claimed export downloadable again after the
+// transfer failed, so the link can be retried until it expires
+func ReleaseDataExport(export *models.DataExport) {
+	db := config.GetDB()
+	db.Model(&models.DataExport{}).
+		Where("id = ? AND status = ?", export.ID, "downloaded").
+		Updates(map[string]interface{}{"status": "ready", "downloaded_at": nil})
+}
+
+// FailInterruptedDataExports marks exports that were still being built when the
+// server stopped as failed, so they do not stay pending forever. It is run on
+// startup, before any new export starts.
+func FailInterruptedDataExports() (int64, error) {
+	db := config.GetDB()
+	var exports []models.DataExport
+	if err := db.Where("status IN ?", []string{"pending", "running"}).Find(&exports).Error; err != nil {
+		return 0, err
+	}
+	for i := range exports {
+		// The build may have left a partial archive behind
+		if err := os.Remove(exportArchivePath(&exports[i])); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting partial export %d: %v", exports[i].ID, err)
+		}
+	}
+
+	result := db.Model(&models.DataExport{}).Where("status IN ?", []string{"pending", "running"}).
+		Updates(map[string]interface{}{"status": "failed", "error": "interrupted by a server restart"})
+	return result.RowsAffected, result.Error
+}
+
+// RunDataExportCleanupJob deletes archives that were never downloaded before their link expired
+func RunDataExportCleanupJob(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if db := config.GetDB(); db != nil {
+			var exports []models.DataExport
+			db.Where("status = ? AND expires_at <= ?", "ready", time.Now()).Find(&exports)
+			for i := range exports {
+				if err := os.Remove(exports[i].FilePath); err != nil && !os.IsNotExist(err) {
+					log.Printf("Error deleting export %d: %v", exports[i].ID, err)
+					continue
+				}
+				db.Model(&exports[i]).Updates(map[string]interface{}{"status": "expired", "file_path": ""})
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func buildDataExport(exportID uint) {
+	db := config.GetDB()
+	var export models.DataExport
+	if err := db.First(&export, exportID).Error; err != nil {
+		log.Printf("Error loading export %d: %v", exportID, err)
+		return
+	}
+	db.Model(&export).Update("status", "running")
+
+	path, err := writeExportArchive(&export)
+	if err != nil {
+		log.Printf("Error building export %d: %v", exportID, err)
+		db.Model(&export).Updates(map[string]interface{}{"status": "failed", "error": err.Error()})
+		return
+	}
+
+	// The export may have been deleted with its account while it was being built
+	expiresAt := time.Now().Add(exportDownloadTTL)
+	result := db.Model(&models.DataExport{}).Where("id = ? AND status = ?", export.ID, "running").Updates(map[string]interface{}{
+		"status":     "ready",
+		"file_path":  path,
+		"expires_at": expiresAt,
+	})
+	if result.Error != nil || result.RowsAffected != 1 {
+		os.Remove(path)
+		return
+	}
+	export.ExpiresAt = &expiresAt
+
+	if err := sendDataExportReadyEmail(&export); err != nil {
+		log.Printf("Error sending export notification: %v", err)
+	}
+}
+
+func writeExportArchive(export *models.DataExport) (string, error) {
+	datasets, err := collectExportDatasets(export.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(exportDir(), 0700); err != nil {
+		return "", err
+	}
+	path := exportArchivePath(export)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	complete := false
+	defer func() {
+		file.Close()
+		// Never leave a partial archive behind
+		if !complete {
+			os.Remove(path)
+		}
+	}()
+
+	archive := zip.NewWriter(file)
+	for _, dataset := range datasets {
+		jsonFile, err := archive.Create(dataset.name + ".json")
+		if err != nil {
+			return "", err
+		}
+		encoder := json.NewEncoder(jsonFile)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(dataset.data); err != nil {
+			return "", err
+		}
+
+		csvFile, err := archive.Create(dataset.name + ".csv")
+		if err != nil {
+			return "", err
+		}
+		writer := csv.NewWriter(csvFile)
+		writer.Write(dataset.header)
+		writer.WriteAll(dataset.rows)
+		if err := writer.Error(); err != nil {
+			return "", err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return "", err
+	}
+	complete = true
+	return path, nil
+}
+
+func collectExportDatasets(userID uint) ([]exportDataset, error) {
+	db := config.GetDB()
+
+	var user models.User
+	if err := db.Preload("Role").First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	var posts []models.Post
+	var sessions []models.Session
+	var auditEntries []models.AuditLog
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&posts).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("actor_id = ? OR subject_id = ?", userID, userID).Order("created_at").Find(&auditEntries).Error; err != nil {
+		return nil, err
+	}
+	// Entries about the user that someone else performed, such as an admin's,
+	// do not reveal who that was or where they were
+	for i := range auditEntries {
+		if auditEntries[i].ActorID != userID {
+			auditEntries[i].ActorID = 0
+			auditEntries[i].IPAddress = ""
+		}
+	}
+
+	profile := exportDataset{
+		name:   "profile",
+		data:   user,
+		header: []string{"id", "username", "name", "email", "avatar_url", "role", "is_active", "last_login", "created_at"},
+		rows: [][]string{{
+			strconv.FormatUint(uint64(user.ID), 10), user.Username, user.Name, user.Email, user.AvatarURL,
+			user.Role.Name, strconv.FormatBool(user.IsActive), formatExportTime(user.LastLogin), formatExportTime(user.CreatedAt),
+		}},
+	}
+
+	// Role history is the trail of role change audit entries
+	var roleChanges []models.AuditLog
+	roleHistory := exportDataset{name: "role_history", header: []string{"changed_at", "changed_by", "details"}}
+	for _, entry := range auditEntries {
+		if entry.Action == "user.role_change" && entry.SubjectID == userID {
+			roleChanges = append(roleChanges, entry)
+			roleHistory.rows = append(roleHistory.rows, []string{
+				formatExportTime(entry.CreatedAt), strconv.FormatUint(uint64(entry.ActorID), 10), entry.Details,
+			})
+		}
+	}
+	roleHistory.data = roleChanges
+
+	postData := exportDataset{name: "posts", data: posts, header: []string{"id", "title", "status", "content", "created_at"}}
+	for _, post := range posts {
+		postData.rows = append(postData.rows, []string{
+			strconv.FormatUint(uint64(post.ID), 10), post.Title, post.Status, post.Content, formatExportTime(post.CreatedAt),
+		})
+	}
+
+	// Every login creates a session, so all sessions form the login history
+	// and the ones still active are the current sessions
+	var activeSessions []models.Session
+	loginHistory := exportDataset{name: "login_history", data: sessions, header: []string{"logged_in_at", "device", "ip_address", "user_agent"}}
+	sessionData := exportDataset{name: "sessions", header: []string{"id", "device", "ip_address", "created_at", "last_seen_at", "expires_at"}}
+	for _, session := range sessions {
+		loginHistory.rows = append(loginHistory.rows, []string{
+			formatExportTime(session.CreatedAt), session.Device, session.IPAddress, session.UserAgent,
+		})
+		if session.IsActive() {
+			activeSessions = append(activeSessions, session)
+			sessionData.rows = append(sessionData.rows, []string{
+				strconv.FormatUint(uint64(session.ID), 10), session.Device, session.IPAddress,
+				formatExportTime(session.CreatedAt), formatExportTime(session.LastSeenAt), formatExportTime(session.ExpiresAt),
+			})
+		}
+	}
+	sessionData.data = activeSessions
+
+	auditData := exportDataset{name: "audit_log", data: auditEntries, header: []string{"created_at", "action", "actor_id", "subject_id", "ip_address", "details"}}
+	for _, entry := range auditEntries {
+		auditData.rows = append(auditData.rows, []string{
+			formatExportTime(entry.CreatedAt), entry.Action, strconv.FormatUint(uint64(entry.ActorID), 10),
+			strconv.FormatUint(uint64(entry.SubjectID), 10), entry.IPAddress, entry.Details,
+		})
+	}
+
+	return []exportDataset{profile, roleHistory, postData, sessionData, loginHistory, auditData}, nil
+}
+
+func exportDownloadURL(export *models.DataExport) string {
+	expires := export.ExpiresAt.Unix()
+	signature := utils.SignValue(fmt.Sprintf("export:%d:%d", export.ID, expires))
+	return utils.AppURL(fmt.Sprintf("/exports/%d/download?expires=%d&signature=%s", export.ID, expires, url.QueryEscape(signature)))
+}
+
+func sendDataExportReadyEmail(export *models.DataExport) error {
+	requester, err := FindUserByID(export.RequestedByID)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nThe data export you requested is ready. Download it before %s: %s\n\n"+
+		"The archive is deleted as soon as it has been downloaded.",
+		requester.Username, export.ExpiresAt.Format(time.RFC1123), exportDownloadURL(export))
+	return utils.SendEmail(requester.Email, "Your data export is ready", body)
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func exportArchivePath(export *models.DataExport) string {
+	return filepath.Join(exportDir(), fmt.Sprintf("export-%d-%d.zip", export.UserID, export.ID))
+}
+
+func exportDir() string {
+	if dir := os.Getenv("EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "hells-exports")
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"os"
+	"testing"
+
+	"hells/models"
+	"hells/testutil"
+)
+
+func TestExportRedactsOtherActors(t *testing.T) {
+	db := testutil.NewDB(t)
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	db.Create(&models.AuditLog{Action: "user.login", ActorID: user.ID, SubjectID: user.ID, IPAddress: "198.51.100.7"})
+	db.Create(&models.AuditLog{Action: "user.suspend", ActorID: admin.ID, SubjectID: user.ID, IPAddress: "10.0.0.5"})
+
+	datasets, err := collectExportDatasets(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dataset := range datasets {
+		if dataset.name != "audit_log" {
+			continue
+		}
+		entries := dataset.data.([]models.AuditLog)
+		if len(entries) != 2 || len(dataset.rows) != 2 {
+			t.Fatalf("audit entries = %+v", entries)
+		}
+		if entries[0].ActorID != user.ID || entries[0].IPAddress != "198.51.100.7" {
+			t.Errorf("own entry = %+v", entries[0])
+		}
+		if entries[1].ActorID != 0 || entries[1].IPAddress != "" || dataset.rows[1][2] != "0" || dataset.rows[1][4] != "" {
+			t.Errorf("admin's entry = %+v, row %v", entries[1], dataset.rows[1])
+		}
+	}
+}
+
+func TestFailInterruptedDataExports(t *testing.T) {
+	t.Setenv("EXPORT_DIR", t.TempDir())
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	exports := []models.DataExport{
+		{UserID: user.ID, Status: "pending"},
+		{UserID: user.ID, Status: "running"},
+		{UserID: user.ID, Status: "ready"},
+	}
+	db.Create(&exports)
+	partial := exportArchivePath(&exports[1])
+	os.WriteFile(partial, []byte("partial"), 0600)
+
+	if failed, err := FailInterruptedDataExports(); err != nil || failed != 2 {
+		t.Fatalf("FailInterruptedDataExports() = %d, %v", failed, err)
+	}
+	for i, want := range []string{"failed", "failed", "ready"} {
+		db.First(&exports[i], exports[i].ID)
+		if exports[i].Status != want {
+			t.Errorf("export %d status = %s, want %s", i, exports[i].Status, want)
+		}
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Error("partial archive was not deleted")
+	}
+}
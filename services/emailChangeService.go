@@ -0,0 +1,203 @@
+package services
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+)
+
+const emailChangeTTL = 24 * time.Hour
+
+// RequestEmailChange stages a new email address for the user. The address only
+// changes once the link sent to it is confirmed; the old address gets a cancel link.
+func RequestEmailChange(user *models.User, newEmail, ipAddress string) (*models.EmailChange, error) {
+	newEmail = normalizeEmail(newEmail)
+	if !strings.Contains(newEmail, "@") {
+		return nil, errors.New("invalid email address")
+	}
+	if strings.EqualFold(newEmail, user.Email) {
+		return nil, errors.New("new email matches the current email")
+	}
+	if emailTaken(newEmail, user.ID) {
+		return nil, errors.New("email already exists")
+	}
+
+	nonce, err := utils.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	db := config.GetDB()
+	tx := db.Begin()
+
+	// A new request supersedes any earlier pending one
+	now := time.Now()
+	err = tx.Model(&models.EmailChange{}).
+		Where("user_id = ? AND confirmed_at IS NULL AND cancelled_at IS NULL", user.ID).
+		Update("cancelled_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	change := models.EmailChange{
+		UserID:    user.ID,
+		OldEmail:  user.Email,
+		NewEmail:  newEmail,
+		Nonce:     nonce,
+		ExpiresAt: now.Add(emailChangeTTL),
+	}
+	if err := tx.Create(&change).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "email_change.request",
+		ActorID:   user.ID,
+		SubjectID: user.ID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("new_email=%s", newEmail),
+	})
+
+	// Without the confirmation email the change could never complete
+	if err := sendEmailChangeEmails(user, &change); err != nil {
+		log.Printf("Error sending email change confirmation: %v", err)
+		db.Model(&change).Update("cancelled_at", time.Now())
+		return nil, errors.New("failed to send confirmation email")
+	}
+	return &change, nil
+}
+
+// ConfirmEmailChange swaps the user's email once the new address confirms
+func ConfirmEmailChange(token, ipAddress string) error {
+	change, err := findEmailChangeByToken(token, "confirm")
+	if err != nil {
+		return err
+	}
+
+	// The address may have been claimed while the change was pending
+	if emailTaken(change.NewEmail, change.UserID) {
+		return errors.New("email already exists")
+	}
+
+	db := config.GetDB()
+	tx := db.Begin()
+
+	if err := tx.Model(&models.User{}).Where("id = ?", change.UserID).Update("email", change.NewEmail).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now()
+	change.ConfirmedAt = &now
+	if err := tx.Save(change).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "email_change.confirm",
+		ActorID:   change.UserID,
+		SubjectID: change.UserID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("old_email=%s new_email=%s", change.OldEmail, change.NewEmail),
+	})
+	return nil
+}
+
+// CancelEmailChange is used from the link sent to the old address
+func CancelEmailChange(token, ipAddress string) error {
+	change, err := findEmailChangeByToken(token, "cancel")
+	if err != nil {
+		return err
+	}
+
+	db := config.GetDB()
+	now := time.Now()
+	change.CancelledAt = &now
+	if err := db.Save(change).Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "email_change.cancel",
+		SubjectID: change.UserID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("new_email=%s", change.NewEmail),
+	})
+	return nil
+}
+
+func findEmailChangeByToken(token, purpose string) (*models.EmailChange, error) {
+	value, err := utils.VerifySignedValue(token)
+	if err != nil {
+		return nil, errors.New("invalid email change token")
+	}
+
+	// Token value is email-change:<purpose>:<id>:<nonce>
+	parts := strings.SplitN(value, ":", 4)
+	if len(parts) != 4 || parts[0] != "email-change" || parts[1] != purpose {
+		return nil, errors.New("invalid email change token")
+	}
+	changeID, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid email change token")
+	}
+
+	db := config.GetDB()
+	var change models.EmailChange
+	if err := db.First(&change, uint(changeID)).Error; err != nil {
+		return nil, errors.New("invalid email change token")
+	}
+	if subtle.ConstantTimeCompare([]byte(change.Nonce), []byte(parts[3])) != 1 || !change.IsPending() {
+		return nil, errors.New("invalid or expired email change token")
+	}
+	return &change, nil
+}
+
+func emailTaken(email string, excludeUserID uint) bool {
+	db := config.GetDB()
+	var existingUser models.User
+	err := db.Where("email = ? AND id <> ?", email, excludeUserID).First(&existingUser).Error
+	return err == nil
+}
+
+func emailChangeToken(change *models.EmailChange, purpose string) string {
+	return utils.SignValue(fmt.Sprintf("email-change:%s:%d:%s", purpose, change.ID, change.Nonce))
+}
+
+func sendEmailChangeEmails(user *models.User, change *models.EmailChange) error {
+	confirmLink := utils.FrontendURL("/email-change/confirm?token=" + url.QueryEscape(emailChangeToken(change, "confirm")))
+	confirmBody := fmt.Sprintf("Hi %s,\n\nConfirm that you want to use this address for your account: %s\n\n"+
+		"The link expires on %s. Until then your sign-in email stays %s.",
+		user.Username, confirmLink, change.ExpiresAt.Format(time.RFC1123), change.OldEmail)
+	if err := utils.SendEmail(change.NewEmail, "Confirm your new email address", confirmBody); err != nil {
+		return err
+	}
+
+	cancelLink := utils.FrontendURL("/email-change/cancel?token=" + url.QueryEscape(emailChangeToken(change, "cancel")))
+	noticeBody := fmt.Sprintf("Hi %s,\n\nA request was made to change your account email to %s.\n\n"+
+		"If this wasn't you, cancel the change and reset your password: %s",
+		user.Username, change.NewEmail, cancelLink)
+	if err := utils.SendEmail(change.OldEmail, "Your account email is being changed", noticeBody); err != nil {
+		log.Printf("Error sending email change notice: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+
+	"gorm.io/gorm"
+)
+
+func createEmailChange(t *testing.T, db *gorm.DB, user *models.User, newEmail string) *models.EmailChange {
+	t.Helper()
+	change := models.EmailChange{
+		UserID:    user.ID,
+		OldEmail:  user.Email,
+		NewEmail:  newEmail,
+		Nonce:     "nonce",
+		ExpiresAt: time.Now().Add(emailChangeTTL),
+	}
+	if err := db.Create(&change).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &change
+}
+
+func TestConfirmEmailChange(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	change := createEmailChange(t, db, user, "alice@new.example.com")
+
+	// The links sent to the old and the new address are not interchangeable
+	if err := ConfirmEmailChange(emailChangeToken(change, "cancel"), ""); err == nil {
+		t.Error("confirmed with the cancel link")
+	}
+	if err := ConfirmEmailChange(emailChangeToken(change, "confirm")+"x", ""); err == nil {
+		t.Error("confirmed with a tampered link")
+	}
+
+	if err := ConfirmEmailChange(emailChangeToken(change, "confirm"), ""); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _ := FindUserByID(user.ID)
+	if reloaded.Email != "alice@new.example.com" {
+		t.Errorf("email = %s", reloaded.Email)
+	}
+	if err := ConfirmEmailChange(emailChangeToken(change, "confirm"), ""); err == nil {
+		t.Error("confirmed the same change twice")
+	}
+	if err := CancelEmailChange(emailChangeToken(change, "cancel"), ""); err == nil {
+		t.Error("cancelled a confirmed change")
+	}
+}
+
+func TestCancelAndExpireEmailChange(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+
+	cancelled := createEmailChange(t, db, user, "alice@new.example.com")
+	if err := CancelEmailChange(emailChangeToken(cancelled, "cancel"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfirmEmailChange(emailChangeToken(cancelled, "confirm"), ""); err == nil {
+		t.Error("confirmed a cancelled change")
+	}
+
+	expired := createEmailChange(t, db, user, "alice@other.example.com")
+	db.Model(expired).Update("expires_at", time.Now().Add(-time.Minute))
+	if err := ConfirmEmailChange(emailChangeToken(expired, "confirm"), ""); err == nil {
+		t.Error("confirmed an expired change")
+	}
+
+	// The new address may have been taken while the change was pending
+	taken := createEmailChange(t, db, user, "bob@example.com")
+	testutil.CreateUser(t, db, "bob", "Viewer")
+	if err := ConfirmEmailChange(emailChangeToken(taken, "confirm"), ""); err == nil {
+		t.Error("confirmed an address that is now taken")
+	}
+
+	reloaded, _ := FindUserByID(user.ID)
+	if reloaded.Email != user.Email {
+		t.Errorf("email = %s, want %s", reloaded.Email, user.Email)
+	}
+}
+
+func TestRequestEmailChangeValidation(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	testutil.CreateUser(t, db, "bob", "Viewer")
+
+	for _, email := range []string{"not an email", "ALICE@example.com", "bob@example.com"} {
+		if _, err := RequestEmailChange(user, email, ""); err == nil {
+			t.Errorf("RequestEmailChange(%q) succeeded", email)
+		}
+	}
+
+	// Without email delivery the change could never be confirmed
+	t.Setenv("SMTP_HOST", "")
+	if _, err := RequestEmailChange(user, "alice@new.example.com", ""); err == nil {
+		t.Error("change requested without sending the confirmation")
+	}
+	var pending int64
+	db.Model(&models.EmailChange{}).Where("cancelled_at IS NULL").Count(&pending)
+	if pending != 0 {
+		t.Errorf("pending changes = %d, want 0", pending)
+	}
+}
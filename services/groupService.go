@@ -0,0 +1,283 @@
+package services
+
+import (
+	"errors"
+	"sort"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+)
+
+func CreateGroup(group *models.Group) error {
+	db := config.GetDB()
+
+	var existing models.Group
+	if err := db.Where("name = ?", group.Name).First(&existing).Error; err == nil {
+		return errors.New("group already exists")
+	}
+
+	return db.Create(group).Error
+}
+
+func ListGroups() ([]models.Group, error) {
+	db := config.GetDB()
+	var groups []models.Group
+	err := db.Preload("Roles").Preload("Permissions").Order("name").Find(&groups).Error
+	return groups, err
+}
+
+func FindGroupByID(groupID uint) (*models.Group, error) {
+	db := config.GetDB()
+	var group models.Group
+	err := db.Preload("Members").Preload("Roles").Preload("Permissions").First(&group, groupID).Error
+	return &group, err
+}
+
+func DeleteGroup(groupID uint) error {
+	db := config.GetDB()
+
+	group, err := FindGroupByID(groupID)
+	if err != nil {
+		return errors.New("group not found")
+	}
+
+	// Drop memberships and grants with the group
+	tx := db.Begin()
+	for _, association := range []string{"Members", "Roles", "Permissions"} {
+		if err := tx.Model(group).Association(association).Clear(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Delete(group).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func AddGroupMember(groupID, userID uint) error {
+	db := config.GetDB()
+	group, user, err := findGroupAndUser(groupID, userID)
+	if err != nil {
+		return err
+	}
+	return db.Model(group).Association("Members").Append(user)
+}
+
+func RemoveGroupMember(groupID, userID uint) error {
+	db := config.GetDB()
+	group, user, err := findGroupAndUser(groupID, userID)
+	if err != nil {
+		return err
+	}
+	return db.Model(group).Association("Members").Delete(user)
+}
+
+func GrantGroupRole(groupID, roleID uint) error {
+	db := config.GetDB()
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return errors.New("group not found")
+	}
+	var role models.Role
+	if err := db.First(&role, roleID).Error; err != nil {
+		return errors.New("role not found")
+	}
+	return db.Model(&group).Association("Roles").Append(&role)
+}
+
+func RevokeGroupRole(groupID, roleID uint) error {
+	db := config.GetDB()
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return errors.New("group not found")
+	}
+	var role models.Role
+	if err := db.First(&role, roleID).Error; err != nil {
+		return errors.New("role not found")
+	}
+	return db.Model(&group).Association("Roles").Delete(&role)
+}
+
+func GrantGroupPermission(groupID, permissionID uint) error {
+	db := config.GetDB()
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return errors.New("group not found")
+	}
+	var permission models.Permission
+	if err := db.First(&permission, permissionID).Error; err != nil {
+		return errors.New("permission not found")
+	}
+	return db.Model(&group).Association("Permissions").Append(&permission)
+}
+
+func RevokeGroupPermission(groupID, permissionID uint) error {
+	db := config.GetDB()
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return errors.New("group not found")
+	}
+	var permission models.Permission
+	if err := db.First(&permission, permissionID).Error; err != nil {
+		return errors.New("permission not found")
+	}
+	return db.Model(&group).Association("Permissions").Delete(&permission)
+}
+
+// EffectivePermissions resolves the union of the permissions granted through the
+// user's own role and through every group the user belongs to
+func EffectivePermissions(userID uint) ([]models.PermissionGrant, error) {
+	db := config.GetDB()
+
+	var user models.User
+	if err := db.Preload("Role.Permissions").First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	var grants []models.PermissionGrant
+	for _, permission := range user.Role.Permissions {
+		grants = append(grants, models.PermissionGrant{Permission: permission.Name, Source: "role", Role: user.Role.Name})
+	}
+
+	// Collect grants from group memberships
+	var groups []models.Group
+	err := db.Preload("Roles.Permissions").Preload("Permissions").
+		Joins("JOIN group_members ON group_members.group_id = groups.id").
+		Where("group_members.user_id = ?", userID).
+		Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		for _, role := range group.Roles {
+			for _, permission := range role.Permissions {
+				grants = append(grants, models.PermissionGrant{Permission: permission.Name, Source: "group_role", Role: role.Name, Group: group.Name})
+			}
+		}
+		for _, permission := range group.Permissions {
+			grants = append(grants, models.PermissionGrant{Permission: permission.Name, Source: "group", Group: group.Name})
+		}
+	}
+
+	sort.SliceStable(grants, func(i, j int) bool { return grants[i].Permission < grants[j].Permission })
+	return grants, nil
+}
+
+// HasPermission reports whether any direct or group grant gives the user the permission
+// UserHasRole reports whether the user holds requiredRole or a higher role,
+// through their own role or a role granted to one of their groups
+func UserHasRole(userID uint, requiredRole string) bool {
+	user, err := FindUserByID(userID)
+	if err != nil {
+		return false
+	}
+	return highestRoleRank(user) >= utils.RoleRank(requiredRole)
+}
+
+func HasPermission(userID uint, permissionName string) bool {
+	grants, err := EffectivePermissions(userID)
+	if err != nil {
+		return false
+	}
+	for _, grant := range grants {
+		if grant.Permission == permissionName {
+			return true
+		}
+	}
+	return false
+}
+
+// WhoHasPermission lists every user holding the permission and the grants that explain why
+func WhoHasPermission(permissionName string) ([]models.PermissionHolder, error) {
+	db := config.GetDB()
+
+	var permission models.Permission
+	if err := db.Where("name = ?", permissionName).First(&permission).Error; err != nil {
+		return nil, errors.New("permission not found")
+	}
+
+	// Roles carrying the permission
+	var roles []models.Role
+	err := db.Joins("JOIN role_permissions ON role_permissions.role_id = roles.id").
+		Where("role_permissions.permission_id = ?", permission.ID).
+		Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+
+	holders := map[uint]*models.PermissionHolder{}
+	addGrant := func(user models.User, grant models.PermissionGrant) {
+		holder, ok := holders[user.ID]
+		if !ok {
+			holder = &models.PermissionHolder{UserID: user.ID, Username: user.Username, Email: user.Email}
+			holders[user.ID] = holder
+		}
+		holder.Grants = append(holder.Grants, grant)
+	}
+
+	for _, role := range roles {
+		// Users holding the role directly
+		var users []models.User
+		if err := db.Where("role_id = ?", role.ID).Find(&users).Error; err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			addGrant(user, models.PermissionGrant{Permission: permission.Name, Source: "role", Role: role.Name})
+		}
+
+		// Members of groups holding the role
+		var groups []models.Group
+		err := db.Preload("Members").
+			Joins("JOIN group_roles ON group_roles.group_id = groups.id").
+			Where("group_roles.role_id = ?", role.ID).
+			Find(&groups).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			for _, user := range group.Members {
+				addGrant(user, models.PermissionGrant{Permission: permission.Name, Source: "group_role", Role: role.Name, Group: group.Name})
+			}
+		}
+	}
+
+	// Members of groups holding the permission directly
+	var groups []models.Group
+	err = db.Preload("Members").
+		Joins("JOIN group_permissions ON group_permissions.group_id = groups.id").
+		Where("group_permissions.permission_id = ?", permission.ID).
+		Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		for _, user := range group.Members {
+			addGrant(user, models.PermissionGrant{Permission: permission.Name, Source: "group", Group: group.Name})
+		}
+	}
+
+	result := make([]models.PermissionHolder, 0, len(holders))
+	for _, holder := range holders {
+		result = append(result, *holder)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UserID < result[j].UserID })
+	return result, nil
+}
+
+func findGroupAndUser(groupID, userID uint) (*models.Group, *models.User, error) {
+	db := config.GetDB()
+
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return nil, nil, errors.New("group not found")
+	}
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, nil, errors.New("user not found")
+	}
+	return &group, &user, nil
+}
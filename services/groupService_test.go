@@ -0,0 +1,138 @@
+package services
+
+import (
+	"testing"
+
+	"hells/models"
+	"hells/testutil"
+
+	"gorm.io/gorm"
+)
+
+func permission(t *testing.T, db *gorm.DB, name string) models.Permission {
+	t.Helper()
+	var permission models.Permission
+	if err := db.Where("name = ?", name).First(&permission).Error; err != nil {
+		t.Fatalf("permission %s: %v", name, err)
+	}
+	return permission
+}
+
+// setupGroupGrants gives editors edit_post directly, moderators the Editor role
+// through a group and authors create_post through a group
+func setupGroupGrants(t *testing.T, db *gorm.DB) (editor, moderator, author, viewer *models.User) {
+	t.Helper()
+	editorRole := testutil.Role(t, db, "Editor")
+	editPost := permission(t, db, "edit_post")
+	if err := db.Model(&editorRole).Association("Permissions").Append(&editPost); err != nil {
+		t.Fatal(err)
+	}
+
+	editor = testutil.CreateUser(t, db, "editor", "Editor")
+	moderator = testutil.CreateUser(t, db, "moderator", "Viewer")
+	author = testutil.CreateUser(t, db, "author", "Viewer")
+	viewer = testutil.CreateUser(t, db, "viewer", "Viewer")
+
+	moderators := models.Group{Name: "moderators"}
+	authors := models.Group{Name: "authors"}
+	for _, group := range []*models.Group{&moderators, &authors} {
+		if err := CreateGroup(group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddGroupMember(moderators.ID, moderator.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := GrantGroupRole(moderators.ID, editorRole.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddGroupMember(authors.ID, author.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := GrantGroupPermission(authors.ID, permission(t, db, "create_post").ID); err != nil {
+		t.Fatal(err)
+	}
+	return editor, moderator, author, viewer
+}
+
+func TestEffectivePermissions(t *testing.T) {
+	db := testutil.NewDB(t)
+	editor, moderator, author, viewer := setupGroupGrants(t, db)
+
+	tests := []struct {
+		user *models.User
+		want []models.PermissionGrant
+	}{
+		{editor, []models.PermissionGrant{{Permission: "edit_post", Source: "role", Role: "Editor"}}},
+		{moderator, []models.PermissionGrant{{Permission: "edit_post", Source: "group_role", Role: "Editor", Group: "moderators"}}},
+		{author, []models.PermissionGrant{{Permission: "create_post", Source: "group", Group: "authors"}}},
+		{viewer, nil},
+	}
+	for _, tt := range tests {
+		grants, err := EffectivePermissions(tt.user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(grants) != len(tt.want) || (len(grants) > 0 && grants[0] != tt.want[0]) {
+			t.Errorf("%s: grants = %+v, want %+v", tt.user.Username, grants, tt.want)
+		}
+	}
+
+	if _, err := EffectivePermissions(9999); err == nil {
+		t.Error("permissions of an unknown user")
+	}
+}
+
+func TestHasPermissionAndRole(t *testing.T) {
+	db := testutil.NewDB(t)
+	editor, moderator, author, viewer := setupGroupGrants(t, db)
+
+	tests := []struct {
+		user       *models.User
+		permission string
+		has        bool
+	}{
+		{editor, "edit_post", true},
+		{moderator, "edit_post", true},
+		{author, "create_post", true},
+		{author, "edit_post", false},
+		{viewer, "edit_post", false},
+		{editor, "delete_post", false},
+	}
+	for _, tt := range tests {
+		if got := HasPermission(tt.user.ID, tt.permission); got != tt.has {
+			t.Errorf("HasPermission(%s, %s) = %v, want %v", tt.user.Username, tt.permission, got, tt.has)
+		}
+	}
+
+	// Roles granted to a group count like the user's own role
+	if !UserHasRole(moderator.ID, "Editor") || UserHasRole(moderator.ID, "Admin") {
+		t.Error("moderator should rank as Editor through their group")
+	}
+	if UserHasRole(author.ID, "Editor") || !UserHasRole(author.ID, "Viewer") {
+		t.Error("author should rank as Viewer")
+	}
+}
+
+func TestWhoHasPermission(t *testing.T) {
+	db := testutil.NewDB(t)
+	editor, moderator, _, _ := setupGroupGrants(t, db)
+
+	holders, err := WhoHasPermission("edit_post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := map[uint]string{}
+	for _, holder := range holders {
+		for _, grant := range holder.Grants {
+			sources[holder.UserID] += grant.Source
+		}
+	}
+	if len(sources) != 2 || sources[editor.ID] != "role" || sources[moderator.ID] != "group_role" {
+		t.Errorf("holders = %+v", holders)
+	}
+
+	if _, err := WhoHasPermission("no_such_permission"); err == nil {
+		t.Error("holders of an unknown permission")
+	}
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+)
+
+const defaultImpersonationTTL = 15 * time.Minute
+
+// ErrImpersonationNotAllowed is returned when the subject's role is not below the actor's
+var ErrImpersonationNotAllowed = errors.New("cannot impersonate a user with an equal or higher role")
+
+// StartImpersonation issues a short-lived token for the subject that records the
+// admin as the real actor. Like any other token it belongs to a session, so the
+// subject's sessions list shows it and revoking the session ends it.
+func StartImpersonation(actorID, subjectID uint, reason, userAgent, ipAddress string) (string, *models.ImpersonationSession, error) {
+	if actorID == subjectID {
+		return "", nil, errors.New("cannot impersonate yourself")
+	}
+
+	subject, err := FindUserByID(subjectID)
+	if err != nil {
+		return "", nil, errors.New("user not found")
+	}
+	actor, err := FindUserByID(actorID)
+	if err != nil {
+		return "", nil, errors.New("user not found")
+	}
+
+	// Admins may only act as users below them, counting roles granted through groups
+	if highestRoleRank(subject) >= highestRoleRank(actor) {
+		return "", nil, ErrImpersonationNotAllowed
+	}
+
+	tokenID, err := utils.GenerateNonce()
+	if err != nil {
+		return "", nil, err
+	}
+
+	ttl := impersonationTTL()
+	userSession, err := CreateSession(subject.ID, userAgent, ipAddress, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims := &utils.Claims{
+		UserID:    strconv.FormatUint(uint64(subject.ID), 10),
+		Role:      subject.Role.Name,
+		Act:       &utils.Actor{UserID: strconv.FormatUint(uint64(actorID), 10)},
+		SessionID: strconv.FormatUint(uint64(userSession.ID), 10),
+	}
+	claims.Id = tokenID
+	token, err := utils.SignClaims(claims, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	session := models.ImpersonationSession{
+		TokenID:   tokenID,
+		ActorID:   actorID,
+		SubjectID: subject.ID,
+		SessionID: userSession.ID,
+		Reason:    reason,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}
+	db := config.GetDB()
+	if err := db.Create(&session).Error; err != nil {
+		return "", nil, err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "impersonation.start",
+		ActorID:   actorID,
+		SubjectID: subject.ID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("token_id=%s reason=%q", tokenID, reason),
+	})
+
+	return token, &session, nil
+}
+
+// EndImpersonation invalidates the impersonation token before it expires
+func EndImpersonation(tokenID, ipAddress string) error {
+	db := config.GetDB()
+
+	var session models.ImpersonationSession
+	if err := db.Where("token_id = ? AND ended_at IS NULL", tokenID).First(&session).Error; err != nil {
+		return errors.New("impersonation session not found")
+	}
+
+	now := time.Now()
+	session.EndedAt = &now
+	if err := db.Save(&session).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.Session{}).Where("id = ? AND revoked_at IS NULL", session.SessionID).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "impersonation.end",
+		ActorID:   session.ActorID,
+		SubjectID: session.SubjectID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("token_id=%s", tokenID),
+	})
+	return nil
+}
+
+// IsImpersonationActive reports whether the impersonation token has not been ended
+func IsImpersonationActive(tokenID string) bool {
+	db := config.GetDB()
+	var session models.ImpersonationSession
+	err := db.Where("token_id = ? AND ended_at IS NULL AND expires_at > ?", tokenID, time.Now()).First(&session).Error
+	return err == nil
+}
+
+// highestRoleRank is the rank of the user's own role or of any role granted to
+// one of their groups, whichever is higher
+func highestRoleRank(user *models.User) int {
+	rank := utils.RoleRank(user.Role.Name)
+
+	db := config.GetDB()
+	var roleNames []string
+	db.Table("roles").
+		Joins("JOIN group_roles ON group_roles.role_id = roles.id").
+		Joins("JOIN group_members ON group_members.group_id = group_roles.group_id").
+		Where("group_members.user_id = ? AND roles.deleted_at IS NULL", user.ID).
+		Pluck("roles.name", &roleNames)
+	for _, name := range roleNames {
+		if r := utils.RoleRank(name); r > rank {
+			rank = r
+		}
+	}
+	return rank
+}
+
+// RecordImpersonatedRequest adds a request made with an impersonation token to
+// the audit log, with the admin as actor and the impersonated user as subject
+func RecordImpersonatedRequest(actorID, subjectID uint, tokenID, method, path, ipAddress string) {
+	RecordAudit(models.AuditLog{
+		Action:    "impersonation.request",
+		ActorID:   actorID,
+		SubjectID: subjectID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("token_id=%s %s %s", tokenID, method, path),
+	})
+}
+
+func impersonationTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("IMPERSONATION_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultImpersonationTTL
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+)
+
+func TestStartImpersonationRequiresLowerRole(t *testing.T) {
+	db := testutil.NewDB(t)
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	otherAdmin := testutil.CreateUser(t, db, "admin2", "Admin")
+	editor := testutil.CreateUser(t, db, "editor", "Editor")
+	viewer := testutil.CreateUser(t, db, "viewer", "Viewer")
+
+	// An Editor who is made Admin through a group
+	group := models.Group{Name: "ops"}
+	db.Create(&group)
+	db.Model(&group).Association("Members").Append(editor)
+	db.Model(&group).Association("Roles").Append(&models.Role{Model: testutil.Role(t, db, "Admin").Model})
+
+	tests := []struct {
+		name    string
+		actor   *models.User
+		subject *models.User
+		allowed bool
+	}{
+		{"admin as viewer", admin, viewer, true},
+		{"admin as admin", admin, otherAdmin, false},
+		{"admin as group admin", admin, editor, false},
+		{"viewer as viewer", viewer, viewer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := StartImpersonation(tt.actor.ID, tt.subject.ID, "support", "test", "127.0.0.1")
+			if !tt.allowed {
+				if err == nil {
+					t.Fatal("impersonation allowed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StartImpersonation: %v", err)
+			}
+			claims, err := utils.ValidateJWT(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !claims.IsImpersonation() || claims.Act.UserID != "1" || claims.Role != "Viewer" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+
+	if _, _, err := StartImpersonation(admin.ID, otherAdmin.ID, "", "", ""); !errors.Is(err, ErrImpersonationNotAllowed) {
+		t.Errorf("err = %v, want ErrImpersonationNotAllowed", err)
+	}
+}
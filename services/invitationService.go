@@ -0,0 +1,286 @@
+package services
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+
+	"gorm.io/gorm"
+)
+
+const defaultInvitationTTL = 72 * time.Hour
+
+// ErrInvitationEmailFailed is returned when an invitation was saved but its email could not be sent
+var ErrInvitationEmailFailed = errors.New("invitation email delivery failed")
+
+// ErrUnverifiedEmail is returned when an account's email was never proven to
+// belong to its owner, so it cannot claim invitations sent to that address
+var ErrUnverifiedEmail = errors.New("the email of this account is not verified; accept the invitation with an account you signed up for yourself")
+
+func CreateOrganization(org *models.Organization) error {
+	db := config.GetDB()
+
+	var existing models.Organization
+	if err := db.Where("name = ?", org.Name).First(&existing).Error; err == nil {
+		return errors.New("organization already exists")
+	}
+
+	return db.Create(org).Error
+}
+
+func FindOrganizationByID(orgID uint) (*models.Organization, error) {
+	db := config.GetDB()
+	var org models.Organization
+	err := db.First(&org, orgID).Error
+	return &org, err
+}
+
+// IsOrganizationAdmin reports whether the user holds the Admin role in the organization
+func IsOrganizationAdmin(orgID, userID uint) bool {
+	db := config.GetDB()
+	var member models.OrganizationMember
+	err := db.Joins("JOIN roles ON roles.id = organization_members.role_id").
+		Where("organization_members.organization_id = ? AND organization_members.user_id = ? AND roles.name = ?", orgID, userID, "Admin").
+		First(&member).Error
+	return err == nil
+}
+
+func CreateInvitation(orgID, roleID, invitedByID uint, email string) (*models.Invitation, error) {
+	db := config.GetDB()
+	email = normalizeEmail(email)
+
+	org, err := FindOrganizationByID(orgID)
+	if err != nil {
+		return nil, errors.New("organization not found")
+	}
+
+	var role models.Role
+	if err := db.First(&role, roleID).Error; err != nil {
+		return nil, errors.New("role not found")
+	}
+
+	// Refuse to invite existing members
+	var member models.OrganizationMember
+	err = db.Joins("JOIN users ON users.id = organization_members.user_id").
+		Where("organization_members.organization_id = ? AND users.email = ?", orgID, email).
+		First(&member).Error
+	if err == nil {
+		return nil, errors.New("user is already a member of this organization")
+	}
+
+	// Refuse duplicate pending invitations
+	var pending models.Invitation
+	err = db.Where("organization_id = ? AND email = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?",
+		orgID, email, time.Now()).First(&pending).Error
+	if err == nil {
+		return nil, errors.New("a pending invitation already exists for this email")
+	}
+
+	nonce, err := utils.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := models.Invitation{
+		OrganizationID: orgID,
+		Email:          email,
+		RoleID:         role.ID,
+		Role:           role,
+		InvitedByID:    invitedByID,
+		Nonce:          nonce,
+		ExpiresAt:      time.Now().Add(invitationTTL()),
+	}
+	if err := db.Create(&invitation).Error; err != nil {
+		return nil, err
+	}
+
+	if err := sendInvitationEmail(&invitation, org); err != nil {
+		return &invitation, ErrInvitationEmailFailed
+	}
+	return &invitation, nil
+}
+
+func ListInvitations(orgID uint) ([]models.Invitation, error) {
+	db := config.GetDB()
+	var invitations []models.Invitation
+	err := db.Preload("Role").
+		Where("organization_id = ?", orgID).
+		Order("created_at desc").
+		Find(&invitations).Error
+	return invitations, err
+}
+
+// ResendInvitation issues a fresh token and expiry, invalidating any previously sent link
+func ResendInvitation(orgID, invitationID uint) (*models.Invitation, error) {
+	db := config.GetDB()
+
+	var invitation models.Invitation
+	if err := db.Preload("Organization").Preload("Role").
+		Where("organization_id = ?", orgID).
+		First(&invitation, invitationID).Error; err != nil {
+		return nil, errors.New("invitation not found")
+	}
+
+	if invitation.AcceptedAt != nil || invitation.RevokedAt != nil {
+		return nil, errors.New("invitation is no longer pending")
+	}
+
+	nonce, err := utils.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+	invitation.Nonce = nonce
+	invitation.ExpiresAt = time.Now().Add(invitationTTL())
+	if err := db.Save(&invitation).Error; err != nil {
+		return nil, err
+	}
+
+	if err := sendInvitationEmail(&invitation, &invitation.Organization); err != nil {
+		return &invitation, ErrInvitationEmailFailed
+	}
+	return &invitation, nil
+}
+
+func RevokeInvitation(orgID, invitationID uint) error {
+	db := config.GetDB()
+
+	var invitation models.Invitation
+	if err := db.Where("organization_id = ?", orgID).First(&invitation, invitationID).Error; err != nil {
+		return errors.New("invitation not found")
+	}
+
+	if invitation.AcceptedAt != nil {
+		return errors.New("invitation has already been accepted")
+	}
+
+	now := time.Now()
+	invitation.RevokedAt = &now
+	return db.Save(&invitation).Error
+}
+
+// ErrInvitationUnavailable is returned when an invitation was accepted,
+// revoked or expired before it could be claimed
+var ErrInvitationUnavailable = errors.New("invalid or expired invitation token")
+
+// FindInvitationByToken verifies an invitation token and returns the pending invitation
+func FindInvitationByToken(token string) (*models.Invitation, error) {
+	return findInvitationByToken(config.GetDB(), token)
+}
+
+func findInvitationByToken(db *gorm.DB, token string) (*models.Invitation, error) {
+	value, err := utils.VerifySignedValue(token)
+	if err != nil {
+		return nil, errors.New("invalid invitation token")
+	}
+
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] != "invite" {
+		return nil, errors.New("invalid invitation token")
+	}
+	invitationID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid invitation token")
+	}
+
+	var invitation models.Invitation
+	if err := db.Preload("Role").First(&invitation, uint(invitationID)).Error; err != nil {
+		return nil, errors.New("invalid invitation token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(invitation.Nonce), []byte(parts[2])) != 1 || !invitation.IsPending() {
+		return nil, ErrInvitationUnavailable
+	}
+
+	return &invitation, nil
+}
+
+// RegisterUser creates the account and, with an invitation token, joins the
+// inviting organization in the same transaction, so a failed invitation leaves
+// no account behind
+func RegisterUser(user *models.User, invitationToken string) error {
+	db := config.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := createUser(tx, user); err != nil {
+			return err
+		}
+		if invitationToken == "" {
+			return nil
+		}
+		return acceptInvitation(tx, invitationToken, user)
+	})
+}
+
+// AcceptInvitation adds the user to the invited organization and consumes the token
+func AcceptInvitation(token string, user *models.User) error {
+	db := config.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		return acceptInvitation(tx, token, user)
+	})
+}
+
+func acceptInvitation(tx *gorm.DB, token string, user *models.User) error {
+	invitation, err := findInvitationByToken(tx, token)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(invitation.Email, user.Email) {
+		return errors.New("invitation was sent to a different email address")
+	}
+	// A SAML account's email is whatever its identity provider asserted, which
+	// proves nothing about who owns the address
+	if user.AuthSource == "saml" {
+		return ErrUnverifiedEmail
+	}
+
+	// Claim the invitation first so concurrent requests cannot both use it
+	now := time.Now()
+	result := tx.Model(&models.Invitation{}).
+		Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", invitation.ID, now).
+		Update("accepted_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrInvitationUnavailable
+	}
+
+	// Add or update membership
+	var member models.OrganizationMember
+	err = tx.Where("organization_id = ? AND user_id = ?", invitation.OrganizationID, user.ID).First(&member).Error
+	if err != nil {
+		member = models.OrganizationMember{
+			OrganizationID: invitation.OrganizationID,
+			UserID:         user.ID,
+		}
+	}
+	member.RoleID = invitation.RoleID
+	return tx.Save(&member).Error
+}
+
+func invitationToken(invitation *models.Invitation) string {
+	return utils.SignValue(fmt.Sprintf("invite:%d:%s", invitation.ID, invitation.Nonce))
+}
+
+func invitationTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("INVITATION_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultInvitationTTL
+}
+
+func sendInvitationEmail(invitation *models.Invitation, org *models.Organization) error {
+	link := utils.FrontendURL("/invitations/accept?token=" + url.QueryEscape(invitationToken(invitation)))
+	body := fmt.Sprintf("You have been invited to join %s as %s.\n\nAccept the invitation: %s\n\nThis link expires on %s.",
+		org.Name, invitation.Role.Name, link, invitation.ExpiresAt.Format(time.RFC1123))
+	return utils.SendEmail(invitation.Email, "You're invited to join "+org.Name, body)
+}
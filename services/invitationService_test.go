@@ -0,0 +1,139 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+
+	"gorm.io/gorm"
+)
+
+func createTestInvitation(t *testing.T, db *gorm.DB, email string) *models.Invitation {
+	t.Helper()
+	org := models.Organization{Name: "Acme"}
+	if err := db.Create(&org).Error; err != nil {
+		t.Fatal(err)
+	}
+	invitation := models.Invitation{
+		OrganizationID: org.ID,
+		Email:          email,
+		RoleID:         testutil.Role(t, db, "Editor").ID,
+		Nonce:          "nonce",
+		ExpiresAt:      time.Now().Add(time.Hour),
+	}
+	if err := db.Create(&invitation).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &invitation
+}
+
+func countUsers(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+	var count int64
+	db.Model(&models.User{}).Count(&count)
+	return count
+}
+
+func TestRegisterUserWithInvitation(t *testing.T) {
+	db := testutil.NewDB(t)
+	invitation := createTestInvitation(t, db, "new@example.com")
+
+	user := models.User{Username: "new", Email: "new@example.com", IsActive: true}
+	if err := RegisterUser(&user, invitationToken(invitation)); err != nil {
+		t.Fatalf("RegisterUser: %v", err)
+	}
+
+	var member models.OrganizationMember
+	if err := db.Where("organization_id = ? AND user_id = ?", invitation.OrganizationID, user.ID).First(&member).Error; err != nil {
+		t.Fatalf("membership not created: %v", err)
+	}
+	if member.RoleID != invitation.RoleID {
+		t.Errorf("member role = %d, want %d", member.RoleID, invitation.RoleID)
+	}
+	db.First(invitation, invitation.ID)
+	if invitation.AcceptedAt == nil {
+		t.Error("invitation not marked accepted")
+	}
+}
+
+func TestRegisterUserInvitationFailureLeavesNoAccount(t *testing.T) {
+	db := testutil.NewDB(t)
+	invitation := createTestInvitation(t, db, "invited@example.com")
+
+	user := models.User{Username: "other", Email: "other@example.com", IsActive: true}
+	if err := RegisterUser(&user, invitationToken(invitation)); err == nil {
+		t.Fatal("expected an error for an invitation sent to another address")
+	}
+	if n := countUsers(t, db); n != 0 {
+		t.Errorf("%d users left behind, want 0", n)
+	}
+}
+
+func TestInvitationCanOnlyBeUsedOnce(t *testing.T) {
+	db := testutil.NewDB(t)
+	invitation := createTestInvitation(t, db, "new@example.com")
+	token := invitationToken(invitation)
+
+	first := models.User{Username: "first", Email: "new@example.com", IsActive: true}
+	if err := RegisterUser(&first, token); err != nil {
+		t.Fatal(err)
+	}
+	// Another account with the same address, e.g. after the first was renamed
+	db.Model(&first).Update("email", "renamed@example.com")
+
+	second := models.User{Username: "second", Email: "new@example.com", IsActive: true}
+	if err := RegisterUser(&second, token); !errors.Is(err, ErrInvitationUnavailable) {
+		t.Fatalf("second use: err = %v, want ErrInvitationUnavailable", err)
+	}
+	if n := countUsers(t, db); n != 1 {
+		t.Errorf("%d users, want 1", n)
+	}
+}
+
+func TestInvitationTokenRequiresPurpose(t *testing.T) {
+	db := testutil.NewDB(t)
+	invitation := createTestInvitation(t, db, "new@example.com")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"no purpose", utils.SignValue(fmt.Sprintf("%d:%s", invitation.ID, invitation.Nonce))},
+		{"other purpose", utils.SignValue(fmt.Sprintf("restore:%d:%s", invitation.ID, invitation.Nonce))},
+		{"wrong nonce", utils.SignValue(fmt.Sprintf("invite:%d:%s", invitation.ID, "other"))},
+		{"unsigned", "invite:1:nonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := FindInvitationByToken(tt.token); err == nil {
+				t.Error("token accepted")
+			}
+		})
+	}
+	if _, err := FindInvitationByToken(invitationToken(invitation)); err != nil {
+		t.Errorf("valid token rejected: %v", err)
+	}
+}
+
+func TestAcceptInvitationRequiresVerifiedEmail(t *testing.T) {
+	db := testutil.NewDB(t)
+	invitation := createTestInvitation(t, db, "ceo@example.com")
+
+	// The identity provider of another organization asserted the address
+	user := testutil.CreateUser(t, db, "ceo", "Viewer")
+	db.Model(&models.User{}).Where("id = ?", user.ID).Update("auth_source", "saml")
+	user, _ = FindUserByID(user.ID)
+
+	if err := AcceptInvitation(invitationToken(invitation), user); !errors.Is(err, ErrUnverifiedEmail) {
+		t.Errorf("err = %v, want ErrUnverifiedEmail", err)
+	}
+	db.First(invitation, invitation.ID)
+	if invitation.AcceptedAt != nil {
+		t.Error("invitation was consumed")
+	}
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"hells/config"
+	"hells/models"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const defaultLDAPUserFilter = "(&(objectClass=person)(|(uid={login})(mail={login})))"
+
+// LDAPConn is the part of an LDAP connection the backend uses, so tests can
+// stand in for a directory server. *ldap.Conn implements it.
+type LDAPConn interface {
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPGroupRole maps members of a directory group to a role
+type LDAPGroupRole struct {
+	GroupDN string
+	Role    string
+}
+
+type LDAPConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	// BindDN and BindPassword are the service account used to look users up;
+	// the search is anonymous when BindDN is empty
+	BindDN       string
+	BindPassword string
+	SearchBase   string
+	// UserFilter finds the user's entry; {login} is replaced with the escaped login
+	UserFilter        string
+	UsernameAttribute string
+	EmailAttribute    string
+	NameAttribute     string
+	GroupAttribute    string
+	// GroupRoles are checked in order and the first group the user belongs to
+	// sets their role. Users in none of them get DefaultRole.
+	GroupRoles  []LDAPGroupRole
+	DefaultRole string
+}
+
+// LDAPAuthBackend authenticates against a directory by searching for the user's
+// entry and binding as it with their password. Users are created locally on
+// their first login and their name and role are refreshed on every login.
+type LDAPAuthBackend struct {
+	Config LDAPConfig
+	// Dial opens a connection to the directory
+	Dial func(LDAPConfig) (LDAPConn, error)
+}
+
+// NewLDAPAuthBackend configures the backend from the LDAP_* environment variables
+func NewLDAPAuthBackend() *LDAPAuthBackend {
+	cfg := LDAPConfig{
+		URL:                os.Getenv("LDAP_URL"),
+		StartTLS:           os.Getenv("LDAP_START_TLS") == "true",
+		InsecureSkipVerify: os.Getenv("LDAP_INSECURE_SKIP_VERIFY") == "true",
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		SearchBase:         os.Getenv("LDAP_SEARCH_BASE"),
+		UserFilter:         envOrDefault("LDAP_USER_FILTER", defaultLDAPUserFilter),
+		UsernameAttribute:  envOrDefault("LDAP_USERNAME_ATTRIBUTE", "uid"),
+		EmailAttribute:     envOrDefault("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		NameAttribute:      envOrDefault("LDAP_NAME_ATTRIBUTE", "cn"),
+		GroupAttribute:     envOrDefault("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		GroupRoles:         parseLDAPGroupRoles(os.Getenv("LDAP_GROUP_ROLES")),
+		DefaultRole:        envOrDefault("LDAP_DEFAULT_ROLE", defaultRoleName),
+	}
+	return &LDAPAuthBackend{Config: cfg, Dial: dialLDAP}
+}
+
+func (b *LDAPAuthBackend) Name() string {
+	return "ldap"
+}
+
+func (b *LDAPAuthBackend) Authenticate(login, password string) (*models.User, error) {
+	// An empty password is an unauthenticated bind, which many servers accept
+	if strings.TrimSpace(login) == "" || password == "" {
+		return nil, ErrUnknownLogin
+	}
+
+	conn, err := b.Dial(b.Config)
+	if err != nil {
+		return nil, fmt.Errorf("ldap connect: %v", err)
+	}
+	defer conn.Close()
+
+	if b.Config.BindDN != "" {
+		if err := conn.Bind(b.Config.BindDN, b.Config.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap service bind: %v", err)
+		}
+	}
+
+	entry, err := b.findEntry(conn, login)
+	if err != nil {
+		return nil, err
+	}
+
+	email := normalizeEmail(entry.GetAttributeValue(b.Config.EmailAttribute))
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			user, err := FindUserByEmail(email)
+			if err != nil {
+				return nil, ErrInvalidCredentials
+			}
+			// Leave accounts of other backends to them, as provisionUser does
+			if user.AuthSource != b.Name() {
+				return nil, ErrUnknownLogin
+			}
+			return user, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap bind: %v", err)
+	}
+
+	return b.provisionUser(entry, email)
+}
+
+// findEntry looks up the single directory entry matching the login
+func (b *LDAPAuthBackend) findEntry(conn LDAPConn, login string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(b.Config.UserFilter, "{login}", ldap.EscapeFilter(login))
+	request := ldap.NewSearchRequest(
+		b.Config.SearchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter,
+		[]string{b.Config.UsernameAttribute, b.Config.EmailAttribute, b.Config.NameAttribute, b.Config.GroupAttribute},
+		nil,
+	)
+
+	result, err := conn.Search(request)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("ldap search: %v", err)
+	}
+	if result == nil || len(result.Entries) == 0 {
+		return nil, ErrUnknownLogin
+	}
+	// A login matching several people cannot be trusted to pick the right one
+	if len(result.Entries) > 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+// provisionUser creates or updates the local user for a directory entry
+func (b *LDAPAuthBackend) provisionUser(entry *ldap.Entry, email string) (*models.User, error) {
+	if email == "" {
+		return nil, fmt.Errorf("ldap entry %s has no %s attribute", entry.DN, b.Config.EmailAttribute)
+	}
+
+	db := config.GetDB()
+	var role models.Role
+	roleName := b.roleFor(entry.GetAttributeValues(b.Config.GroupAttribute))
+	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return nil, fmt.Errorf("role %q not found", roleName)
+	}
+
+	name := entry.GetAttributeValue(b.Config.NameAttribute)
+	user, err := FindUserByEmail(email)
+	if err != nil {
+		username, err := availableUsername(entry.GetAttributeValue(b.Config.UsernameAttribute))
+		if err != nil {
+			log.Printf("LDAP entry %s has no usable %s: %v", entry.DN, b.Config.UsernameAttribute, err)
+			return nil, ErrUnknownLogin
+		}
+		user = &models.User{
+			Username:   username,
+			Name:       name,
+			Email:      email,
+			AuthSource: b.Name(),
+			RoleID:     role.ID,
+			IsActive:   true,
+		}
+		// A deleted account still holds its email until it is purged. Like
+		// any other conflict, it is not the directory's to resolve.
+		err = CreateUser(user)
+		if errors.Is(err, ErrUsernameExists) || errors.Is(err, ErrEmailExists) {
+			log.Printf("LDAP entry %s conflicts with an existing account: %v", entry.DN, err)
+			return nil, ErrUnknownLogin
+		}
+		if err != nil {
+			return nil, err
+		}
+		RecordAudit(models.AuditLog{
+			Action:    "ldap.user_create",
+			SubjectID: user.ID,
+			Details:   "dn=" + entry.DN,
+		})
+		return FindUserByID(user.ID)
+	}
+
+	// A directory entry with the same email must not take over a local, SAML
+	// or SCIM account; the other backends still sign its owner in
+	if user.AuthSource != b.Name() {
+		log.Printf("LDAP entry %s matches the %s account %d; not linking it", entry.DN, authSource(user), user.ID)
+		RecordAudit(models.AuditLog{
+			Action:    "ldap.link_refused",
+			SubjectID: user.ID,
+			Details:   "dn=" + entry.DN + " auth_source=" + authSource(user),
+		})
+		return nil, ErrUnknownLogin
+	}
+
+	// The directory is the source of truth for the accounts it created
+	if user.Name != name {
+		if err := db.Model(&models.User{}).Where("id = ?", user.ID).Update("name", name).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := setUserRole(user, role.ID, ""); err != nil {
+		return nil, err
+	}
+	return FindUserByID(user.ID)
+}
+
+// roleFor returns the role of the first configured group in groupDNs
+func (b *LDAPAuthBackend) roleFor(groupDNs []string) string {
+	for _, mapping := range b.Config.GroupRoles {
+		want, err := ldap.ParseDN(mapping.GroupDN)
+		if err != nil {
+			continue
+		}
+		for _, groupDN := range groupDNs {
+			if have, err := ldap.ParseDN(groupDN); err == nil && want.EqualFold(have) {
+				return mapping.Role
+			}
+		}
+	}
+	return b.Config.DefaultRole
+}
+
+func dialLDAP(cfg LDAPConfig) (LDAPConn, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("LDAP_URL is not set")
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if u, err := url.Parse(cfg.URL); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// parseLDAPGroupRoles reads "<group DN>:<role>" pairs separated by semicolons
+func parseLDAPGroupRoles(value string) []LDAPGroupRole {
+	var mappings []LDAPGroupRole
+	for _, pair := range strings.Split(value, ";") {
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			continue
+		}
+		mappings = append(mappings, LDAPGroupRole{
+			GroupDN: strings.TrimSpace(pair[:i]),
+			Role:    strings.TrimSpace(pair[i+1:]),
+		})
+	}
+	return mappings
+}
+
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAPConn is a directory holding entries and their passwords
+type fakeLDAPConn struct {
+	entries   []*ldap.Entry
+	passwords map[string]string
+}
+
+func (c *fakeLDAPConn) Bind(username, password string) error {
+	if want, ok := c.passwords[username]; ok && want == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+// Search returns every entry whose uid or mail is in the filter
+func (c *fakeLDAPConn) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+	for _, entry := range c.entries {
+		uid, mail := entry.GetAttributeValue("uid"), entry.GetAttributeValue("mail")
+		if request.Filter == "(&(objectClass=person)(|(uid="+uid+")(mail="+uid+")))" ||
+			request.Filter == "(&(objectClass=person)(|(uid="+mail+")(mail="+mail+")))" {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result, nil
+}
+
+func (c *fakeLDAPConn) Close() error {
+	return nil
+}
+
+func newTestLDAPBackend(entries ...*ldap.Entry) *LDAPAuthBackend {
+	conn := &fakeLDAPConn{entries: entries, passwords: map[string]string{}}
+	for _, entry := range entries {
+		conn.passwords[entry.DN] = "directory password"
+	}
+	return &LDAPAuthBackend{
+		Config: LDAPConfig{
+			UserFilter:        defaultLDAPUserFilter,
+			UsernameAttribute: "uid",
+			EmailAttribute:    "mail",
+			NameAttribute:     "cn",
+			GroupAttribute:    "memberOf",
+			GroupRoles:        []LDAPGroupRole{{GroupDN: "cn=editors,dc=example,dc=com", Role: "Editor"}},
+			DefaultRole:       "Viewer",
+		},
+		Dial: func(LDAPConfig) (LDAPConn, error) { return conn, nil },
+	}
+}
+
+func ldapEntry(uid string, groups ...string) *ldap.Entry {
+	return ldap.NewEntry("uid="+uid+",ou=people,dc=example,dc=com", map[string][]string{
+		"uid":      {uid},
+		"mail":     {uid + "@example.com"},
+		"cn":       {"Directory " + uid},
+		"memberOf": groups,
+	})
+}
+
+func TestLDAPAuthenticateProvisionsUsers(t *testing.T) {
+	testutil.NewDB(t)
+	backend := newTestLDAPBackend(ldapEntry("dana", "CN=Editors,DC=example,DC=com"))
+
+	user, err := backend.Authenticate("dana", "directory password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.AuthSource != "ldap" || user.Email != "dana@example.com" || user.Role.Name != "Editor" || user.Name != "Directory dana" {
+		t.Errorf("user = %+v", user)
+	}
+
+	// Later logins update the same account
+	again, err := backend.Authenticate("dana@example.com", "directory password")
+	if err != nil || again.ID != user.ID {
+		t.Errorf("second login = %+v, %v", again, err)
+	}
+
+	user, err = backend.Authenticate("dana", "wrong")
+	if !errors.Is(err, ErrInvalidCredentials) || user == nil || user.ID != again.ID {
+		t.Errorf("wrong password = %+v, %v", user, err)
+	}
+	if _, err := backend.Authenticate("nobody", "directory password"); !errors.Is(err, ErrUnknownLogin) {
+		t.Errorf("unknown login: err = %v", err)
+	}
+	if _, err := backend.Authenticate("dana", ""); !errors.Is(err, ErrUnknownLogin) {
+		t.Errorf("empty password: err = %v", err)
+	}
+}
+
+func TestLDAPAuthenticateDoesNotTakeOverOtherAccounts(t *testing.T) {
+	db := testutil.NewDB(t)
+	local := testutil.CreateUser(t, db, "admin", "Admin")
+	saml := testutil.CreateUser(t, db, "federated", "Viewer")
+	db.Model(saml).Update("auth_source", "saml")
+	backend := newTestLDAPBackend(ldapEntry("admin"), ldapEntry("federated"))
+
+	for _, user := range []*models.User{local, saml} {
+		if _, err := backend.Authenticate(user.Username, "directory password"); !errors.Is(err, ErrUnknownLogin) {
+			t.Errorf("%s: err = %v, want ErrUnknownLogin", user.Username, err)
+		}
+		// A wrong directory password is left to the account's own backend too
+		if _, err := backend.Authenticate(user.Username, "wrong"); !errors.Is(err, ErrUnknownLogin) {
+			t.Errorf("%s wrong password: err = %v, want ErrUnknownLogin", user.Username, err)
+		}
+
+		reloaded, _ := FindUserByID(user.ID)
+		if reloaded.AuthSource != user.AuthSource || reloaded.RoleID != user.RoleID || reloaded.Name != user.Name {
+			t.Errorf("%s changed: %+v", user.Username, reloaded)
+		}
+	}
+
+	var refused int64
+	db.Model(&models.AuditLog{}).Where("action = ?", "ldap.link_refused").Count(&refused)
+	if refused != 2 {
+		t.Errorf("ldap.link_refused audits = %d, want 2", refused)
+	}
+}
+
+func TestLDAPProvisioningCollisions(t *testing.T) {
+	db := testutil.NewDB(t)
+	erin := testutil.CreateUser(t, db, "erin", "Viewer")
+	db.Model(&models.User{}).Where("id = ?", erin.ID).Update("email", "erin@other.example.com")
+	frank := testutil.CreateUser(t, db, "frank", "Viewer")
+	db.Model(&models.User{}).Where("id = ?", frank.ID).Updates(map[string]interface{}{"username": "frank-old", "deleted_at": time.Now()})
+	backend := newTestLDAPBackend(ldapEntry("erin"), ldapEntry("frank"), ldapEntry("zz"))
+
+	// Someone else's username gets a suffix rather than failing the sign-in
+	user, err := backend.Authenticate("erin", "directory password")
+	if err != nil || user.Username != "erin-2" || user.ID == erin.ID {
+		t.Errorf("erin = %+v, %v", user, err)
+	}
+
+	// A deleted account still holds the email, and uid zz is too short to be a username
+	for _, login := range []string{"frank", "zz"} {
+		if _, err := backend.Authenticate(login, "directory password"); !errors.Is(err, ErrUnknownLogin) {
+			t.Errorf("%s: err = %v, want ErrUnknownLogin", login, err)
+		}
+	}
+	var users int64
+	db.Model(&models.User{}).Where("email = ?", "zz@example.com").Count(&users)
+	if users != 0 {
+		t.Error("user created with an invalid username")
+	}
+}
+
+func TestLDAPRoleFor(t *testing.T) {
+	backend := newTestLDAPBackend()
+	backend.Config.GroupRoles = parseLDAPGroupRoles("cn=admins,dc=example,dc=com:Admin; cn=editors,dc=example,dc=com:Editor")
+
+	tests := []struct {
+		groups []string
+		want   string
+	}{
+		{nil, "Viewer"},
+		{[]string{"cn=editors,dc=example,dc=com"}, "Editor"},
+		{[]string{"CN=Editors, DC=Example, DC=com", "cn=admins,dc=example,dc=com"}, "Admin"},
+		{[]string{"not a dn"}, "Viewer"},
+	}
+	for _, tt := range tests {
+		if got := backend.roleFor(tt.groups); got != tt.want {
+			t.Errorf("roleFor(%v) = %s, want %s", tt.groups, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Failures allowed before back-off delays kick in
+	loginFreeAttempts      = 3
+	defaultLockoutLimit    = 10
+	defaultIPLockoutLimit  = 50
+	defaultLockoutDuration = 15 * time.Minute
+	defaultBackoffBase     = time.Second
+)
+
+// LoginRetryAfter returns how long the caller must wait before another login
+// attempt for this email or from this IP is allowed
+func LoginRetryAfter(email, ipAddress string) time.Duration {
+	db := config.GetDB()
+	now := time.Now()
+
+	var wait time.Duration
+	for _, key := range []string{accountThrottleKey(email), ipThrottleKey(ipAddress)} {
+		var throttle models.LoginThrottle
+		if err := db.Where("throttle_key = ?", key).First(&throttle).Error; err != nil {
+			continue
+		}
+		if w := throttleWait(&throttle, now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// RecordLoginFailure counts a failed attempt against the account and IP. userID is
+// zero when no account exists for the email; the email is tracked either way so
+// responses do not reveal which accounts exist.
+func RecordLoginFailure(email, ipAddress string, userID uint) {
+	if throttle := recordFailure(accountThrottleKey(email), lockoutLimit("LOGIN_LOCKOUT_THRESHOLD", defaultLockoutLimit)); throttle != nil {
+		RecordAudit(models.AuditLog{
+			Action:    "login.lockout",
+			SubjectID: userID,
+			IPAddress: ipAddress,
+			Details:   fmt.Sprintf("key=%s failures=%d locked_until=%s", throttle.Key, throttle.Failures, throttle.LockedUntil.Format(time.RFC3339)),
+		})
+		if userID != 0 {
+			if err := sendUnlockEmail(email, throttle); err != nil {
+				log.Printf("Error sending unlock email: %v", err)
+			}
+		}
+	}
+
+	if throttle := recordFailure(ipThrottleKey(ipAddress), lockoutLimit("LOGIN_IP_LOCKOUT_THRESHOLD", defaultIPLockoutLimit)); throttle != nil {
+		RecordAudit(models.AuditLog{
+			Action:    "login.lockout",
+			IPAddress: ipAddress,
+			Details:   fmt.Sprintf("key=%s failures=%d locked_until=%s", throttle.Key, throttle.Failures, throttle.LockedUntil.Format(time.RFC3339)),
+		})
+	}
+}
+
+// RecordLoginSuccess clears the failure count for the account
+func RecordLoginSuccess(email string) {
+	db := config.GetDB()
+	db.Unscoped().Where("throttle_key = ?", accountThrottleKey(email)).Delete(&models.LoginThrottle{})
+}
+
+// UnlockAccount lifts a lockout on the account, recording who did it
+func UnlockAccount(user *models.User, actorID uint, ipAddress string) error {
+	db := config.GetDB()
+	err := db.Unscoped().Where("throttle_key = ?", accountThrottleKey(user.Email)).Delete(&models.LoginThrottle{}).Error
+	if err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "login.unlock",
+		ActorID:   actorID,
+		SubjectID: user.ID,
+		IPAddress: ipAddress,
+	})
+	return nil
+}
+
+// UnlockAccountWithToken lifts a lockout using the link emailed to the user
+func UnlockAccountWithToken(token, ipAddress string) error {
+	value, err := utils.VerifySignedValue(token)
+	if err != nil {
+		return errors.New("invalid unlock token")
+	}
+
+	// Token value is unlock:<locked until>:<email>
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] != "unlock" {
+		return errors.New("invalid unlock token")
+	}
+	lockedUntil, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("invalid unlock token")
+	}
+
+	// Only the lockout the link was sent for can be lifted with it
+	db := config.GetDB()
+	var throttle models.LoginThrottle
+	if err := db.Where("throttle_key = ?", accountThrottleKey(parts[2])).First(&throttle).Error; err != nil {
+		return errors.New("invalid or expired unlock token")
+	}
+	if throttle.LockedUntil == nil || throttle.LockedUntil.Unix() != lockedUntil || time.Now().After(*throttle.LockedUntil) {
+		return errors.New("invalid or expired unlock token")
+	}
+
+	user, err := FindUserByEmail(parts[2])
+	if err != nil {
+		return errors.New("invalid or expired unlock token")
+	}
+	return UnlockAccount(user, user.ID, ipAddress)
+}
+
+// recordFailure increments the failure count and returns the throttle when this
+// failure triggered a new lockout. Concurrent failures are all counted and only
+// one of them starts the lockout.
+func recordFailure(key string, limit int) *models.LoginThrottle {
+	db := config.GetDB()
+	now := time.Now()
+	lockoutDuration := loginLockoutDuration()
+
+	// Old failures stop counting once a full lockout period has passed. The
+	// assignments are ordered so last_failure_at is changed last, as MySQL
+	// evaluates them left to right.
+	expired := gorm.Expr("last_failure_at < ?", now.Add(-lockoutDuration))
+	throttle := models.LoginThrottle{Key: key, Failures: 1, LastFailureAt: now}
+	err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "throttle_key"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "failures"}, Value: gorm.Expr("CASE WHEN ? THEN 1 ELSE failures + 1 END", expired)},
+			{Column: clause.Column{Name: "locked_until"}, Value: gorm.Expr("CASE WHEN ? THEN NULL ELSE locked_until END", expired)},
+			{Column: clause.Column{Name: "last_failure_at"}, Value: now},
+			{Column: clause.Column{Name: "updated_at"}, Value: now},
+		},
+	}).Create(&throttle).Error
+	if err != nil {
+		log.Printf("Error recording login failure for %s: %v", key, err)
+		return nil
+	}
+
+	// Whichever failure reaches the limit first claims the lockout
+	lockedUntil := now.Add(lockoutDuration)
+	result := db.Model(&models.LoginThrottle{}).
+		Where("throttle_key = ? AND failures >= ? AND (locked_until IS NULL OR locked_until < ?)", key, limit, now).
+		Update("locked_until", lockedUntil)
+	if result.Error != nil {
+		log.Printf("Error locking %s: %v", key, result.Error)
+		return nil
+	}
+	if result.RowsAffected != 1 {
+		return nil
+	}
+
+	if err := db.Where("throttle_key = ?", key).First(&throttle).Error; err != nil {
+		return nil
+	}
+	return &throttle
+}
+
+// throttleWait applies the lockout, then an exponential back-off once the free attempts are used
+func throttleWait(throttle *models.LoginThrottle, now time.Time) time.Duration {
+	if throttle.LockedUntil != nil && now.Before(*throttle.LockedUntil) {
+		return throttle.LockedUntil.Sub(now)
+	}
+	if throttle.Failures < loginFreeAttempts {
+		return 0
+	}
+
+	maxDelay := loginLockoutDuration()
+	delay := loginBackoffBase()
+	for i := loginFreeAttempts; i < throttle.Failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if next := throttle.LastFailureAt.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+func sendUnlockEmail(email string, throttle *models.LoginThrottle) error {
+	token := utils.SignValue(fmt.Sprintf("unlock:%d:%s", throttle.LockedUntil.Unix(), normalizeEmail(email)))
+	link := utils.FrontendURL("/unlock-account?token=" + url.QueryEscape(token))
+	body := fmt.Sprintf("Your account was temporarily locked after %d failed sign-in attempts.\n\n"+
+		"If this was you, unlock it now: %s\n\nOtherwise it unlocks automatically at %s. "+
+		"If you did not try to sign in, consider changing your password.",
+		throttle.Failures, link, throttle.LockedUntil.Format(time.RFC1123))
+	return utils.SendEmail(email, "Your account has been locked", body)
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + normalizeEmail(email)
+}
+
+func ipThrottleKey(ipAddress string) string {
+	return "ip:" + ipAddress
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func lockoutLimit(env string, fallback int) int {
+	if limit, err := strconv.Atoi(os.Getenv(env)); err == nil && limit > 0 {
+		return limit
+	}
+	return fallback
+}
+
+func loginLockoutDuration() time.Duration {
+	if duration, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT_DURATION")); err == nil && duration > 0 {
+		return duration
+	}
+	return defaultLockoutDuration
+}
+
+func loginBackoffBase() time.Duration {
+	if base, err := time.ParseDuration(os.Getenv("LOGIN_BACKOFF_BASE")); err == nil && base > 0 {
+		return base
+	}
+	return defaultBackoffBase
+}
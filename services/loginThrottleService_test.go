@@ -0,0 +1,103 @@
+package services
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+)
+
+func TestRecordFailureLocksOnce(t *testing.T) {
+	db := testutil.NewDB(t)
+	key := accountThrottleKey("alice@example.com")
+
+	for i := 1; i <= 5; i++ {
+		throttle := recordFailure(key, 3)
+		if locked := throttle != nil; locked != (i == 3) {
+			t.Fatalf("failure %d: locked = %v", i, locked)
+		}
+	}
+
+	var throttle models.LoginThrottle
+	db.Where("throttle_key = ?", key).First(&throttle)
+	if throttle.Failures != 5 || throttle.LockedUntil == nil {
+		t.Errorf("throttle = %+v", throttle)
+	}
+}
+
+func TestRecordFailureForgetsOldFailures(t *testing.T) {
+	db := testutil.NewDB(t)
+	key := ipThrottleKey("203.0.113.7")
+
+	old := time.Now().Add(-2 * loginLockoutDuration())
+	db.Create(&models.LoginThrottle{Key: key, Failures: 9, LastFailureAt: old, LockedUntil: &old})
+
+	if throttle := recordFailure(key, 3); throttle != nil {
+		t.Error("an old lockout counted towards a new one")
+	}
+	var throttle models.LoginThrottle
+	db.Where("throttle_key = ?", key).First(&throttle)
+	if throttle.Failures != 1 || throttle.LockedUntil != nil {
+		t.Errorf("throttle = %+v", throttle)
+	}
+}
+
+func TestRecordFailureConcurrent(t *testing.T) {
+	db := testutil.NewDB(t)
+	key := accountThrottleKey("bob@example.com")
+	recordFailure(key, 100)
+
+	const attempts = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	lockouts := 0
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if recordFailure(key, 10) != nil {
+				mu.Lock()
+				lockouts++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var throttle models.LoginThrottle
+	db.Where("throttle_key = ?", key).First(&throttle)
+	if throttle.Failures != attempts+1 {
+		t.Errorf("failures = %d, want %d", throttle.Failures, attempts+1)
+	}
+	if lockouts != 1 {
+		t.Errorf("lockouts = %d, want 1", lockouts)
+	}
+}
+
+func TestThrottleWait(t *testing.T) {
+	t.Setenv("LOGIN_BACKOFF_BASE", "1s")
+	t.Setenv("LOGIN_LOCKOUT_DURATION", "15m")
+	now := time.Now()
+	lockedUntil := now.Add(time.Minute)
+
+	tests := []struct {
+		name     string
+		throttle models.LoginThrottle
+		want     time.Duration
+	}{
+		{"free attempts", models.LoginThrottle{Failures: loginFreeAttempts - 1, LastFailureAt: now}, 0},
+		{"first back-off", models.LoginThrottle{Failures: loginFreeAttempts, LastFailureAt: now}, time.Second},
+		{"doubling back-off", models.LoginThrottle{Failures: loginFreeAttempts + 2, LastFailureAt: now}, 4 * time.Second},
+		{"back-off elapsed", models.LoginThrottle{Failures: loginFreeAttempts, LastFailureAt: now.Add(-time.Minute)}, 0},
+		{"locked", models.LoginThrottle{Failures: 1, LastFailureAt: now, LockedUntil: &lockedUntil}, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := throttleWait(&tt.throttle, now); got != tt.want {
+				t.Errorf("throttleWait() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
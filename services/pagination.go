@@ -0,0 +1,120 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"hells/utils"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidCursor is returned for cursors that are malformed, tampered with
+// or issued for a different listing
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a listing ordered by (created_at, id). It is handed
+// to clients as an opaque signed token.
+type Cursor struct {
+	Listing   string    `json:"l"`
+	CreatedAt time.Time `json:"t"`
+	ID        uint      `json:"id"`
+	// Before selects the page preceding the position instead of the one following it
+	Before bool `json:"b,omitempty"`
+}
+
+// Encode signs the cursor so clients cannot forge positions
+func (c Cursor) Encode() string {
+	payload, _ := json.Marshal(c)
+	return utils.SignValue(string(payload))
+}
+
+// DecodeCursor verifies a cursor token issued for the named listing
+func DecodeCursor(listing, token string) (*Cursor, error) {
+	value, err := utils.VerifySignedValue(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor Cursor
+	if err := json.Unmarshal([]byte(value), &cursor); err != nil || cursor.Listing != listing {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// KeysetPage describes one page of a keyset paginated listing. Listings are
+// ordered by (created_at, id), oldest first, so rows inserted while a client is
+// scrolling neither shift nor duplicate the rows it has already seen.
+type KeysetPage struct {
+	Listing string
+	// Table qualifies the key columns when the query joins other tables
+	Table  string
+	Cursor *Cursor
+	Limit  int
+}
+
+// CursorResult carries the rows of a page and the cursors around it
+type CursorResult[T any] struct {
+	Items      []T
+	NextCursor string
+	PrevCursor string
+}
+
+// Apply restricts and orders the query for the page. One extra row is fetched
+// to learn whether another page follows in the direction of travel.
+func (p KeysetPage) Apply(db *gorm.DB) *gorm.DB {
+	createdAt, id := p.Table+".created_at", p.Table+".id"
+
+	if p.Cursor != nil {
+		op := ">"
+		if p.Cursor.Before {
+			op = "<"
+		}
+		db = db.Where(
+			"("+createdAt+" "+op+" ?) OR ("+createdAt+" = ? AND "+id+" "+op+" ?)",
+			p.Cursor.CreatedAt, p.Cursor.CreatedAt, p.Cursor.ID,
+		)
+	}
+
+	if p.Cursor != nil && p.Cursor.Before {
+		db = db.Order(createdAt + " DESC").Order(id + " DESC")
+	} else {
+		db = db.Order(createdAt).Order(id)
+	}
+	return db.Limit(p.Limit + 1)
+}
+
+// PageByCursor trims the rows fetched through KeysetPage.Apply to the page and
+// builds the cursors for the neighbouring pages. key returns the created_at and
+// id of a row.
+func PageByCursor[T any](p KeysetPage, rows []T, key func(T) (time.Time, uint)) CursorResult[T] {
+	backward := p.Cursor != nil && p.Cursor.Before
+	more := len(rows) > p.Limit
+	if more {
+		rows = rows[:p.Limit]
+	}
+
+	// Backward pages are fetched newest first
+	if backward {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	result := CursorResult[T]{Items: rows}
+	if len(rows) == 0 {
+		return result
+	}
+
+	if more || backward {
+		createdAt, id := key(rows[len(rows)-1])
+		result.NextCursor = Cursor{Listing: p.Listing, CreatedAt: createdAt, ID: id}.Encode()
+	}
+	if (more && backward) || (p.Cursor != nil && !backward) {
+		createdAt, id := key(rows[0])
+		result.PrevCursor = Cursor{Listing: p.Listing, CreatedAt: createdAt, ID: id, Before: true}.Encode()
+	}
+	return result
+}
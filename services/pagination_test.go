@@ -0,0 +1,121 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	testutil.NewDB(t)
+	token := Cursor{Listing: "users", CreatedAt: time.Unix(1700000000, 0).UTC(), ID: 42}.Encode()
+
+	cursor, err := DecodeCursor("users", token)
+	if err != nil || cursor.ID != 42 || !cursor.CreatedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("DecodeCursor() = %+v, %v", cursor, err)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := Cursor{Listing: "users", CreatedAt: time.Unix(1700000000, 0).UTC(), ID: 1}.Encode()
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name    string
+		listing string
+		token   string
+	}{
+		{"other listing", "sessions", token},
+		{"forged position", "users", forgedPayload + "." + signature},
+		{"truncated signature", "users", payload + "." + signature[:10]},
+		{"no signature", "users", payload},
+		{"garbage", "users", "not-a-cursor"},
+		{"signed value of another kind", "users", utils.SignValue("unlock:1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeCursor(tt.listing, tt.token); err != ErrInvalidCursor {
+				t.Errorf("DecodeCursor() error = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+// walkUsers pages forward through every user and returns their IDs in order
+func walkUsers(t *testing.T, limit int, onPage func(page int)) []uint {
+	t.Helper()
+	var ids []uint
+	var cursor *Cursor
+	for page := 0; page < 100; page++ {
+		result, _, err := ListUsersByCursor(UserListQuery{Limit: limit}, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range result.Items {
+			ids = append(ids, user.ID)
+		}
+		if onPage != nil {
+			onPage(page)
+		}
+		if result.NextCursor == "" {
+			return ids
+		}
+		if cursor, err = DecodeCursor("users", result.NextCursor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("pagination did not end")
+	return nil
+}
+
+func TestListUsersByCursor(t *testing.T) {
+	db := testutil.NewDB(t)
+
+	// Users sharing a created_at are ordered by id
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 23; i++ {
+		user := testutil.CreateUser(t, db, testutil.Email("user", i), "Viewer")
+		if i%3 == 0 {
+			db.Model(&models.User{}).Where("id = ?", user.ID).Update("created_at", createdAt)
+		}
+	}
+
+	var expected []uint
+	db.Model(&models.User{}).Order("created_at").Order("id").Pluck("id", &expected)
+
+	// A user signing up mid-scroll is listed at the end, and nothing is skipped
+	// or repeated
+	ids := walkUsers(t, 5, func(page int) {
+		if page == 1 {
+			user := testutil.CreateUser(t, db, "latecomer", "Viewer")
+			expected = append(expected, user.ID)
+		}
+	})
+	if len(ids) != len(expected) {
+		t.Fatalf("walked %d users, want %d", len(ids), len(expected))
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Fatalf("position %d: id %d, want %d", i, ids[i], expected[i])
+		}
+	}
+
+	// Paging back from the last page returns the page before it
+	first, _, _ := ListUsersByCursor(UserListQuery{Limit: 5}, nil)
+	next, _ := DecodeCursor("users", first.NextCursor)
+	second, _, _ := ListUsersByCursor(UserListQuery{Limit: 5}, next)
+	prev, err := DecodeCursor("users", second.PrevCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, _, _ := ListUsersByCursor(UserListQuery{Limit: 5}, prev)
+	if len(back.Items) != 5 || back.Items[0].ID != first.Items[0].ID || back.Items[4].ID != first.Items[4].ID {
+		t.Errorf("previous page = %v", back.Items)
+	}
+	if back.PrevCursor != "" {
+		t.Error("first page has a previous cursor")
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+)
+
+// ErrInvalidCurrentPassword is returned when the confirmation password does not match
+var ErrInvalidCurrentPassword = errors.New("current password is incorrect")
+
+// ErrExternalPassword is returned for accounts whose password is managed by a
+// directory or identity provider
+var ErrExternalPassword = errors.New("password is managed by your organization's identity provider")
+
+// ChangePassword replaces the password of a signed-in user, ends every other
+// session and notifies the user by email
+func ChangePassword(userID, currentSessionID uint, currentPassword, newPassword, ipAddress string) error {
+	user, err := FindUserByID(userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	if authSource(user) != "local" {
+		return ErrExternalPassword
+	}
+
+	if !utils.CheckPasswordHash(currentPassword, user.PasswordHash) {
+		return ErrInvalidCurrentPassword
+	}
+
+	// Enforce password policy
+	if err := utils.DefaultPasswordPolicy().Validate(newPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	db := config.GetDB()
+	tx := db.Begin()
+
+	// Update user password
+	if err := tx.Model(user).Update("password_hash", hashedPassword).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Revoke every other session and the tokens issued for them
+	now := time.Now()
+	err = tx.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, currentSessionID).
+		Update("revoked_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// End impersonation of this user
+	err = tx.Model(&models.ImpersonationSession{}).
+		Where("subject_id = ? AND ended_at IS NULL", userID).
+		Update("ended_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Outstanding reset tokens were requested for the old password
+	err = tx.Model(&models.PasswordReset{}).
+		Where("email = ? AND is_used = ?", user.Email, false).
+		Update("is_used", true).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "password.change",
+		ActorID:   userID,
+		SubjectID: userID,
+		IPAddress: ipAddress,
+	})
+
+	if err := sendPasswordChangedEmail(user, ipAddress); err != nil {
+		log.Printf("Error sending password change notification: %v", err)
+	}
+	return nil
+}
+
+// CreatePasswordReset issues a reset token for the email, valid for ttl
+func CreatePasswordReset(email string, ttl time.Duration) (*models.PasswordReset, error) {
+	token, err := utils.GeneratePasswordResetToken()
+	if err != nil {
+		return nil, err
+	}
+
+	db := config.GetDB()
+	reset := models.PasswordReset{
+		Email:     email,
+		Token:     token,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	err = db.Create(&reset).Error
+	return &reset, err
+}
+
+// sendPasswordChangedEmail tells the user their password changed, with a reset
+// link to take the account back if it was not them
+func sendPasswordChangedEmail(user *models.User, ipAddress string) error {
+	reset, err := CreatePasswordReset(user.Email, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	link := utils.FrontendURL(fmt.Sprintf("/reset-password?email=%s&token=%s", url.QueryEscape(user.Email), url.QueryEscape(reset.Token)))
+	body := fmt.Sprintf("Hi %s,\n\nThe password for your account was changed on %s from %s. "+
+		"All other sessions have been signed out.\n\n"+
+		"If this wasn't you, secure your account now by resetting your password: %s",
+		user.Username, time.Now().Format(time.RFC1123), ipAddress, link)
+	return utils.SendEmail(user.Email, "Your password was changed", body)
+}
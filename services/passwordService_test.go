@@ -0,0 +1,99 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+)
+
+func TestChangePassword(t *testing.T) {
+	t.Setenv("PASSWORD_HASHER", "bcrypt")
+	t.Setenv("PASSWORD_BCRYPT_COST", "4")
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	hash, err := utils.HashPassword("old correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(user).Update("password_hash", hash)
+
+	current, _ := CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+	other, _ := CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+	reset, _ := CreatePasswordReset(user.Email, time.Hour)
+
+	if err := ChangePassword(user.ID, current.ID, "wrong", "new staple battery horse", ""); !errors.Is(err, ErrInvalidCurrentPassword) {
+		t.Errorf("wrong current password: err = %v", err)
+	}
+	if err := ChangePassword(user.ID, current.ID, "old correct horse battery", "alice", ""); err == nil {
+		t.Error("weak password accepted")
+	}
+	if err := ChangePassword(user.ID, current.ID, "old correct horse battery", "new staple battery horse", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, _ := FindUserByID(user.ID)
+	if !utils.CheckPasswordHash("new staple battery horse", reloaded.PasswordHash) {
+		t.Error("password was not changed")
+	}
+	db.First(current, current.ID)
+	db.First(other, other.ID)
+	if !current.IsActive() || other.IsActive() {
+		t.Errorf("current session active = %v, other session active = %v", current.IsActive(), other.IsActive())
+	}
+	db.First(reset, reset.ID)
+	if !reset.IsUsed {
+		t.Error("reset token issued before the change is still usable")
+	}
+}
+
+func TestChangePasswordExternalAccounts(t *testing.T) {
+	db := testutil.NewDB(t)
+	for _, source := range []string{"ldap", "saml"} {
+		user := testutil.CreateUser(t, db, source, "Viewer")
+		db.Model(&models.User{}).Where("id = ?", user.ID).Update("auth_source", source)
+
+		if err := ChangePassword(user.ID, 0, "anything", "new staple battery horse", ""); !errors.Is(err, ErrExternalPassword) {
+			t.Errorf("%s: err = %v, want ErrExternalPassword", source, err)
+		}
+	}
+}
+
+func TestResetUserPasswordSignsEveryoneOut(t *testing.T) {
+	t.Setenv("PASSWORD_HASHER", "bcrypt")
+	t.Setenv("PASSWORD_BCRYPT_COST", "4")
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	session, _ := CreateSession(user.ID, "attacker", "203.0.113.9", time.Hour)
+	impersonation := models.ImpersonationSession{TokenID: "jti", ActorID: 99, SubjectID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	db.Create(&impersonation)
+	reset, _ := CreatePasswordReset(user.Email, time.Hour)
+	other, _ := CreatePasswordReset(user.Email, time.Hour)
+
+	if err := ResetUserPassword(user.Email, reset.Token, "new staple battery horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	db.First(session, session.ID)
+	if session.IsActive() {
+		t.Error("session is still active after the reset")
+	}
+	db.First(&impersonation, impersonation.ID)
+	if impersonation.EndedAt == nil {
+		t.Error("impersonation is still running after the reset")
+	}
+	reloaded, _ := FindUserByID(user.ID)
+	if !utils.CheckPasswordHash("new staple battery horse", reloaded.PasswordHash) {
+		t.Error("password was not reset")
+	}
+
+	if err := ResetUserPassword(user.Email, reset.Token, "another staple battery"); err == nil {
+		t.Error("reset token worked twice")
+	}
+	if err := ResetUserPassword(user.Email, other.Token, "another staple battery"); err == nil {
+		t.Error("older reset token still works")
+	}
+}
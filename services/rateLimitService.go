@@ -0,0 +1,156 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"hells/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RateLimitStore counts requests per key in fixed windows. The rate limiting
+// middleware combines the current and previous window into a sliding window.
+type RateLimitStore interface {
+	// Increment records a request for key and returns the counts of the
+	// current and previous windows, including this request
+	Increment(key string, window time.Duration, now time.Time) (current, previous int, err error)
+}
+
+const (
+	// DefaultMemoryRateLimitKeys caps the keys a memory store tracks, so
+	// requests from ever-changing IPs cannot grow it without bound
+	DefaultMemoryRateLimitKeys   = 100000
+	memoryRateLimitSweepInterval = time.Minute
+)
+
+// MemoryRateLimitStore keeps counters in process memory. Limits are per instance.
+type MemoryRateLimitStore struct {
+	// MaxKeys is the most keys tracked at once; once full, an arbitrary key
+	// is forgotten for each new one
+	MaxKeys int
+
+	mu        sync.Mutex
+	counters  map[string]*memoryCounter
+	nextSweep time.Time
+}
+
+type memoryCounter struct {
+	windows map[int64]int
+	// expiresAt is when neither the current nor the previous window counts any more
+	expiresAt time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{MaxKeys: DefaultMemoryRateLimitKeys, counters: map[string]*memoryCounter{}}
+}
+
+func (s *MemoryRateLimitStore) Increment(key string, window time.Duration, now time.Time) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.After(s.nextSweep) {
+		s.sweep(now)
+	}
+
+	start := windowStart(now, window)
+	counter, ok := s.counters[key]
+	if !ok {
+		if s.MaxKeys > 0 && len(s.counters) >= s.MaxKeys {
+			s.evict()
+		}
+		counter = &memoryCounter{windows: map[int64]int{}}
+		s.counters[key] = counter
+	}
+
+	// Windows older than the previous one no longer count
+	for ws := range counter.windows {
+		if ws < start-int64(window) {
+			delete(counter.windows, ws)
+		}
+	}
+
+	counter.windows[start]++
+	counter.expiresAt = time.Unix(0, start).Add(2 * window)
+	return counter.windows[start], counter.windows[start-int64(window)], nil
+}
+
+// Len returns the number of keys being tracked
+func (s *MemoryRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.counters)
+}
+
+// sweep drops the keys whose windows have all expired; the caller holds s.mu
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, counter := range s.counters {
+		if !now.Before(counter.expiresAt) {
+			delete(s.counters, key)
+		}
+	}
+	s.nextSweep = now.Add(memoryRateLimitSweepInterval)
+}
+
+// evict makes room for a new key; the caller holds s.mu
+func (s *MemoryRateLimitStore) evict() {
+	for key := range s.counters {
+		if len(s.counters) < s.MaxKeys {
+			return
+		}
+		delete(s.counters, key)
+	}
+}
+
+// DatabaseRateLimitStore keeps counters in the database so limits are shared by
+// every instance of the service
+type DatabaseRateLimitStore struct {
+	db *gorm.DB
+}
+
+func NewDatabaseRateLimitStore(db *gorm.DB) *DatabaseRateLimitStore {
+	return &DatabaseRateLimitStore{db: db}
+}
+
+func (s *DatabaseRateLimitStore) Increment(key string, window time.Duration, now time.Time) (int, int, error) {
+	start := windowStart(now, window)
+	previousStart := start - int64(window)
+
+	// Atomic upsert so concurrent instances never lose a hit
+	counter := models.RateLimitCounter{Key: key, WindowStart: start, Count: 1}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "bucket_key"}, {Name: "window_start"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("count + 1"), "updated_at": now}),
+	}).Create(&counter).Error
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var counters []models.RateLimitCounter
+	err = s.db.Where("bucket_key = ? AND window_start IN ?", key, []int64{start, previousStart}).Find(&counters).Error
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var current, previous int
+	for _, c := range counters {
+		if c.WindowStart == start {
+			current = c.Count
+		} else {
+			previous = c.Count
+		}
+	}
+
+	// First hit of a new window: drop this key's expired windows
+	if current == 1 {
+		s.db.Unscoped().Where("bucket_key = ? AND window_start < ?", key, previousStart).Delete(&models.RateLimitCounter{})
+	}
+
+	return current, previous, nil
+}
+
+// windowStart returns the start of the fixed window containing now, in nanoseconds
+func windowStart(now time.Time, window time.Duration) int64 {
+	return now.UnixNano() - now.UnixNano()%int64(window)
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStoreCounts(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	window := time.Minute
+	now := time.Unix(0, windowStart(time.Now(), window))
+
+	for i := 1; i <= 3; i++ {
+		current, previous, _ := store.Increment("login:ip:a", window, now)
+		if current != i || previous != 0 {
+			t.Fatalf("hit %d: current=%d previous=%d", i, current, previous)
+		}
+	}
+
+	// The next window sees this one as its previous window
+	current, previous, _ := store.Increment("login:ip:a", window, now.Add(window))
+	if current != 1 || previous != 3 {
+		t.Errorf("next window: current=%d previous=%d", current, previous)
+	}
+
+	// Other keys are counted separately
+	if current, _, _ := store.Increment("login:ip:b", window, now); current != 1 {
+		t.Errorf("other key: current=%d", current)
+	}
+}
+
+func TestMemoryRateLimitStoreSweepsExpiredKeys(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		store.Increment(fmt.Sprintf("login:ip:%d", i), time.Second, now)
+	}
+	store.Increment("export:user:1", time.Hour, now)
+
+	// A minute later only the long window still counts
+	store.Increment("login:ip:new", time.Second, now.Add(2*memoryRateLimitSweepInterval))
+	if n := store.Len(); n != 2 {
+		t.Errorf("keys after sweep = %d, want 2", n)
+	}
+}
+
+func TestMemoryRateLimitStoreCapsKeys(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	store.MaxKeys = 50
+	now := time.Now()
+
+	for i := 0; i < 500; i++ {
+		store.Increment(fmt.Sprintf("login:ip:%d", i), time.Hour, now)
+	}
+	if n := store.Len(); n != 50 {
+		t.Errorf("keys = %d, want 50", n)
+	}
+}
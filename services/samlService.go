@@ -0,0 +1,576 @@
+package services
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+
+	"github.com/crewjam/saml"
+	"gorm.io/gorm"
+)
+
+const samlRequestTTL = 10 * time.Minute
+
+var (
+	// ErrSAMLNotConfigured is returned for organizations without an enabled identity provider
+	ErrSAMLNotConfigured = errors.New("SAML sign-in is not configured for this organization")
+	// ErrSAMLLoginFailed hides the reason a response was rejected from the browser;
+	// the reason is logged instead
+	ErrSAMLLoginFailed = errors.New("SAML sign-in failed")
+)
+
+// SaveSAMLProvider validates and stores an organization's identity provider.
+// The metadata is fetched from metadataURL when provider has none.
+func SaveSAMLProvider(orgID uint, provider *models.SAMLProvider, metadataURL string) error {
+	if _, err := FindOrganizationByID(orgID); err != nil {
+		return errors.New("organization not found")
+	}
+
+	if provider.IdPMetadataXML == "" && metadataURL != "" {
+		metadata, err := fetchSAMLMetadata(metadataURL)
+		if err != nil {
+			return fmt.Errorf("could not fetch IdP metadata: %v", err)
+		}
+		provider.IdPMetadataXML = metadata
+	}
+	entity, err := parseSAMLMetadata([]byte(provider.IdPMetadataXML))
+	if err != nil {
+		return fmt.Errorf("invalid IdP metadata: %v", err)
+	}
+	provider.IdPEntityID = entity.EntityID
+
+	db := config.GetDB()
+	for _, mapping := range provider.RoleMappings {
+		var role models.Role
+		if err := db.Where("name = ?", mapping.Role).First(&role).Error; err != nil {
+			return fmt.Errorf("role %q not found", mapping.Role)
+		}
+	}
+	if provider.DefaultRoleID != 0 {
+		var role models.Role
+		if err := db.First(&role, provider.DefaultRoleID).Error; err != nil {
+			return errors.New("default role not found")
+		}
+	}
+
+	// One provider per organization: update the existing one in place
+	var existing models.SAMLProvider
+	if err := db.Where("organization_id = ?", orgID).First(&existing).Error; err == nil {
+		provider.ID = existing.ID
+		provider.CreatedAt = existing.CreatedAt
+	}
+	provider.OrganizationID = orgID
+	return db.Save(provider).Error
+}
+
+func FindSAMLProvider(orgID uint) (*models.SAMLProvider, error) {
+	db := config.GetDB()
+	var provider models.SAMLProvider
+	err := db.Where("organization_id = ?", orgID).First(&provider).Error
+	return &provider, err
+}
+
+// SAMLMetadata returns the service provider metadata to register with the organization's IdP
+func SAMLMetadata(orgID uint) ([]byte, error) {
+	sp, _, err := samlServiceProvider(orgID, false)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), metadata...), nil
+}
+
+// StartSAMLLogin records a new AuthnRequest and returns the IdP URL to redirect
+// the browser to. returnTo is the frontend path to land on after signing in.
+func StartSAMLLogin(orgID uint, returnTo string) (string, error) {
+	return startSAMLRequest(orgID, models.SAMLRequest{ReturnTo: safeReturnPath(returnTo)}, false)
+}
+
+// StartSAMLReauthentication sends a signed-in SAML user back to their IdP with
+// ForceAuthn set, so the IdP asks for their credentials again. It is the step-up
+// for users who have no password to confirm at /auth/reauthenticate.
+func StartSAMLReauthentication(userID, sessionID uint, returnTo string) (string, error) {
+	db := config.GetDB()
+	var identity models.SAMLIdentity
+	err := db.Joins("JOIN saml_providers ON saml_providers.id = saml_identities.provider_id").
+		Where("saml_identities.user_id = ? AND saml_identities.deleted_at IS NULL AND saml_providers.enabled = ?", userID, true).
+		Order("saml_identities.updated_at desc").
+		First(&identity).Error
+	if err != nil {
+		return "", ErrSAMLNotConfigured
+	}
+	var provider models.SAMLProvider
+	if err := db.First(&provider, identity.ProviderID).Error; err != nil {
+		return "", ErrSAMLNotConfigured
+	}
+
+	pending := models.SAMLRequest{
+		ReturnTo:  safeReturnPath(returnTo),
+		UserID:    userID,
+		SessionID: sessionID,
+	}
+	return startSAMLRequest(provider.OrganizationID, pending, true)
+}
+
+func startSAMLRequest(orgID uint, pending models.SAMLRequest, forceAuthn bool) (string, error) {
+	sp, provider, err := samlServiceProvider(orgID, true)
+	if err != nil {
+		return "", err
+	}
+
+	ssoURL := sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if ssoURL == "" {
+		return "", errors.New("IdP metadata has no HTTP-Redirect single sign-on endpoint")
+	}
+	request, err := sp.MakeAuthenticationRequest(ssoURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", err
+	}
+	if forceAuthn {
+		request.ForceAuthn = &forceAuthn
+	}
+
+	relayState, err := utils.GenerateNonce()
+	if err != nil {
+		return "", err
+	}
+	db := config.GetDB()
+	pending.ProviderID = provider.ID
+	pending.RequestID = request.ID
+	pending.RelayState = relayState
+	pending.ExpiresAt = time.Now().Add(samlRequestTTL)
+	if err := db.Create(&pending).Error; err != nil {
+		return "", err
+	}
+
+	redirect, err := request.Redirect(relayState, sp)
+	if err != nil {
+		return "", err
+	}
+	return redirect.String(), nil
+}
+
+// SAMLLogin is a validated IdP response
+type SAMLLogin struct {
+	User *models.User
+	// ReturnTo is the frontend path to send the browser to
+	ReturnTo string
+	// SessionID is the session being re-authenticated, zero for a new sign-in
+	SessionID uint
+	// AuthTime is when the IdP authenticated the user
+	AuthTime time.Time
+}
+
+// CompleteSAMLLogin validates the IdP's response posted to the ACS endpoint.
+// Users are matched by NameID and created on first sign-in; their membership
+// role in the organization follows the provider's role mappings. A response to
+// a re-authentication request must be for the user who asked for it.
+func CompleteSAMLLogin(orgID uint, r *http.Request) (*SAMLLogin, error) {
+	sp, provider, err := samlServiceProvider(orgID, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, ErrSAMLLoginFailed
+	}
+
+	// Only IdP responses to a request we sent, and only once
+	db := config.GetDB()
+	var pending models.SAMLRequest
+	err = db.Where("provider_id = ? AND relay_state = ? AND used_at IS NULL AND expires_at > ?",
+		provider.ID, r.PostForm.Get("RelayState"), time.Now()).First(&pending).Error
+	if err != nil {
+		log.Printf("SAML response for organization %d has no pending request", orgID)
+		return nil, ErrSAMLLoginFailed
+	}
+	// Checks the signature, issuer, audience, recipient, InResponseTo and validity window
+	assertion, err := sp.ParseResponse(r, []string{pending.RequestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		log.Printf("Rejected SAML response for organization %d: %v", orgID, err)
+		return nil, ErrSAMLLoginFailed
+	}
+
+	// Claim the request only for a valid response, so a forged post cannot
+	// use up the user's pending sign-in; of two valid posts only one wins
+	result := db.Model(&models.SAMLRequest{}).Where("id = ? AND used_at IS NULL", pending.ID).Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected != 1 {
+		return nil, ErrSAMLLoginFailed
+	}
+
+	user, err := samlUser(provider, assertion)
+	if err != nil {
+		log.Printf("SAML sign-in for organization %d: %v", orgID, err)
+		return nil, err
+	}
+
+	login := &SAMLLogin{User: user, ReturnTo: pending.ReturnTo, AuthTime: time.Now()}
+	if len(assertion.AuthnStatements) > 0 && !assertion.AuthnStatements[0].AuthnInstant.IsZero() {
+		login.AuthTime = assertion.AuthnStatements[0].AuthnInstant
+	}
+	if pending.UserID != 0 {
+		// IdPs that ignore ForceAuthn answer from their own session, which
+		// shows in an AuthnInstant older than the request
+		if user.ID != pending.UserID || login.AuthTime.Before(pending.CreatedAt.Add(-time.Minute)) {
+			log.Printf("Rejected SAML re-authentication for user %d in organization %d", pending.UserID, orgID)
+			return nil, ErrSAMLLoginFailed
+		}
+		login.SessionID = pending.SessionID
+	}
+	return login, nil
+}
+
+// samlUser finds or creates the user for an assertion and applies the attribute mappings
+func samlUser(provider *models.SAMLProvider, assertion *saml.Assertion) (*models.User, error) {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, ErrSAMLLoginFailed
+	}
+	nameID := assertion.Subject.NameID.Value
+
+	email := normalizeEmail(samlAttribute(assertion, provider.EmailAttribute, "email"))
+	if email == "" && utils.ValidEmail(nameID) {
+		email = normalizeEmail(nameID)
+	}
+	name := samlAttribute(assertion, provider.NameAttribute, "displayName")
+
+	roleID, err := samlRoleID(provider, assertion)
+	if err != nil {
+		return nil, err
+	}
+
+	db := config.GetDB()
+	var identity models.SAMLIdentity
+	err = db.Where("provider_id = ? AND name_id = ?", provider.ID, nameID).First(&identity).Error
+	if err == nil {
+		user, err := FindUserByID(identity.UserID)
+		if err != nil || user.DeletedAt != nil {
+			return nil, ErrSAMLLoginFailed
+		}
+		if name != "" && name != user.Name {
+			db.Model(&models.User{}).Where("id = ?", user.ID).Update("name", name)
+			user.Name = name
+		}
+		if err := setOrganizationRole(provider.OrganizationID, user.ID, roleID); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	// New subject: create the user. Existing accounts are never taken over by
+	// matching email, as the IdP only speaks for its own organization. For the
+	// same reason the email stays unverified: the account cannot accept
+	// invitations sent to that address.
+	if !utils.ValidEmail(email) {
+		return nil, errors.New("the identity provider did not send an email address")
+	}
+	if emailTaken(email, 0) {
+		return nil, errors.New("an account with this email already exists, sign in with your password")
+	}
+
+	username := samlAttribute(assertion, provider.UsernameAttribute, "username")
+	if username == "" {
+		username = email
+	}
+	user := models.User{
+		Username:   username,
+		Name:       name,
+		Email:      email,
+		AuthSource: "saml",
+		IsActive:   true,
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := createUser(tx, &user); err != nil {
+			return err
+		}
+		identity = models.SAMLIdentity{ProviderID: provider.ID, NameID: nameID, UserID: user.ID}
+		if err := tx.Create(&identity).Error; err != nil {
+			return err
+		}
+		member := models.OrganizationMember{OrganizationID: provider.OrganizationID, UserID: user.ID, RoleID: roleID}
+		return tx.Create(&member).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "saml.user_create",
+		SubjectID: user.ID,
+		Details:   fmt.Sprintf("organization_id=%d name_id=%q", provider.OrganizationID, nameID),
+	})
+	return FindUserByID(user.ID)
+}
+
+// samlRoleID returns the organization role for the assertion's role attribute
+func samlRoleID(provider *models.SAMLProvider, assertion *saml.Assertion) (uint, error) {
+	db := config.GetDB()
+	values := samlAttributeValues(assertion, provider.RoleAttribute)
+	for _, mapping := range provider.RoleMappings {
+		for _, value := range values {
+			if value == mapping.Value {
+				var role models.Role
+				if err := db.Where("name = ?", mapping.Role).First(&role).Error; err != nil {
+					return 0, fmt.Errorf("role %q not found", mapping.Role)
+				}
+				return role.ID, nil
+			}
+		}
+	}
+
+	if provider.DefaultRoleID != 0 {
+		return provider.DefaultRoleID, nil
+	}
+	var role models.Role
+	if err := db.Where("name = ?", defaultRoleName).First(&role).Error; err != nil {
+		return 0, errors.New("default role not found")
+	}
+	return role.ID, nil
+}
+
+// setOrganizationRole adds the user to the organization or updates their role in it
+func setOrganizationRole(orgID, userID, roleID uint) error {
+	db := config.GetDB()
+	var member models.OrganizationMember
+	if err := db.Where("organization_id = ? AND user_id = ?", orgID, userID).First(&member).Error; err != nil {
+		member = models.OrganizationMember{OrganizationID: orgID, UserID: userID}
+	}
+	if member.ID != 0 && member.RoleID == roleID {
+		return nil
+	}
+	member.RoleID = roleID
+	return db.Save(&member).Error
+}
+
+// samlAttribute returns the first value of the named attribute, or of fallback when name is empty
+func samlAttribute(assertion *saml.Assertion, name, fallback string) string {
+	if name == "" {
+		name = fallback
+	}
+	if values := samlAttributeValues(assertion, name); len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// samlAttributeValues returns the values of the attribute whose Name or FriendlyName is name
+func samlAttributeValues(assertion *saml.Assertion, name string) []string {
+	if name == "" {
+		return nil
+	}
+	var values []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != name && attribute.FriendlyName != name {
+				continue
+			}
+			for _, value := range attribute.Values {
+				values = append(values, value.Value)
+			}
+		}
+	}
+	return values
+}
+
+// samlServiceProvider builds the service provider for an organization. Its
+// entity ID and endpoints are specific to the organization so each IdP can be
+// registered separately.
+func samlServiceProvider(orgID uint, requireEnabled bool) (*saml.ServiceProvider, *models.SAMLProvider, error) {
+	provider, err := FindSAMLProvider(orgID)
+	if err != nil || (requireEnabled && !provider.Enabled) {
+		return nil, nil, ErrSAMLNotConfigured
+	}
+
+	key, cert, err := samlKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	idpMetadata, err := parseSAMLMetadata([]byte(provider.IdPMetadataXML))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid IdP metadata: %v", err)
+	}
+
+	base := fmt.Sprintf("/saml/%d", orgID)
+	metadataURL, err := url.Parse(utils.AppURL(base + "/metadata"))
+	if err != nil {
+		return nil, nil, err
+	}
+	acsURL, err := url.Parse(utils.AppURL(base + "/acs"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          metadataURL.String(),
+		Key:               key,
+		Certificate:       cert,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: saml.PersistentNameIDFormat,
+	}
+	return sp, provider, nil
+}
+
+var (
+	samlKey     *rsa.PrivateKey
+	samlCert    *x509.Certificate
+	samlKeyErr  error
+	samlKeyOnce sync.Once
+)
+
+// samlKeyPair loads the service provider's signing key and certificate from
+// SAML_SP_KEY_FILE and SAML_SP_CERT_FILE
+func samlKeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	samlKeyOnce.Do(func() {
+		pair, err := tls.LoadX509KeyPair(os.Getenv("SAML_SP_CERT_FILE"), os.Getenv("SAML_SP_KEY_FILE"))
+		if err != nil {
+			samlKeyErr = fmt.Errorf("SAML service provider key pair: %v", err)
+			return
+		}
+		key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			samlKeyErr = errors.New("SAML service provider key must be an RSA key")
+			return
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			samlKeyErr = err
+			return
+		}
+		samlKey, samlCert = key, cert
+	})
+	return samlKey, samlCert, samlKeyErr
+}
+
+// parseSAMLMetadata reads IdP metadata, which some IdPs wrap in an EntitiesDescriptor
+func parseSAMLMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	var entity saml.EntityDescriptor
+	if err := xml.Unmarshal(data, &entity); err == nil {
+		if len(entity.IDPSSODescriptors) == 0 {
+			return nil, errors.New("metadata has no IDPSSODescriptor")
+		}
+		return &entity, nil
+	}
+
+	var entities saml.EntitiesDescriptor
+	if err := xml.Unmarshal(data, &entities); err != nil {
+		return nil, err
+	}
+	for i, e := range entities.EntityDescriptors {
+		if len(e.IDPSSODescriptors) > 0 {
+			return &entities.EntityDescriptors[i], nil
+		}
+	}
+	return nil, errors.New("metadata has no IDPSSODescriptor")
+}
+
+// samlMetadataClient fetches IdP metadata from URLs organization admins enter,
+// so it only connects to public addresses, including after redirects
+var samlMetadataClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: publicAddressOnly}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" || len(via) >= 5 {
+			return errors.New("metadata URL redirects too often or away from https")
+		}
+		return nil
+	},
+}
+
+// nonPublicNetworks are ranges besides loopback, private and link-local ones
+// that no IdP publishes metadata on
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+// publicAddressOnly is a net.Dialer Control check run on the resolved address,
+// so hostnames resolving to internal addresses are refused as well
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("metadata URL must not point to the non-public address %s", host)
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+func fetchSAMLMetadata(metadataURL string) (string, error) {
+	if u, err := url.Parse(metadataURL); err != nil || u.Scheme != "https" {
+		return "", errors.New("metadata URL must use https")
+	}
+
+	resp, err := samlMetadataClient.Get(metadataURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return string(body), err
+}
+
+// safeReturnPath keeps post-login redirects on the frontend
+func safeReturnPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, `\`) {
+		return "/"
+	}
+	return path
+}
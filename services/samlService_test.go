@@ -0,0 +1,218 @@
+package services
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+
+	"gorm.io/gorm"
+)
+
+const testIdPMetadata = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`
+
+// useSAMLKeyPair points the service provider at a throwaway key pair
+func useSAMLKeyPair(t *testing.T) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "sp.crt"), filepath.Join(dir, "sp.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	t.Setenv("SAML_SP_CERT_FILE", certFile)
+	t.Setenv("SAML_SP_KEY_FILE", keyFile)
+	t.Setenv("APP_URL", "https://auth.example.com")
+	if _, _, err := samlKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createSAMLProvider(t *testing.T, db *gorm.DB) *models.SAMLProvider {
+	t.Helper()
+	org := models.Organization{Name: "Acme"}
+	if err := db.Create(&org).Error; err != nil {
+		t.Fatal(err)
+	}
+	provider := models.SAMLProvider{OrganizationID: org.ID, Enabled: true, IdPMetadataXML: testIdPMetadata}
+	if err := db.Create(&provider).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &provider
+}
+
+// authnRequest decodes the AuthnRequest from an HTTP-Redirect binding URL
+func authnRequest(t *testing.T, redirect string) string {
+	t.Helper()
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(request)
+}
+
+func TestStartSAMLReauthentication(t *testing.T) {
+	db := testutil.NewDB(t)
+	useSAMLKeyPair(t)
+	provider := createSAMLProvider(t, db)
+	user := testutil.CreateUser(t, db, "sso", "Viewer")
+	db.Create(&models.SAMLIdentity{ProviderID: provider.ID, NameID: "sso-subject", UserID: user.ID})
+
+	redirect, err := StartSAMLReauthentication(user.ID, 42, "/settings")
+	if err != nil {
+		t.Fatalf("StartSAMLReauthentication: %v", err)
+	}
+	if !strings.HasPrefix(redirect, "https://idp.example.com/sso?") {
+		t.Errorf("redirect = %q", redirect)
+	}
+	if request := authnRequest(t, redirect); !strings.Contains(request, `ForceAuthn="true"`) {
+		t.Errorf("AuthnRequest without ForceAuthn: %s", request)
+	}
+
+	var pending models.SAMLRequest
+	if err := db.Where("provider_id = ?", provider.ID).First(&pending).Error; err != nil {
+		t.Fatal(err)
+	}
+	if pending.UserID != user.ID || pending.SessionID != 42 || pending.ReturnTo != "/settings" {
+		t.Errorf("pending request = %+v", pending)
+	}
+
+	// Plain sign-ins do not force authentication
+	redirect, err = StartSAMLLogin(provider.OrganizationID, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(authnRequest(t, redirect), "ForceAuthn") {
+		t.Error("sign-in request forces authentication")
+	}
+}
+
+func TestStartSAMLReauthenticationWithoutIdentity(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "local", "Viewer")
+
+	if _, err := StartSAMLReauthentication(user.ID, 1, "/"); !errors.Is(err, ErrSAMLNotConfigured) {
+		t.Errorf("err = %v, want ErrSAMLNotConfigured", err)
+	}
+}
+
+func TestCompleteSAMLLoginKeepsRequestForInvalidResponses(t *testing.T) {
+	db := testutil.NewDB(t)
+	useSAMLKeyPair(t)
+	provider := createSAMLProvider(t, db)
+
+	redirect, err := StartSAMLLogin(provider.OrganizationID, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(redirect)
+	form := url.Values{
+		"RelayState":   {u.Query().Get("RelayState")},
+		"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte("<Response/>"))},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/saml/acs", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if _, err := CompleteSAMLLogin(provider.OrganizationID, r); !errors.Is(err, ErrSAMLLoginFailed) {
+		t.Fatalf("err = %v, want ErrSAMLLoginFailed", err)
+	}
+	var pending models.SAMLRequest
+	if err := db.Where("provider_id = ?", provider.ID).First(&pending).Error; err != nil {
+		t.Fatal(err)
+	}
+	if pending.UsedAt != nil {
+		t.Error("an invalid response used up the pending request")
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestFetchSAMLMetadataRefusesInternalAddresses(t *testing.T) {
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(testIdPMetadata))
+	}))
+	defer server.Close()
+
+	for _, metadataURL := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)} {
+		if _, err := fetchSAMLMetadata(metadataURL); err == nil || !strings.Contains(err.Error(), "non-public address") {
+			t.Errorf("fetch %s: err = %v", metadataURL, err)
+		}
+	}
+	if _, err := fetchSAMLMetadata("http://idp.example.com/metadata"); err == nil {
+		t.Error("fetched metadata over http")
+	}
+	if requests != 0 {
+		t.Errorf("server received %d requests", requests)
+	}
+}
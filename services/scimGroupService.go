@@ -0,0 +1,430 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+
+	"gorm.io/gorm"
+)
+
+// defaultRoleName is the role users fall back to when removed from a SCIM group
+const defaultRoleName = "Viewer"
+
+var errScimGroupNotFound = &ScimError{Status: http.StatusNotFound, Detail: "Group not found"}
+
+// scimGroupFilterColumns maps filterable group attributes (lower-cased) to their columns
+var scimGroupFilterColumns = map[string]string{
+	"id":          "id",
+	"displayname": "name",
+}
+
+// scimMemberPathPattern matches members[value eq "42"]
+var scimMemberPathPattern = regexp.MustCompile(`^(?i)members\[\s*value\s+eq\s+"([^"]*)"\s*\]$`)
+
+// ScimGroup is the SCIM representation of a role. As a user holds exactly one
+// role, adding a user to a group moves them out of their previous one, and
+// removing them from a group returns them to the default role.
+type ScimGroup struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []ScimMultiValue `json:"members"`
+	Meta        *ScimMeta        `json:"meta,omitempty"`
+}
+
+// NewScimGroup converts a role and its members to their SCIM representation
+func NewScimGroup(role *models.Role, members []models.User) ScimGroup {
+	id := strconv.FormatUint(uint64(role.ID), 10)
+	group := ScimGroup{
+		Schemas:     []string{ScimGroupSchema},
+		ID:          id,
+		DisplayName: role.Name,
+		Members:     []ScimMultiValue{},
+		Meta: &ScimMeta{
+			ResourceType: "Group",
+			Created:      role.CreatedAt,
+			LastModified: role.UpdatedAt,
+			Location:     utils.AppURL("/scim/v2/Groups/" + id),
+		},
+	}
+	for _, member := range members {
+		memberID := strconv.FormatUint(uint64(member.ID), 10)
+		group.Members = append(group.Members, ScimMultiValue{
+			Value:   memberID,
+			Display: member.Username,
+			Ref:     utils.AppURL("/scim/v2/Users/" + memberID),
+		})
+	}
+	return group
+}
+
+// ListScimGroups returns the roles matching the query. withMembers is false
+// when the client asked for excludedAttributes=members.
+func ListScimGroups(query ScimListQuery, withMembers bool) (*ScimListResponse, error) {
+	query.normalize()
+	db := config.GetDB()
+	filtered := func() (*gorm.DB, error) {
+		return applyScimFilter(db.Model(&models.Role{}), query.Filter, scimGroupFilterColumns)
+	}
+
+	counted, err := filtered()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	if err := counted.Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	var roles []models.Role
+	listed, _ := filtered()
+	if err := query.page(listed).Order("id").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+
+	resources := make([]ScimGroup, len(roles))
+	for i := range roles {
+		var members []models.User
+		if withMembers {
+			if members, err = roleMembers(roles[i].ID); err != nil {
+				return nil, err
+			}
+		}
+		resources[i] = NewScimGroup(&roles[i], members)
+	}
+	return &ScimListResponse{
+		Schemas:      []string{ScimListSchema},
+		TotalResults: int(total),
+		StartIndex:   query.StartIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}, nil
+}
+
+func GetScimGroup(id string) (*ScimGroup, error) {
+	role, err := findScimGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	members, err := roleMembers(role.ID)
+	if err != nil {
+		return nil, err
+	}
+	group := NewScimGroup(role, members)
+	return &group, nil
+}
+
+// CreateScimGroup creates a role and moves the listed members into it
+func CreateScimGroup(group ScimGroup, ipAddress string) (*ScimGroup, error) {
+	name := strings.TrimSpace(group.DisplayName)
+	if name == "" {
+		return nil, scimBadRequest("invalidValue", "displayName is required")
+	}
+
+	db := config.GetDB()
+	var existing models.Role
+	if err := db.Where("name = ?", name).First(&existing).Error; err == nil {
+		return nil, &ScimError{Status: http.StatusConflict, ScimType: "uniqueness", Detail: "group already exists"}
+	}
+
+	role := models.Role{Name: name}
+	if err := db.Create(&role).Error; err != nil {
+		return nil, err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "scim.group_create",
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("role_id=%d name=%q", role.ID, role.Name),
+	})
+
+	if err := setScimGroupMembers(&role, group.Members, ipAddress); err != nil {
+		return nil, err
+	}
+	return GetScimGroup(strconv.FormatUint(uint64(role.ID), 10))
+}
+
+// ReplaceScimGroup renames the role and replaces its members
+func ReplaceScimGroup(id string, group ScimGroup, ipAddress string) (*ScimGroup, error) {
+	role, err := findScimGroup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(group.DisplayName)
+	if name == "" {
+		return nil, scimBadRequest("invalidValue", "displayName is required")
+	}
+	if name != role.Name {
+		if err := renameScimGroup(role, name, ipAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := setScimGroupMembers(role, group.Members, ipAddress); err != nil {
+		return nil, err
+	}
+	return GetScimGroup(id)
+}
+
+// PatchScimGroup applies PATCH operations to the group. Member changes are
+// applied one by one rather than by replacing the member list, so large groups
+// can be updated without resending every member.
+func PatchScimGroup(id string, patch ScimPatchRequest, ipAddress string) (*ScimGroup, error) {
+	role, err := findScimGroup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range patch.Operations {
+		if err := applyScimGroupPatch(role, op, ipAddress); err != nil {
+			return nil, err
+		}
+	}
+	return GetScimGroup(id)
+}
+
+// DeleteScimGroup moves the role's members to the default role and deletes it
+func DeleteScimGroup(id, ipAddress string) error {
+	role, err := findScimGroup(id)
+	if err != nil {
+		return err
+	}
+	if role.Name == defaultRoleName || role.Name == "Admin" {
+		return scimBadRequest("mutability", "the %s group cannot be deleted", role.Name)
+	}
+
+	// Users the identity provider does not manage would be left without a role
+	members, err := roleMembers(role.ID)
+	if err != nil {
+		return err
+	}
+	for _, user := range members {
+		if !scimManaged(&user) {
+			return &ScimError{Status: http.StatusConflict, Detail: fmt.Sprintf("the %s group still has members not managed by the identity provider", role.Name)}
+		}
+	}
+
+	if err := setScimGroupMembers(role, nil, ipAddress); err != nil {
+		return err
+	}
+
+	db := config.GetDB()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Deleted accounts may still be restored, so they move to the default role too
+		err := tx.Model(&models.User{}).Where("role_id = ?", role.ID).
+			Update("role_id", tx.Model(&models.Role{}).Select("id").Where("name = ?", defaultRoleName)).Error
+		if err != nil {
+			return err
+		}
+		return tx.Select("Permissions").Delete(role).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "scim.group_delete",
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("role_id=%d name=%q", role.ID, role.Name),
+	})
+	return nil
+}
+
+func applyScimGroupPatch(role *models.Role, op ScimPatchOperation, ipAddress string) error {
+	operation := strings.ToLower(op.Op)
+	path := strings.ToLower(op.Path)
+
+	// Without a path the value is an object of attributes to set
+	if path == "" && operation != "remove" {
+		var values struct {
+			DisplayName json.RawMessage `json:"displayName"`
+			Members     json.RawMessage `json:"members"`
+		}
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return scimBadRequest("invalidValue", "patch value must be an object when no path is given")
+		}
+		if values.DisplayName != nil {
+			if err := applyScimGroupPatch(role, ScimPatchOperation{Op: operation, Path: "displayName", Value: values.DisplayName}, ipAddress); err != nil {
+				return err
+			}
+		}
+		if values.Members != nil {
+			return applyScimGroupPatch(role, ScimPatchOperation{Op: operation, Path: "members", Value: values.Members}, ipAddress)
+		}
+		return nil
+	}
+
+	if match := scimMemberPathPattern.FindStringSubmatch(op.Path); match != nil && operation == "remove" {
+		return removeScimGroupMembers(role, []ScimMultiValue{{Value: match[1]}}, ipAddress)
+	}
+
+	switch {
+	case path == "displayname" && (operation == "add" || operation == "replace"):
+		var name string
+		if err := scimString(op.Value, &name); err != nil {
+			return err
+		}
+		if name = strings.TrimSpace(name); name == "" {
+			return scimBadRequest("invalidValue", "displayName is required")
+		}
+		if name == role.Name {
+			return nil
+		}
+		return renameScimGroup(role, name, ipAddress)
+	case path == "members":
+		var members []ScimMultiValue
+		if len(op.Value) > 0 && string(op.Value) != "null" {
+			if err := json.Unmarshal(op.Value, &members); err != nil {
+				return scimBadRequest("invalidValue", "members must be an array")
+			}
+		}
+		switch operation {
+		case "add":
+			return addScimGroupMembers(role, members, ipAddress)
+		case "replace":
+			return setScimGroupMembers(role, members, ipAddress)
+		case "remove":
+			// Without a value every member is removed
+			if members == nil {
+				return setScimGroupMembers(role, nil, ipAddress)
+			}
+			return removeScimGroupMembers(role, members, ipAddress)
+		}
+	}
+	return scimBadRequest("invalidPath", "unsupported %s of %q", op.Op, op.Path)
+}
+
+func renameScimGroup(role *models.Role, name, ipAddress string) error {
+	if role.Name == defaultRoleName || role.Name == "Admin" {
+		return scimBadRequest("mutability", "the %s group cannot be renamed", role.Name)
+	}
+
+	db := config.GetDB()
+	var existing models.Role
+	if err := db.Where("name = ? AND id <> ?", name, role.ID).First(&existing).Error; err == nil {
+		return &ScimError{Status: http.StatusConflict, ScimType: "uniqueness", Detail: "group already exists"}
+	}
+	if err := db.Model(role).Update("name", name).Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "scim.group_update",
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("role_id=%d name=%q", role.ID, name),
+	})
+	return nil
+}
+
+// setScimGroupMembers makes members the exact member list of the role
+func setScimGroupMembers(role *models.Role, members []ScimMultiValue, ipAddress string) error {
+	current, err := roleMembers(role.ID)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{}
+	for _, member := range members {
+		keep[member.Value] = true
+	}
+	// Members the identity provider does not manage are not its to remove
+	var removed []ScimMultiValue
+	for _, user := range current {
+		if !scimManaged(&user) {
+			continue
+		}
+		if id := strconv.FormatUint(uint64(user.ID), 10); !keep[id] {
+			removed = append(removed, ScimMultiValue{Value: id})
+		}
+	}
+
+	if err := removeScimGroupMembers(role, removed, ipAddress); err != nil {
+		return err
+	}
+	return addScimGroupMembers(role, members, ipAddress)
+}
+
+func addScimGroupMembers(role *models.Role, members []ScimMultiValue, ipAddress string) error {
+	for _, member := range members {
+		user, err := findScimUser(member.Value)
+		if err != nil {
+			return scimBadRequest("invalidValue", "member %q not found", member.Value)
+		}
+		if err := setScimUserRole(user, role, ipAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeScimGroupMembers(role *models.Role, members []ScimMultiValue, ipAddress string) error {
+	if len(members) == 0 {
+		return nil
+	}
+
+	db := config.GetDB()
+	var defaultRole models.Role
+	if err := db.Where("name = ?", defaultRoleName).First(&defaultRole).Error; err != nil {
+		return errors.New("default role not found")
+	}
+	if role.ID == defaultRole.ID {
+		return scimBadRequest("mutability", "members cannot be removed from the %s group", defaultRoleName)
+	}
+
+	for _, member := range members {
+		user, err := findScimUser(member.Value)
+		// Removing someone who is not a member is not an error
+		if err != nil || user.RoleID != role.ID {
+			continue
+		}
+		if err := setScimUserRole(user, &defaultRole, ipAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setScimUserRole moves a user the identity provider manages into role. Admin
+// rights are granted and revoked in the app only.
+func setScimUserRole(user *models.User, role *models.Role, ipAddress string) error {
+	if user.RoleID == role.ID {
+		return nil
+	}
+	if !scimManaged(user) {
+		return errScimUserNotManaged
+	}
+	if utils.HasRole(user.Role.Name, "Admin") || utils.HasRole(role.Name, "Admin") {
+		return &ScimError{Status: http.StatusForbidden, Detail: "The Admin role is not managed by the identity provider"}
+	}
+	return setUserRole(user, role.ID, ipAddress)
+}
+
+func findScimGroup(id string) (*models.Role, error) {
+	roleID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, errScimGroupNotFound
+	}
+	db := config.GetDB()
+	var role models.Role
+	if err := db.First(&role, roleID).Error; err != nil {
+		return nil, errScimGroupNotFound
+	}
+	return &role, nil
+}
+
+func roleMembers(roleID uint) ([]models.User, error) {
+	db := config.GetDB()
+	var users []models.User
+	err := db.Where("role_id = ? AND deleted_at IS NULL", roleID).Order("id").Find(&users).Error
+	return users, err
+}
@@ -0,0 +1,615 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+
+	"gorm.io/gorm"
+)
+
+// SCIM 2.0 schema URNs (RFC 7643, RFC 7644)
+const (
+	ScimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	ScimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ScimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	ScimPatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+)
+
+// MaxScimResults caps the count of a SCIM list request
+const MaxScimResults = 200
+
+// ScimError is an error reported to the provisioning client with its HTTP status
+// and, for 400 and 409 responses, a scimType such as invalidFilter or uniqueness
+type ScimError struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *ScimError) Error() string {
+	return e.Detail
+}
+
+func scimBadRequest(scimType, format string, args ...interface{}) *ScimError {
+	return &ScimError{Status: http.StatusBadRequest, ScimType: scimType, Detail: fmt.Sprintf(format, args...)}
+}
+
+var errScimUserNotFound = &ScimError{Status: http.StatusNotFound, Detail: "User not found"}
+
+var errScimUserNotManaged = &ScimError{Status: http.StatusForbidden, Detail: "User is not managed by the identity provider"}
+
+type ScimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type ScimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// ScimMultiValue is an entry of a multi-valued attribute such as emails or members
+type ScimMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// ScimUser is the SCIM representation of models.User. Groups lists the user's
+// role and is read-only; roles are assigned through group membership.
+type ScimUser struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	ExternalID  string           `json:"externalId,omitempty"`
+	UserName    string           `json:"userName"`
+	Name        *ScimName        `json:"name,omitempty"`
+	DisplayName string           `json:"displayName,omitempty"`
+	Emails      []ScimMultiValue `json:"emails,omitempty"`
+	Active      *bool            `json:"active,omitempty"`
+	// Password is write-only and never returned
+	Password string           `json:"password,omitempty"`
+	Groups   []ScimMultiValue `json:"groups,omitempty"`
+	Meta     *ScimMeta        `json:"meta,omitempty"`
+}
+
+type ScimListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+type ScimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type ScimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []ScimPatchOperation `json:"Operations"`
+}
+
+// ScimListQuery holds the filter and 1-based paging of a list request
+type ScimListQuery struct {
+	Filter     string
+	StartIndex int
+	Count      int
+}
+
+// scimFilterPattern matches the `attribute eq "value"` filters identity providers send
+var scimFilterPattern = regexp.MustCompile(`^\s*([A-Za-z][\w.]*)\s+([A-Za-z]{2})\s+("(?:[^"\\]|\\.)*"|true|false|\d+)\s*$`)
+
+// scimUserFilterColumns maps filterable user attributes (lower-cased) to their columns
+var scimUserFilterColumns = map[string]string{
+	"id":           "id",
+	"username":     "username",
+	"externalid":   "external_id",
+	"emails":       "email",
+	"emails.value": "email",
+	"displayname":  "name",
+	"active":       "is_active",
+}
+
+// applyScimFilter restricts db to the resources matching filter. Only the eq
+// operator is supported.
+func applyScimFilter(db *gorm.DB, filter string, columns map[string]string) (*gorm.DB, error) {
+	if strings.TrimSpace(filter) == "" {
+		return db, nil
+	}
+
+	match := scimFilterPattern.FindStringSubmatch(filter)
+	if match == nil {
+		return nil, scimBadRequest("invalidFilter", "unsupported filter %q", filter)
+	}
+	column, ok := columns[strings.ToLower(match[1])]
+	if !ok {
+		return nil, scimBadRequest("invalidFilter", "cannot filter by %s", match[1])
+	}
+	if !strings.EqualFold(match[2], "eq") {
+		return nil, scimBadRequest("invalidFilter", "unsupported filter operator %s", match[2])
+	}
+
+	var value interface{} = match[3]
+	switch {
+	case strings.HasPrefix(match[3], `"`):
+		unquoted, err := strconv.Unquote(match[3])
+		if err != nil {
+			return nil, scimBadRequest("invalidFilter", "invalid filter value %s", match[3])
+		}
+		value = unquoted
+	case match[3] == "true" || match[3] == "false":
+		value = match[3] == "true"
+	}
+	return db.Where(column+" = ?", value), nil
+}
+
+// page applies the 1-based startIndex and count of q
+func (q ScimListQuery) page(db *gorm.DB) *gorm.DB {
+	return db.Offset(q.StartIndex - 1).Limit(q.Count)
+}
+
+// normalize clamps out of range paging values. A count of 0 asks only for totalResults.
+func (q *ScimListQuery) normalize() {
+	if q.StartIndex < 1 {
+		q.StartIndex = 1
+	}
+	if q.Count < 0 {
+		q.Count = 0
+	}
+	if q.Count > MaxScimResults {
+		q.Count = MaxScimResults
+	}
+}
+
+// NewScimUser converts a user to its SCIM representation
+func NewScimUser(user *models.User) ScimUser {
+	id := strconv.FormatUint(uint64(user.ID), 10)
+	active := user.IsActive
+	resource := ScimUser{
+		Schemas:     []string{ScimUserSchema},
+		ID:          id,
+		ExternalID:  user.ExternalID,
+		UserName:    user.Username,
+		DisplayName: user.Name,
+		Emails:      []ScimMultiValue{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &ScimMeta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     utils.AppURL("/scim/v2/Users/" + id),
+		},
+	}
+	if user.Name != "" {
+		resource.Name = &ScimName{Formatted: user.Name}
+	}
+	if user.RoleID != 0 {
+		roleID := strconv.FormatUint(uint64(user.RoleID), 10)
+		resource.Groups = []ScimMultiValue{{
+			Value:   roleID,
+			Display: user.Role.Name,
+			Ref:     utils.AppURL("/scim/v2/Groups/" + roleID),
+		}}
+	}
+	return resource
+}
+
+// primaryEmail returns the primary email of the resource, or its first one
+func (u *ScimUser) primaryEmail() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return normalizeEmail(email.Value)
+		}
+	}
+	if len(u.Emails) > 0 {
+		return normalizeEmail(u.Emails[0].Value)
+	}
+	return ""
+}
+
+// displayName prefers displayName, then the formatted name, then given and family names
+func (u *ScimUser) displayName() string {
+	if u.DisplayName != "" {
+		return strings.TrimSpace(u.DisplayName)
+	}
+	if u.Name == nil {
+		return ""
+	}
+	if u.Name.Formatted != "" {
+		return strings.TrimSpace(u.Name.Formatted)
+	}
+	return strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+}
+
+func (u *ScimUser) validate() error {
+	if strings.TrimSpace(u.UserName) == "" {
+		return scimBadRequest("invalidValue", "userName is required")
+	}
+	if !utils.ValidUsername(strings.TrimSpace(u.UserName)) {
+		return scimBadRequest("invalidValue", "userName must be 3-30 letters, digits, dots, dashes or underscores")
+	}
+	if !utils.ValidEmail(u.primaryEmail()) {
+		return scimBadRequest("invalidValue", "a valid email is required")
+	}
+	return nil
+}
+
+// ListScimUsers returns the users matching the query, leaving out deleted accounts
+func ListScimUsers(query ScimListQuery) (*ScimListResponse, error) {
+	query.normalize()
+	db := config.GetDB()
+
+	filtered := func() (*gorm.DB, error) {
+		return applyScimFilter(db.Model(&models.User{}).Where("deleted_at IS NULL"), query.Filter, scimUserFilterColumns)
+	}
+
+	counted, err := filtered()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	if err := counted.Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	var users []models.User
+	listed, _ := filtered()
+	if err := query.page(listed).Preload("Role").Order("id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	resources := make([]ScimUser, len(users))
+	for i := range users {
+		resources[i] = NewScimUser(&users[i])
+	}
+	return &ScimListResponse{
+		Schemas:      []string{ScimListSchema},
+		TotalResults: int(total),
+		StartIndex:   query.StartIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}, nil
+}
+
+// GetScimUser returns a user that has not been deleted
+func GetScimUser(id string) (*ScimUser, error) {
+	user, err := findScimUser(id)
+	if err != nil {
+		return nil, err
+	}
+	resource := NewScimUser(user)
+	return &resource, nil
+}
+
+// CreateScimUser provisions a user. Users created without a password can only
+// sign in once they set one through a password reset.
+func CreateScimUser(resource ScimUser, ipAddress string) (*ScimUser, error) {
+	if err := resource.validate(); err != nil {
+		return nil, err
+	}
+
+	user := models.User{
+		Username:   strings.TrimSpace(resource.UserName),
+		ExternalID: resource.ExternalID,
+		Name:       resource.displayName(),
+		Email:      resource.primaryEmail(),
+		AuthSource: "scim",
+		IsActive:   true,
+	}
+	if resource.Password != "" {
+		hash, err := scimPasswordHash(resource.Password, &user)
+		if err != nil {
+			return nil, err
+		}
+		user.PasswordHash = hash
+	}
+
+	err := CreateUser(&user)
+	if errors.Is(err, ErrUsernameExists) || errors.Is(err, ErrEmailExists) {
+		return nil, &ScimError{Status: http.StatusConflict, ScimType: "uniqueness", Detail: err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "scim.user_create",
+		SubjectID: user.ID,
+		IPAddress: ipAddress,
+	})
+
+	if resource.Active != nil && !*resource.Active {
+		if err := setScimUserActive(user.ID, false, ipAddress); err != nil {
+			return nil, err
+		}
+	}
+	return GetScimUser(strconv.FormatUint(uint64(user.ID), 10))
+}
+
+// ReplaceScimUser overwrites the user's attributes with those of resource
+func ReplaceScimUser(id string, resource ScimUser, ipAddress string) (*ScimUser, error) {
+	user, err := findScimWritableUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := resource.validate(); err != nil {
+		return nil, err
+	}
+
+	username := strings.TrimSpace(resource.UserName)
+	email := resource.primaryEmail()
+	if UsernameTaken(username, user.ID) {
+		return nil, &ScimError{Status: http.StatusConflict, ScimType: "uniqueness", Detail: ErrUsernameExists.Error()}
+	}
+	if emailTaken(email, user.ID) {
+		return nil, &ScimError{Status: http.StatusConflict, ScimType: "uniqueness", Detail: ErrEmailExists.Error()}
+	}
+
+	// The identity provider owns these attributes, so email changes skip confirmation
+	updates := map[string]interface{}{
+		"username":    username,
+		"external_id": resource.ExternalID,
+		"name":        resource.displayName(),
+		"email":       email,
+	}
+	if resource.Password != "" {
+		// Accounts linked by externalId keep the password their owner chose
+		if user.AuthSource != "scim" {
+			return nil, scimBadRequest("mutability", "the password of this user is not managed by the identity provider")
+		}
+		hash, err := scimPasswordHash(resource.Password, user)
+		if err != nil {
+			return nil, err
+		}
+		updates["password_hash"] = hash
+	}
+
+	db := config.GetDB()
+	if err := db.Model(&models.User{}).Where("id = ?", user.ID).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "scim.user_update",
+		SubjectID: user.ID,
+		IPAddress: ipAddress,
+	})
+
+	if resource.Active != nil {
+		if err := setScimUserActive(user.ID, *resource.Active, ipAddress); err != nil {
+			return nil, err
+		}
+	}
+	return GetScimUser(id)
+}
+
+// PatchScimUser applies PATCH operations to the user's representation and saves the result
+func PatchScimUser(id string, patch ScimPatchRequest, ipAddress string) (*ScimUser, error) {
+	current, err := GetScimUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply to a copy that leaves out read-only attributes and the password.
+	// active reflects admin suspensions too, so it is only sent when patched.
+	resource := *current
+	resource.Groups, resource.Meta, resource.Active = nil, nil, nil
+	for _, op := range patch.Operations {
+		if err := resource.applyPatch(op); err != nil {
+			return nil, err
+		}
+	}
+	return ReplaceScimUser(id, resource, ipAddress)
+}
+
+// DeleteScimUser deletes the account, starting the usual restore grace period
+func DeleteScimUser(id, ipAddress string) error {
+	user, err := findScimWritableUser(id)
+	if err != nil {
+		return err
+	}
+	_, err = DeleteAccount(user.ID, 0, "Deprovisioned by identity provider", ipAddress)
+	return err
+}
+
+const scimDeactivationReason = "Deactivated by identity provider"
+
+// setScimUserActive toggles the identity provider's own suspension so sessions
+// end and the change is audited. Admin suspensions are left alone either way.
+func setScimUserActive(userID uint, active bool, ipAddress string) error {
+	suspension := activeSuspensionFrom(userID, SuspensionSourceScim)
+	if !active && suspension == nil {
+		_, err := suspendUser(userID, 0, SuspensionSourceScim, scimDeactivationReason, nil, ipAddress)
+		return err
+	}
+	if active && suspension != nil {
+		return liftSuspension(suspension, 0, "scim.user_reactivate", ipAddress)
+	}
+	return nil
+}
+
+func findScimUser(id string) (*models.User, error) {
+	userID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, errScimUserNotFound
+	}
+	user, err := FindUserByID(uint(userID))
+	if err != nil || user.DeletedAt != nil {
+		return nil, errScimUserNotFound
+	}
+	return user, nil
+}
+
+// findScimWritableUser returns a user the identity provider may change: one it
+// provisioned or one linked to it by externalId. Admins are never changed
+// through SCIM, so a leaked token cannot take over or lock out an admin.
+func findScimWritableUser(id string) (*models.User, error) {
+	user, err := findScimUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if !scimManaged(user) || utils.HasRole(user.Role.Name, "Admin") {
+		return nil, errScimUserNotManaged
+	}
+	return user, nil
+}
+
+func scimManaged(user *models.User) bool {
+	return user.AuthSource == "scim" || user.ExternalID != ""
+}
+
+// scimPasswordHash applies the password policy to a password pushed by the identity provider
+func scimPasswordHash(password string, user *models.User) (string, error) {
+	if err := utils.DefaultPasswordPolicy().Validate(password, user.Username, user.Email); err != nil {
+		return "", scimBadRequest("invalidValue", "%s", err.Error())
+	}
+	return utils.HashPassword(password)
+}
+
+// applyPatch applies one PATCH operation. Identity providers differ in casing
+// and value types, so op and paths are matched case-insensitively and
+// booleans may arrive as strings.
+func (u *ScimUser) applyPatch(op ScimPatchOperation) error {
+	operation := strings.ToLower(op.Op)
+	if operation != "add" && operation != "replace" && operation != "remove" {
+		return scimBadRequest("invalidSyntax", "unsupported patch operation %q", op.Op)
+	}
+
+	// Without a path the value is an object of attributes to set
+	if op.Path == "" {
+		if operation == "remove" {
+			return scimBadRequest("noTarget", "remove requires a path")
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return scimBadRequest("invalidValue", "patch value must be an object when no path is given")
+		}
+		for path, value := range values {
+			if path == "schemas" || path == "id" || path == "meta" {
+				continue
+			}
+			if err := u.applyPatch(ScimPatchOperation{Op: operation, Path: path, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	path := strings.TrimPrefix(strings.ToLower(op.Path), strings.ToLower(ScimUserSchema)+":")
+	// emails[type eq "work"].value and similar target the single email we keep
+	if strings.HasPrefix(path, "emails[") {
+		path = "emails.value"
+	}
+	// Extension schemas such as the enterprise user are not stored
+	if strings.HasPrefix(path, "urn:") {
+		return nil
+	}
+
+	if operation == "remove" {
+		switch path {
+		case "externalid":
+			u.ExternalID = ""
+		case "displayname":
+			u.DisplayName = ""
+		case "name", "name.formatted", "name.givenname", "name.familyname":
+			u.DisplayName, u.Name = "", nil
+		default:
+			return scimBadRequest("mutability", "%s cannot be removed", op.Path)
+		}
+		return nil
+	}
+
+	switch path {
+	case "username":
+		return scimString(op.Value, &u.UserName)
+	case "externalid":
+		return scimString(op.Value, &u.ExternalID)
+	case "displayname":
+		return scimString(op.Value, &u.DisplayName)
+	case "password":
+		return scimString(op.Value, &u.Password)
+	case "active":
+		active, err := scimBool(op.Value)
+		if err != nil {
+			return err
+		}
+		u.Active = &active
+	case "name":
+		var name ScimName
+		if err := json.Unmarshal(op.Value, &name); err != nil {
+			return scimBadRequest("invalidValue", "name must be an object")
+		}
+		u.DisplayName, u.Name = "", &name
+	case "name.formatted", "name.givenname", "name.familyname":
+		if u.Name == nil {
+			u.Name = &ScimName{}
+		}
+		// Rebuild the formatted name from its parts unless it is set directly
+		u.DisplayName = ""
+		switch path {
+		case "name.formatted":
+			return scimString(op.Value, &u.Name.Formatted)
+		case "name.givenname":
+			u.Name.Formatted = ""
+			return scimString(op.Value, &u.Name.GivenName)
+		default:
+			u.Name.Formatted = ""
+			return scimString(op.Value, &u.Name.FamilyName)
+		}
+	case "emails":
+		var emails []ScimMultiValue
+		if err := json.Unmarshal(op.Value, &emails); err != nil || len(emails) == 0 {
+			return scimBadRequest("invalidValue", "emails must be a non-empty array")
+		}
+		u.Emails = emails
+	case "emails.value":
+		var email string
+		if err := scimString(op.Value, &email); err != nil {
+			return err
+		}
+		u.Emails = []ScimMultiValue{{Value: email, Type: "work", Primary: true}}
+	case "groups":
+		return scimBadRequest("mutability", "groups is read-only, change group membership instead")
+	default:
+		return scimBadRequest("invalidPath", "unsupported path %q", op.Path)
+	}
+	return nil
+}
+
+func scimString(raw json.RawMessage, target *string) error {
+	if err := json.Unmarshal(raw, target); err != nil {
+		return scimBadRequest("invalidValue", "expected a string value")
+	}
+	return nil
+}
+
+func scimBool(raw json.RawMessage) (bool, error) {
+	var value bool
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if value, err := strconv.ParseBool(text); err == nil {
+			return value, nil
+		}
+	}
+	return false, scimBadRequest("invalidValue", "expected a boolean value")
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+)
+
+func scimID(user *models.User) string {
+	return strconv.FormatUint(uint64(user.ID), 10)
+}
+
+func scimStatus(err error) int {
+	var scimErr *ScimError
+	if errors.As(err, &scimErr) {
+		return scimErr.Status
+	}
+	return 0
+}
+
+func TestApplyScimFilter(t *testing.T) {
+	db := testutil.NewDB(t)
+	testutil.CreateUser(t, db, "alice", "Viewer")
+	bob := testutil.CreateUser(t, db, "bob", "Viewer")
+	db.Model(bob).Updates(map[string]interface{}{"external_id": "ext-bob", "is_active": false})
+
+	tests := []struct {
+		filter string
+		want   int
+		status int
+	}{
+		{filter: "", want: 2},
+		{filter: `userName eq "alice"`, want: 1},
+		{filter: `USERNAME EQ "alice"`, want: 1},
+		{filter: `emails.value eq "bob@example.com"`, want: 1},
+		{filter: `externalId eq "ext-bob"`, want: 1},
+		{filter: `active eq false`, want: 1},
+		{filter: `userName eq "carol"`, want: 0},
+		{filter: `userName eq "a\" OR 1=1 --"`, want: 0},
+		{filter: `userName co "a"`, status: http.StatusBadRequest},
+		{filter: `passwordHash eq "x"`, status: http.StatusBadRequest},
+		{filter: `userName eq "a" or userName eq "b"`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		list, err := ListScimUsers(ScimListQuery{Filter: tt.filter, Count: 10})
+		if tt.status != 0 {
+			if scimStatus(err) != tt.status {
+				t.Errorf("%s: err = %v, want status %d", tt.filter, err, tt.status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		if list.TotalResults != tt.want {
+			t.Errorf("%s: totalResults = %d, want %d", tt.filter, list.TotalResults, tt.want)
+		}
+	}
+}
+
+func TestScimWritesOnlyManagedUsers(t *testing.T) {
+	db := testutil.NewDB(t)
+	local := testutil.CreateUser(t, db, "local", "Editor")
+	linked := testutil.CreateUser(t, db, "linked", "Viewer")
+	db.Model(linked).Update("external_id", "ext-linked")
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	db.Model(admin).Update("external_id", "ext-admin")
+
+	replacement := ScimUser{UserName: "renamed", Emails: []ScimMultiValue{{Value: "renamed@example.com", Primary: true}}}
+	for _, user := range []*models.User{local, admin} {
+		if _, err := ReplaceScimUser(scimID(user), replacement, ""); scimStatus(err) != http.StatusForbidden {
+			t.Errorf("replace %s: err = %v, want 403", user.Username, err)
+		}
+		patch := ScimPatchRequest{Operations: []ScimPatchOperation{{Op: "replace", Path: "active", Value: []byte("false")}}}
+		if _, err := PatchScimUser(scimID(user), patch, ""); scimStatus(err) != http.StatusForbidden {
+			t.Errorf("patch %s: err = %v, want 403", user.Username, err)
+		}
+		if err := DeleteScimUser(scimID(user), ""); scimStatus(err) != http.StatusForbidden {
+			t.Errorf("delete %s: err = %v, want 403", user.Username, err)
+		}
+	}
+	reloaded, _ := FindUserByID(local.ID)
+	if reloaded.Username != "local" || !reloaded.IsActive || reloaded.DeletedAt != nil {
+		t.Errorf("local user changed: %+v", reloaded)
+	}
+
+	// Linked local accounts may be updated, but keep their own password
+	replacement.ExternalID = "ext-linked"
+	if _, err := ReplaceScimUser(scimID(linked), replacement, ""); err != nil {
+		t.Fatal(err)
+	}
+	replacement.Password = "a much better passphrase"
+	if _, err := ReplaceScimUser(scimID(linked), replacement, ""); scimStatus(err) != http.StatusBadRequest {
+		t.Errorf("password of linked user: err = %v, want 400", err)
+	}
+}
+
+func TestScimProvisionedUser(t *testing.T) {
+	testutil.NewDB(t)
+
+	created, err := CreateScimUser(ScimUser{
+		UserName: "carol",
+		Emails:   []ScimMultiValue{{Value: "carol@example.com", Primary: true}},
+		Password: "correct horse battery staple",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := FindUserByEmail("carol@example.com")
+	if err != nil || user.AuthSource != "scim" {
+		t.Fatalf("user = %+v, %v", user, err)
+	}
+
+	// Provisioned users sign in with the local password
+	if _, err := authenticateWith([]AuthBackend{LocalAuthBackend{}}, "carol@example.com", "correct horse battery staple"); err != nil {
+		t.Errorf("authenticate: %v", err)
+	}
+
+	created.Password = "another strong passphrase"
+	if _, err := ReplaceScimUser(created.ID, *created, ""); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = FindUserByID(user.ID)
+	if !utils.CheckPasswordHash("another strong passphrase", user.PasswordHash) {
+		t.Error("password was not replaced")
+	}
+
+	if err := DeleteScimUser(created.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScimActiveLeavesAdminSuspensions(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	db := testutil.NewDB(t)
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	created, err := CreateScimUser(ScimUser{UserName: "dave", Emails: []ScimMultiValue{{Value: "dave@example.com", Primary: true}}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := FindUserByEmail("dave@example.com")
+	setActive := func(active string) {
+		t.Helper()
+		patch := ScimPatchRequest{Operations: []ScimPatchOperation{{Op: "replace", Path: "active", Value: []byte(active)}}}
+		if _, err := PatchScimUser(created.ID, patch, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := SuspendUser(user.ID, admin.ID, "spam", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	setActive("true")
+	if IsUserActive(user.ID) {
+		t.Error("identity provider lifted an admin suspension")
+	}
+
+	// Patching other attributes does not turn the admin suspension into a deactivation
+	rename := ScimPatchRequest{Operations: []ScimPatchOperation{{Op: "replace", Path: "displayName", Value: []byte(`"Dave"`)}}}
+	if _, err := PatchScimUser(created.ID, rename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if activeSuspensionFrom(user.ID, SuspensionSourceScim) != nil {
+		t.Error("rename deactivated the user")
+	}
+
+	setActive("false")
+	if err := ReactivateUser(user.ID, admin.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if IsUserActive(user.ID) {
+		t.Error("admin reactivation lifted the identity provider's deactivation")
+	}
+	setActive("true")
+	if !IsUserActive(user.ID) {
+		t.Error("user is not active once both suspensions are lifted")
+	}
+
+	var audits int64
+	db.Model(&models.AuditLog{}).Where("subject_id = ? AND action IN ?", user.ID, []string{"scim.user_deactivate", "scim.user_reactivate"}).Count(&audits)
+	if audits != 2 {
+		t.Errorf("scim audit entries = %d, want 2", audits)
+	}
+}
+
+func TestScimGroupsKeepAdminOffLimits(t *testing.T) {
+	db := testutil.NewDB(t)
+	adminRole := testutil.Role(t, db, "Admin")
+	editorRole := testutil.Role(t, db, "Editor")
+	admins := strconv.FormatUint(uint64(adminRole.ID), 10)
+	editors := strconv.FormatUint(uint64(editorRole.ID), 10)
+
+	managed := testutil.CreateUser(t, db, "managed", "Viewer")
+	db.Model(managed).Update("external_id", "ext-managed")
+	local := testutil.CreateUser(t, db, "local", "Viewer")
+	localEditor := testutil.CreateUser(t, db, "localeditor", "Editor")
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	db.Model(admin).Update("external_id", "ext-admin")
+
+	add := func(group, id string) error {
+		patch := ScimPatchRequest{Operations: []ScimPatchOperation{{
+			Op: "add", Path: "members", Value: []byte(`[{"value":"` + id + `"}]`),
+		}}}
+		_, err := PatchScimGroup(group, patch, "")
+		return err
+	}
+
+	if err := add(admins, scimID(managed)); scimStatus(err) != http.StatusForbidden {
+		t.Errorf("grant admin: err = %v, want 403", err)
+	}
+	if err := add(editors, scimID(admin)); scimStatus(err) != http.StatusForbidden {
+		t.Errorf("demote admin: err = %v, want 403", err)
+	}
+	if err := add(editors, scimID(local)); scimStatus(err) != http.StatusForbidden {
+		t.Errorf("promote local user: err = %v, want 403", err)
+	}
+	if err := add(editors, scimID(managed)); err != nil {
+		t.Fatalf("promote managed user: %v", err)
+	}
+
+	// Replacing the members leaves users the identity provider does not manage alone
+	patch := ScimPatchRequest{Operations: []ScimPatchOperation{{Op: "replace", Path: "members", Value: []byte(`[]`)}}}
+	if _, err := PatchScimGroup(editors, patch, ""); err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[*models.User]string{managed: "Viewer", localEditor: "Editor", admin: "Admin", local: "Viewer"} {
+		reloaded, _ := FindUserByID(user.ID)
+		if reloaded.Role.Name != want {
+			t.Errorf("%s role = %s, want %s", user.Username, reloaded.Role.Name, want)
+		}
+	}
+}
+
+func TestDeleteScimGroupKeepsLocalMembers(t *testing.T) {
+	db := testutil.NewDB(t)
+	managed := testutil.CreateUser(t, db, "managed", "Viewer")
+	db.Model(managed).Update("external_id", "ext-managed")
+	deleted := testutil.CreateUser(t, db, "deleted", "Viewer")
+	db.Model(deleted).Update("external_id", "ext-deleted")
+	local := testutil.CreateUser(t, db, "local", "Viewer")
+
+	group, err := CreateScimGroup(ScimGroup{
+		DisplayName: "Support",
+		Members:     []ScimMultiValue{{Value: scimID(managed)}, {Value: scimID(deleted)}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	support, _ := findScimGroup(group.ID)
+	db.Model(&models.User{}).Where("id = ?", local.ID).Update("role_id", support.ID)
+	db.Model(deleted).Update("deleted_at", time.Now())
+
+	if err := DeleteScimGroup(group.ID, ""); scimStatus(err) != http.StatusConflict {
+		t.Fatalf("delete with local members: err = %v, want 409", err)
+	}
+	reloaded, _ := FindUserByID(managed.ID)
+	if reloaded.RoleID != support.ID {
+		t.Error("refused delete still removed members")
+	}
+
+	db.Model(&models.User{}).Where("id = ?", local.ID).Update("role_id", testutil.Role(t, db, "Viewer").ID)
+	if err := DeleteScimGroup(group.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []*models.User{managed, deleted} {
+		reloaded, _ := FindUserByID(user.ID)
+		if reloaded.Role.Name != "Viewer" {
+			t.Errorf("%s role = %q, want Viewer", user.Username, reloaded.Role.Name)
+		}
+	}
+}
+
+func TestScimUserNameValidation(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "managed", "Viewer")
+	db.Model(user).Update("external_id", "ext-managed")
+
+	for _, userName := range []string{"ab", "has space", "<script>", strings.Repeat("a", 31)} {
+		resource := ScimUser{UserName: userName, Emails: []ScimMultiValue{{Value: "new@example.com", Primary: true}}}
+		if _, err := CreateScimUser(resource, ""); scimStatus(err) != http.StatusBadRequest {
+			t.Errorf("create %q: err = %v, want 400", userName, err)
+		}
+		if _, err := ReplaceScimUser(scimID(user), resource, ""); scimStatus(err) != http.StatusBadRequest {
+			t.Errorf("replace %q: err = %v, want 400", userName, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+)
+
+// How often LastSeenAt is written back while a session is in use
+const sessionTouchInterval = time.Minute
+
+func CreateSession(userID uint, userAgent, ipAddress string, ttl time.Duration) (*models.Session, error) {
+	db := config.GetDB()
+	now := time.Now()
+	session := models.Session{
+		UserID:     userID,
+		Device:     utils.DescribeDevice(userAgent),
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	err := db.Create(&session).Error
+	return &session, err
+}
+
+// TouchSession checks that the session belongs to the user and is still active,
+// and records that it was just used
+func TouchSession(sessionID, userID uint, ipAddress string) error {
+	db := config.GetDB()
+
+	var session models.Session
+	if err := db.Where("user_id = ?", userID).First(&session, sessionID).Error; err != nil {
+		return errors.New("session not found")
+	}
+	if !session.IsActive() {
+		return errors.New("session is no longer active")
+	}
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		return db.Model(&session).Updates(map[string]interface{}{
+			"last_seen_at": time.Now(),
+			"ip_address":   ipAddress,
+		}).Error
+	}
+	return nil
+}
+
+func ListActiveSessions(userID uint) ([]models.Session, error) {
+	db := config.GetDB()
+	var sessions []models.Session
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+func RevokeSession(userID, sessionID, actorID uint, ipAddress string) error {
+	db := config.GetDB()
+
+	var session models.Session
+	if err := db.Where("user_id = ?", userID).First(&session, sessionID).Error; err != nil {
+		return errors.New("session not found")
+	}
+	if session.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	session.RevokedAt = &now
+	if err := db.Save(&session).Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "session.revoke",
+		ActorID:   actorID,
+		SubjectID: userID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("session_id=%d", sessionID),
+	})
+	return nil
+}
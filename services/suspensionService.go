@@ -0,0 +1,217 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+)
+
+// Sources of suspensions
+const (
+	SuspensionSourceAdmin = "admin"
+	SuspensionSourceScim  = "scim"
+)
+
+// SuspendUser deactivates the user, ends their sessions and notifies them.
+// A nil endsAt keeps the user suspended until an admin reactivates them.
+func SuspendUser(userID, actorID uint, reason string, endsAt *time.Time, ipAddress string) (*models.Suspension, error) {
+	if userID == actorID {
+		return nil, errors.New("cannot suspend yourself")
+	}
+	return suspendUser(userID, actorID, SuspensionSourceAdmin, reason, endsAt, ipAddress)
+}
+
+func suspendUser(userID, actorID uint, source, reason string, endsAt *time.Time, ipAddress string) (*models.Suspension, error) {
+	if endsAt != nil && endsAt.Before(time.Now()) {
+		return nil, errors.New("suspension end date must be in the future")
+	}
+
+	user, err := FindUserByID(userID)
+	if err != nil || user.DeletedAt != nil {
+		return nil, errors.New("user not found")
+	}
+	if activeSuspensionFrom(userID, source) != nil {
+		return nil, errors.New("user is already suspended")
+	}
+
+	db := config.GetDB()
+	now := time.Now()
+	suspension := models.Suspension{
+		UserID:        userID,
+		Source:        source,
+		SuspendedByID: actorID,
+		Reason:        reason,
+		EndsAt:        endsAt,
+	}
+
+	tx := db.Begin()
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("is_active", false).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Live tokens stop working with their sessions
+	err = tx.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Model(&models.ImpersonationSession{}).
+		Where("subject_id = ? AND ended_at IS NULL", userID).
+		Update("ended_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Create(&suspension).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	until := "until further notice"
+	if endsAt != nil {
+		until = "until " + endsAt.Format(time.RFC1123)
+	}
+	action := "user.suspend"
+	if source == SuspensionSourceScim {
+		action = "scim.user_deactivate"
+	}
+	RecordAudit(models.AuditLog{
+		Action:    action,
+		ActorID:   actorID,
+		SubjectID: userID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("reason=%q %s", reason, until),
+	})
+
+	body := fmt.Sprintf("Hi %s,\n\nYour account has been suspended %s.\n\nReason: %s", user.Username, until, reason)
+	if err := utils.SendEmail(user.Email, "Your account has been suspended", body); err != nil {
+		log.Printf("Error sending suspension email: %v", err)
+	}
+	return &suspension, nil
+}
+
+// ReactivateUser lifts the user's admin suspension. Deactivation by the
+// identity provider stays in place until it reactivates the user.
+func ReactivateUser(userID, actorID uint, ipAddress string) error {
+	suspension := activeSuspensionFrom(userID, SuspensionSourceAdmin)
+	if suspension == nil {
+		return errors.New("user is not suspended")
+	}
+	return liftSuspension(suspension, actorID, "user.reactivate", ipAddress)
+}
+
+// liftSuspension ends the suspension. The user becomes active again once no
+// other suspension is left.
+func liftSuspension(suspension *models.Suspension, actorID uint, action, ipAddress string) error {
+	user, err := FindUserByID(suspension.UserID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	db := config.GetDB()
+	now := time.Now()
+	tx := db.Begin()
+
+	// Claim the suspension so the expiry job and an admin cannot both lift it
+	result := tx.Model(&models.Suspension{}).Where("id = ? AND lifted_at IS NULL", suspension.ID).
+		Updates(map[string]interface{}{"lifted_at": now, "lifted_by_id": actorID})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		tx.Rollback()
+		return errors.New("user is not suspended")
+	}
+
+	// Deleted accounts and accounts with another suspension stay inactive
+	var remaining int64
+	if err := tx.Model(&models.Suspension{}).Where("user_id = ? AND lifted_at IS NULL", user.ID).Count(&remaining).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if remaining == 0 {
+		err = tx.Model(&models.User{}).Where("id = ? AND deleted_at IS NULL", user.ID).Update("is_active", true).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    action,
+		ActorID:   actorID,
+		SubjectID: user.ID,
+		IPAddress: ipAddress,
+		Details:   "source=" + suspension.Source,
+	})
+
+	if remaining == 0 {
+		body := fmt.Sprintf("Hi %s,\n\nYour account suspension has been lifted and you can sign in again.", user.Username)
+		if err := utils.SendEmail(user.Email, "Your account has been reactivated", body); err != nil {
+			log.Printf("Error sending reactivation email: %v", err)
+		}
+	}
+	return nil
+}
+
+// IsUserActive reports whether the user may use the service
+func IsUserActive(userID uint) bool {
+	db := config.GetDB()
+	var user models.User
+	err := db.Select("id", "is_active").Where("deleted_at IS NULL").First(&user, userID).Error
+	return err == nil && user.IsActive
+}
+
+// RunSuspensionExpiryJob lifts suspensions whose end date has passed, checking every interval
+func RunSuspensionExpiryJob(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if db := config.GetDB(); db != nil {
+			var expired []models.Suspension
+			db.Where("lifted_at IS NULL AND ends_at IS NOT NULL AND ends_at <= ?", time.Now()).Find(&expired)
+			for i := range expired {
+				suspension := &expired[i]
+				if err := liftSuspension(suspension, 0, "user.suspension_expired", ""); err != nil {
+					log.Printf("Error lifting suspension %d: %v", suspension.ID, err)
+				}
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func activeSuspension(userID uint) *models.Suspension {
+	db := config.GetDB()
+	var suspension models.Suspension
+	if err := db.Where("user_id = ? AND lifted_at IS NULL", userID).First(&suspension).Error; err != nil {
+		return nil
+	}
+	return &suspension
+}
+
+func activeSuspensionFrom(userID uint, source string) *models.Suspension {
+	db := config.GetDB()
+	var suspension models.Suspension
+	if err := db.Where("user_id = ? AND source = ? AND lifted_at IS NULL", userID, source).First(&suspension).Error; err != nil {
+		return nil
+	}
+	return &suspension
+}
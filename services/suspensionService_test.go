@@ -0,0 +1,102 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+)
+
+func TestSuspendAndReactivateUser(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	db := testutil.NewDB(t)
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	session, _ := CreateSession(user.ID, "test", "127.0.0.1", time.Hour)
+
+	past := time.Now().Add(-time.Minute)
+	if _, err := SuspendUser(user.ID, admin.ID, "spam", &past, ""); err == nil {
+		t.Error("suspended until a past date")
+	}
+	if _, err := SuspendUser(admin.ID, admin.ID, "oops", nil, ""); err == nil {
+		t.Error("admin suspended themselves")
+	}
+
+	if _, err := SuspendUser(user.ID, admin.ID, "spam", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if IsUserActive(user.ID) {
+		t.Error("suspended user is active")
+	}
+	db.First(session, session.ID)
+	if session.IsActive() {
+		t.Error("session of a suspended user is still active")
+	}
+	if _, err := SuspendUser(user.ID, admin.ID, "again", nil, ""); err == nil {
+		t.Error("suspended an already suspended user")
+	}
+
+	if err := ReactivateUser(user.ID, admin.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !IsUserActive(user.ID) {
+		t.Error("reactivated user is not active")
+	}
+	if err := ReactivateUser(user.ID, admin.ID, ""); err == nil {
+		t.Error("reactivated a user that is not suspended")
+	}
+
+	var suspension models.Suspension
+	db.Where("user_id = ?", user.ID).First(&suspension)
+	if suspension.LiftedAt == nil || suspension.LiftedByID != admin.ID {
+		t.Errorf("suspension = %+v", suspension)
+	}
+}
+
+func TestReactivateDeletedUser(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	db := testutil.NewDB(t)
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+	if _, err := SuspendUser(user.ID, 0, "expired trial", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A suspension expiring after the account was deleted leaves it inactive
+	db.Model(&models.User{}).Where("id = ?", user.ID).Update("deleted_at", time.Now())
+	if err := ReactivateUser(user.ID, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	var reloaded models.User
+	db.First(&reloaded, user.ID)
+	if reloaded.IsActive || IsUserActive(user.ID) {
+		t.Error("deleted user was reactivated")
+	}
+}
+
+func TestExpiredSuspensionKeepsOtherSuspensions(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	db := testutil.NewDB(t)
+	admin := testutil.CreateUser(t, db, "admin", "Admin")
+	user := testutil.CreateUser(t, db, "alice", "Viewer")
+
+	endsAt := time.Now().Add(time.Hour)
+	suspension, err := SuspendUser(user.ID, admin.ID, "cool off", &endsAt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := suspendUser(user.ID, 0, SuspensionSourceScim, scimDeactivationReason, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The admin's suspension runs out while the identity provider's remains
+	if err := liftSuspension(suspension, 0, "user.suspension_expired", ""); err != nil {
+		t.Fatal(err)
+	}
+	if IsUserActive(user.ID) {
+		t.Error("user reactivated while deactivated by the identity provider")
+	}
+	if err := liftSuspension(suspension, 0, "user.suspension_expired", ""); err == nil {
+		t.Error("lifted the same suspension twice")
+	}
+}
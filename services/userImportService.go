@@ -0,0 +1,282 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"hells/config"
+	"hells/models"
+	"hells/utils"
+
+	"gorm.io/gorm"
+)
+
+// MaxUserImportRows caps the size of a single import
+const MaxUserImportRows = 10000
+
+// Import row outcomes
+const (
+	ImportStatusCreated     = "created"
+	ImportStatusWouldCreate = "would_create"
+	ImportStatusDuplicate   = "duplicate"
+	ImportStatusInvalid     = "invalid"
+)
+
+// errImportRejected rolls back an import that contains invalid rows
+var errImportRejected = errors.New("import rejected")
+
+// UserImportRow is one user to import. Without a password hash the user is
+// emailed a link to choose a password.
+type UserImportRow struct {
+	Username     string `json:"username"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	Role         string `json:"role"`
+	PasswordHash string `json:"password_hash"`
+}
+
+type UserImportOptions struct {
+	// DryRun validates every row and checks for duplicates without saving anything
+	DryRun    bool
+	ActorID   uint
+	IPAddress string
+}
+
+type UserImportResult struct {
+	// Row is the 1-based position of the row in the input, not counting a CSV header
+	Row        int      `json:"row"`
+	Username   string   `json:"username"`
+	Email      string   `json:"email"`
+	Status     string   `json:"status"`
+	Errors     []string `json:"errors,omitempty"`
+	UserID     uint     `json:"user_id,omitempty"`
+	EmailError string   `json:"email_error,omitempty"`
+}
+
+type UserImportReport struct {
+	DryRun bool `json:"dry_run"`
+	// Committed is false when the import was a dry run or was rejected
+	Committed  bool               `json:"committed"`
+	Created    int                `json:"created"`
+	Duplicates int                `json:"duplicates"`
+	Invalid    int                `json:"invalid"`
+	Rows       []UserImportResult `json:"rows"`
+}
+
+// ParseUserImport reads import rows from CSV with a header line or from a JSON array
+func ParseUserImport(r io.Reader, format string) ([]UserImportRow, error) {
+	var rows []UserImportRow
+
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r).Decode(&rows); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	case "csv":
+		reader := csv.NewReader(r)
+		reader.TrimLeadingSpace = true
+		// Short rows are reported by validation rather than failing the parse
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV header: %v", err)
+		}
+
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		for _, required := range []string{"username", "email"} {
+			if _, ok := columns[required]; !ok {
+				return nil, fmt.Errorf("CSV header is missing the %s column", required)
+			}
+		}
+		field := func(record []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid CSV: %v", err)
+			}
+			rows = append(rows, UserImportRow{
+				Username:     field(record, "username"),
+				Name:         field(record, "name"),
+				Email:        field(record, "email"),
+				Role:         field(record, "role"),
+				PasswordHash: field(record, "password_hash"),
+			})
+			if len(rows) > MaxUserImportRows {
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported import format %q", format)
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("no rows to import")
+	}
+	if len(rows) > MaxUserImportRows {
+		return nil, fmt.Errorf("an import may contain at most %d rows", MaxUserImportRows)
+	}
+	return rows, nil
+}
+
+// ImportUsers creates the users in one transaction. Rows whose username or email
+// is already taken are reported as duplicates and skipped; any invalid row
+// rejects the whole import. A dry run goes through the same steps and rolls back.
+func ImportUsers(rows []UserImportRow, opts UserImportOptions) (*UserImportReport, error) {
+	db := config.GetDB()
+	report := &UserImportReport{DryRun: opts.DryRun, Rows: make([]UserImportResult, len(rows))}
+	created := make([]*models.User, len(rows))
+
+	roles := map[string]uint{}
+	roleID := func(name string) (uint, error) {
+		if id, ok := roles[name]; ok {
+			return id, nil
+		}
+		var role models.Role
+		if err := db.Where("name = ?", name).First(&role).Error; err != nil {
+			return 0, err
+		}
+		roles[name] = role.ID
+		return role.ID, nil
+	}
+
+	// Validate every row before the transaction opens, so no row locks are
+	// held while checking. Hashes are only parsed and bounds-checked, never computed.
+	users := make([]*models.User, len(rows))
+	for i, row := range rows {
+		result := &report.Rows[i]
+		*result = UserImportResult{Row: i + 1, Username: strings.TrimSpace(row.Username), Email: normalizeEmail(row.Email)}
+
+		user := models.User{
+			Username:     result.Username,
+			Name:         strings.TrimSpace(row.Name),
+			Email:        result.Email,
+			PasswordHash: strings.TrimSpace(row.PasswordHash),
+			IsActive:     true,
+		}
+
+		if !utils.ValidUsername(user.Username) {
+			result.Errors = append(result.Errors, "username must be 3-30 letters, digits, dots, dashes or underscores")
+		}
+		if !utils.ValidEmail(user.Email) {
+			result.Errors = append(result.Errors, "email is not a valid address")
+		}
+		if len([]rune(user.Name)) > 100 {
+			result.Errors = append(result.Errors, "name must be at most 100 characters")
+		}
+		if user.PasswordHash != "" {
+			if err := utils.ValidatePasswordHash(user.PasswordHash); err != nil {
+				result.Errors = append(result.Errors, "password_hash: "+err.Error())
+			}
+		}
+		if role := strings.TrimSpace(row.Role); role != "" {
+			id, err := roleID(role)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("role %q not found", role))
+			}
+			user.RoleID = id
+		}
+		if len(result.Errors) > 0 {
+			result.Status = ImportStatusInvalid
+			report.Invalid++
+			continue
+		}
+		users[i] = &user
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i, user := range users {
+			if user == nil {
+				continue
+			}
+			result := &report.Rows[i]
+
+			// Earlier rows of the same import count towards duplicates too
+			err := createUser(tx, user)
+			if errors.Is(err, ErrUsernameExists) || errors.Is(err, ErrEmailExists) {
+				result.Status = ImportStatusDuplicate
+				result.Errors = append(result.Errors, err.Error())
+				report.Duplicates++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("row %d: %v", i+1, err)
+			}
+
+			// Rows are only reported as created once the transaction commits
+			result.Status = ImportStatusWouldCreate
+			created[i] = user
+			report.Created++
+		}
+
+		if report.Invalid > 0 || opts.DryRun {
+			return errImportRejected
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errImportRejected) {
+		return nil, err
+	}
+	if err != nil {
+		return report, nil
+	}
+
+	report.Committed = true
+	for i, user := range created {
+		if user != nil {
+			report.Rows[i].Status = ImportStatusCreated
+			report.Rows[i].UserID = user.ID
+		}
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "user.import",
+		ActorID:   opts.ActorID,
+		IPAddress: opts.IPAddress,
+		Details:   fmt.Sprintf("created=%d duplicates=%d", report.Created, report.Duplicates),
+	})
+
+	// Users without a password choose one through an emailed link
+	for i, user := range created {
+		if user == nil || user.PasswordHash != "" {
+			continue
+		}
+		if err := sendImportInvitationEmail(user); err != nil {
+			log.Printf("Error sending import invitation to %s: %v", user.Email, err)
+			report.Rows[i].EmailError = "invitation email could not be sent"
+		}
+	}
+	return report, nil
+}
+
+// sendImportInvitationEmail invites an imported user to set a password
+func sendImportInvitationEmail(user *models.User) error {
+	reset, err := CreatePasswordReset(user.Email, invitationTTL())
+	if err != nil {
+		return err
+	}
+
+	link := utils.FrontendURL(fmt.Sprintf("/reset-password?email=%s&token=%s", url.QueryEscape(user.Email), url.QueryEscape(reset.Token)))
+	body := fmt.Sprintf("Hi %s,\n\nAn account has been created for you. Choose a password to sign in: %s\n\n"+
+		"This link expires on %s.",
+		user.Username, link, reset.ExpiresAt.Format(time.RFC1123))
+	return utils.SendEmail(user.Email, "Your new account", body)
+}
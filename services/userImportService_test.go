@@ -0,0 +1,87 @@
+package services
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"hells/models"
+	"hells/testutil"
+	"hells/utils"
+)
+
+func TestImportUsers(t *testing.T) {
+	db := testutil.NewDB(t)
+	testutil.CreateUser(t, db, "taken", "Viewer")
+	hash, err := (&utils.BcryptHasher{Cost: 4}).Hash("secret password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []UserImportRow{
+		{Username: "alice", Email: "alice@example.com", Role: "Editor", PasswordHash: hash},
+		{Username: "bob", Email: "bob@example.com"},
+		{Username: "taken", Email: "other@example.com"},
+		{Username: "bob2", Email: "BOB@example.com"},
+	}
+
+	report, err := ImportUsers(rows, UserImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Committed || report.Created != 2 || report.Duplicates != 2 {
+		t.Errorf("dry run report = %+v", report)
+	}
+	var count int64
+	db.Model(&models.User{}).Count(&count)
+	if count != 1 {
+		t.Errorf("dry run created users: %d", count)
+	}
+
+	report, err = ImportUsers(rows, UserImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Committed || report.Rows[0].Status != ImportStatusCreated || report.Rows[3].Status != ImportStatusDuplicate {
+		t.Errorf("report = %+v", report)
+	}
+	alice, err := FindUserByEmail("alice@example.com")
+	if err != nil || alice.Role.Name != "Editor" || !utils.CheckPasswordHash("secret password", alice.PasswordHash) {
+		t.Errorf("alice = %+v, %v", alice, err)
+	}
+}
+
+func TestImportUsersRejectsCostlyHashes(t *testing.T) {
+	db := testutil.NewDB(t)
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	// Verifying any of these would take minutes and gigabytes of memory
+	var rows []UserImportRow
+	for i := 0; i < 20; i++ {
+		rows = append(rows, UserImportRow{
+			Username:     fmt.Sprintf("user%d", i),
+			Email:        testutil.Email("user", i),
+			PasswordHash: fmt.Sprintf("$argon2id$v=19$m=4194304,t=1000,p=1$%s$%s", salt, key),
+		})
+	}
+	rows = append(rows, UserImportRow{Username: "fine", Email: "fine@example.com"})
+
+	start := time.Now()
+	report, err := ImportUsers(rows, UserImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("import took %v", elapsed)
+	}
+	if report.Committed || report.Invalid != 20 || report.Rows[0].Status != ImportStatusInvalid {
+		t.Errorf("report = %+v", report)
+	}
+	var count int64
+	db.Model(&models.User{}).Count(&count)
+	if count != 0 {
+		t.Errorf("rejected import created %d users", count)
+	}
+}
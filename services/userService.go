@@ -2,26 +2,37 @@ package services
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"hells/config"
 	"hells/models"
+	"hells/utils"
 
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUsernameExists = errors.New("username already exists")
+	ErrEmailExists    = errors.New("email already exists")
 )
 
 func CreateUser(user *models.User) error {
-	db := config.GetDB()
+	return createUser(config.GetDB(), user)
+}
 
+// createUser creates the user through db, which may be a transaction
+func createUser(db *gorm.DB, user *models.User) error {
 	// Check if username already exists
 	var existingUser models.User
 	if err := db.Where("username = ?", user.Username).First(&existingUser).Error; err == nil {
-		return errors.New("username already exists")
+		return ErrUsernameExists
 	}
 
 	// Check if email already exists
 	if err := db.Where("email = ?", user.Email).First(&existingUser).Error; err == nil {
-		return errors.New("email already exists")
+		return ErrEmailExists
 	}
 
 	// Find default role if not set
@@ -39,7 +50,7 @@ func CreateUser(user *models.User) error {
 func FindUserByEmail(email string) (*models.User, error) {
 	db := config.GetDB()
 	var user models.User
-	err := db.Where("email = ?", email).Preload("Role").First(&user).Error
+	err := db.Where("email = ? AND deleted_at IS NULL", email).Preload("Role").First(&user).Error
 	if err != nil {
 		return nil, err
 	}
@@ -58,6 +69,30 @@ func UpdateUser(user *models.User) error {
 	return db.Save(user).Error
 }
 
+// UpdateProfile saves the self-service profile fields that are not nil. Only
+// those columns are written, so concurrent changes to the rest of the account
+// are kept.
+func UpdateProfile(userID uint, name, username, avatarURL *string) (*models.User, error) {
+	updates := map[string]interface{}{}
+	if name != nil {
+		updates["name"] = *name
+	}
+	if username != nil {
+		updates["username"] = *username
+	}
+	if avatarURL != nil {
+		updates["avatar_url"] = *avatarURL
+	}
+
+	if len(updates) > 0 {
+		db := config.GetDB()
+		if err := db.Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	return FindUserByID(userID)
+}
+
 func ResetUserPassword(email, resetToken, newPassword string) error {
 	db := config.GetDB()
 
@@ -70,8 +105,21 @@ func ResetUserPassword(email, resetToken, newPassword string) error {
 		return errors.New("invalid or expired reset token")
 	}
 
+	var user models.User
+	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+		return err
+	}
+	if authSource(&user) != "local" {
+		return ErrExternalPassword
+	}
+
+	// Enforce password policy
+	if err := utils.DefaultPasswordPolicy().Validate(newPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+
 	// Hash new password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	hashedPassword, err := utils.HashPassword(newPassword)
 	if err != nil {
 		return err
 	}
@@ -79,21 +127,42 @@ func ResetUserPassword(email, resetToken, newPassword string) error {
 	// Begin transaction
 	tx := db.Begin()
 
+	// Claim the reset token so it works only once
+	result := tx.Model(&models.PasswordReset{}).Where("id = ? AND is_used = ?", passwordReset.ID, false).Update("is_used", true)
+	if result.Error != nil || result.RowsAffected != 1 {
+		tx.Rollback()
+		return errors.New("invalid or expired reset token")
+	}
+
 	// Update user password
-	var user models.User
-	if err := tx.Where("email = ?", email).First(&user).Error; err != nil {
+	if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Update("password_hash", hashedPassword).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// A reset is how owners take back an account, so sign out everyone,
+	// including whoever changed the password
+	now := time.Now()
+	err = tx.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", user.ID).
+		Update("revoked_at", now).Error
+	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	user.PasswordHash = string(hashedPassword)
-	if err := tx.Save(&user).Error; err != nil {
+	err = tx.Model(&models.ImpersonationSession{}).
+		Where("subject_id = ? AND ended_at IS NULL", user.ID).
+		Update("ended_at", now).Error
+	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	// Mark reset token as used
-	passwordReset.IsUsed = true
-	if err := tx.Save(&passwordReset).Error; err != nil {
+	// Other reset links were issued before this one took effect
+	err = tx.Model(&models.PasswordReset{}).
+		Where("email = ? AND is_used = ?", user.Email, false).
+		Update("is_used", true).Error
+	if err != nil {
 		tx.Rollback()
 		return err
 	}
@@ -102,19 +171,99 @@ func ResetUserPassword(email, resetToken, newPassword string) error {
 	return tx.Commit().Error
 }
 
-func ListUsers(page, limit int) ([]models.User, int, error) {
+func ListUsers(query UserListQuery) ([]models.User, int, error) {
 	db := config.GetDB()
 	var users []models.User
 	var total int64
 
-	// Count total users
-	db.Model(&models.User{}).Count(&total)
+	if query.Limit > MaxUserPageSize {
+		query.Limit = MaxUserPageSize
+	}
+
+	// Count matching users
+	if err := query.apply(db.Model(&models.User{})).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
 
 	// Paginate and fetch users
-	err := db.Preload("Role").
-		Offset((page - 1) * limit).
-		Limit(limit).
+	err := query.order(query.apply(db.Select("users.*").Preload("Role"))).
+		Offset((query.Page - 1) * query.Limit).
+		Limit(query.Limit).
 		Find(&users).Error
 
 	return users, int(total), err
 }
+
+// UsernameTaken reports whether another user already has the username
+func UsernameTaken(username string, excludeUserID uint) bool {
+	db := config.GetDB()
+	var existingUser models.User
+	err := db.Where("username = ? AND id <> ?", username, excludeUserID).First(&existingUser).Error
+	return err == nil
+}
+
+// availableUsername returns base, or base with a numeric suffix when another
+// account, including a deleted one, already uses it. It is for accounts
+// provisioned from a directory, whose usernames are not chosen by their owner.
+func availableUsername(base string) (string, error) {
+	if !utils.ValidUsername(base) {
+		return "", fmt.Errorf("%q is not a valid username", base)
+	}
+	candidate := base
+	for n := 2; n <= 10; n++ {
+		if !UsernameTaken(candidate, 0) {
+			return candidate, nil
+		}
+		// Usernames are at most 30 characters
+		suffix := "-" + strconv.Itoa(n)
+		candidate = base[:min(len(base), 30-len(suffix))] + suffix
+	}
+	return "", ErrUsernameExists
+}
+
+// ListUsersByCursor returns a keyset paginated page of users matching the filters
+// in query. Its sort and page fields are ignored.
+func ListUsersByCursor(query UserListQuery, cursor *Cursor) (CursorResult[models.User], int, error) {
+	db := config.GetDB()
+	var users []models.User
+	var total int64
+
+	if query.Limit > MaxUserPageSize {
+		query.Limit = MaxUserPageSize
+	}
+
+	// Count matching users
+	if err := query.apply(db.Model(&models.User{})).Count(&total).Error; err != nil {
+		return CursorResult[models.User]{}, 0, err
+	}
+
+	page := KeysetPage{Listing: "users", Table: "users", Cursor: cursor, Limit: query.Limit}
+	if err := page.Apply(query.apply(db.Select("users.*").Preload("Role"))).Find(&users).Error; err != nil {
+		return CursorResult[models.User]{}, 0, err
+	}
+
+	return PageByCursor(page, users, func(u models.User) (time.Time, uint) {
+		return u.CreatedAt, u.ID
+	}), int(total), nil
+}
+
+// setUserRole changes the user's role, recording it in their role history
+func setUserRole(user *models.User, roleID uint, ipAddress string) error {
+	if user.RoleID == roleID {
+		return nil
+	}
+
+	db := config.GetDB()
+	if err := db.Model(&models.User{}).Where("id = ?", user.ID).Update("role_id", roleID).Error; err != nil {
+		return err
+	}
+
+	RecordAudit(models.AuditLog{
+		Action:    "user.role_change",
+		SubjectID: user.ID,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("old_role_id=%d new_role_id=%d", user.RoleID, roleID),
+	})
+	user.RoleID = roleID
+	return nil
+}
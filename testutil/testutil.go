@@ -0,0 +1,77 @@
+// Package testutil sets up the database and environment for tests. It is only
+// imported from _test.go files.
+package testutil
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"hells/config"
+	"hells/models"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// NewDB opens an empty, migrated and seeded SQLite database and installs it as
+// config.GetDB for the rest of the test
+func NewDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	if err := config.MigrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SeedDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	config.UseDatabase(db)
+	t.Cleanup(func() {
+		config.UseDatabase(nil)
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// Role returns the seeded role with the given name
+func Role(t testing.TB, db *gorm.DB, name string) models.Role {
+	t.Helper()
+	var role models.Role
+	if err := db.Where("name = ?", name).First(&role).Error; err != nil {
+		t.Fatalf("role %s: %v", name, err)
+	}
+	return role
+}
+
+// CreateUser inserts an active user with the given role
+func CreateUser(t testing.TB, db *gorm.DB, username, roleName string) *models.User {
+	t.Helper()
+	user := models.User{
+		Username: username,
+		Email:    username + "@example.com",
+		RoleID:   Role(t, db, roleName).ID,
+		IsActive: true,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user %s: %v", username, err)
+	}
+	if err := db.Preload("Role").First(&user, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+// Email returns a unique address for a test user
+func Email(name string, i int) string {
+	return fmt.Sprintf("%s%d@example.com", name, i)
+}
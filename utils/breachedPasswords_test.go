@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+const (
+	passwordPrefix = "5BAA6"
+	passwordSuffix = "1E4C9B93F3F0682250B6CF8331B7EE68FD8"
+)
+
+func TestRangeFileChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{"found", passwordPrefix, "0018A45C4D1DEF81644B54AB7F969B88D65:1\n" + passwordSuffix + ":3861493\n", 3861493, false},
+		{"found in .txt file", passwordPrefix + ".txt", passwordSuffix + ":42\n", 42, false},
+		{"lowercase suffix and CRLF", passwordPrefix, strings.ToLower(passwordSuffix) + ":7\r\n", 7, false},
+		{"not in range", passwordPrefix, "0018A45C4D1DEF81644B54AB7F969B88D65:1\n", 0, false},
+		{"padding entry", passwordPrefix, passwordSuffix + ":0\n", 0, false},
+		{"no range file", "00000", passwordSuffix + ":9\n", 0, false},
+		{"malformed count", passwordPrefix, passwordSuffix + ":lots\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, tt.file), []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			checker := &RangeFileChecker{Dir: dir}
+			got, err := checker.BreachCount("password")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BreachCount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("BreachCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPRangeChecker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Add-Padding") != "true" {
+			t.Error("request without Add-Padding")
+		}
+		switch r.URL.Path {
+		case "/range/" + passwordPrefix:
+			fmt.Fprintf(w, "0018A45C4D1DEF81644B54AB7F969B88D65:0\r\n%s:12\r\n", passwordSuffix)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	checker := NewHTTPRangeChecker(server.URL + "/range")
+	if count, err := checker.BreachCount("password"); err != nil || count != 12 {
+		t.Errorf("BreachCount(password) = %d, %v", count, err)
+	}
+	if _, err := checker.BreachCount("something else"); err == nil {
+		t.Error("error status was not reported")
+	}
+}
+
+type fakeBreachChecker struct {
+	count int
+	err   error
+}
+
+func (c fakeBreachChecker) BreachCount(string) (int, error) {
+	return c.count, c.err
+}
+
+func TestPasswordPolicyBreachCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		checker  BreachedPasswordChecker
+		breached bool
+	}{
+		{"no checker", nil, false},
+		{"not breached", fakeBreachChecker{}, false},
+		{"breached", fakeBreachChecker{count: 3}, true},
+		// An unreachable checker must not block sign-ups
+		{"checker fails open", fakeBreachChecker{err: errors.New("unavailable")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &PasswordPolicy{MinLength: 10, Blocklist: map[string]struct{}{}, BreachChecker: tt.checker}
+
+			err := policy.Validate("Xk9#mQ2$vL7!", "alice", "alice@example.com")
+			var policyErr *PasswordPolicyError
+			breached := errors.As(err, &policyErr) && policyErr.Violations[0].Rule == "breached_password"
+			if breached != tt.breached {
+				t.Errorf("Validate() = %v, breached want %v", err, tt.breached)
+			}
+			if !tt.breached && err != nil {
+				t.Errorf("Validate() = %v", err)
+			}
+		})
+	}
+}
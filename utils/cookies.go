@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	SessionCookieName = "session"
+	CSRFCookieName    = "csrf_token"
+	CSRFHeaderName    = "X-CSRF-Token"
+)
+
+// SetSessionCookies stores the token in an HttpOnly cookie and the CSRF token in a
+// cookie readable by the frontend, which echoes it back in the X-CSRF-Token header
+func SetSessionCookies(w http.ResponseWriter, token, csrfToken string, expires time.Time) {
+	http.SetCookie(w, newCookie(SessionCookieName, token, expires, true))
+	http.SetCookie(w, newCookie(CSRFCookieName, csrfToken, expires, false))
+}
+
+// ClearSessionCookies expires both session cookies
+func ClearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, newCookie(SessionCookieName, "", time.Unix(0, 0), true))
+	http.SetCookie(w, newCookie(CSRFCookieName, "", time.Unix(0, 0), false))
+}
+
+// GenerateCSRFToken derives a CSRF token bound to the session
+func GenerateCSRFToken(sessionID string) string {
+	return SignValue("csrf:" + sessionID)
+}
+
+// ValidCSRFToken checks that the token was issued for the session
+func ValidCSRFToken(token, sessionID string) bool {
+	value, err := VerifySignedValue(token)
+	return err == nil && sessionID != "" && value == "csrf:"+sessionID
+}
+
+func newCookie(name, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   os.Getenv("COOKIE_DOMAIN"),
+		Expires:  expires,
+		HttpOnly: httpOnly,
+		Secure:   os.Getenv("COOKIE_SECURE") != "false",
+		SameSite: cookieSameSite(),
+	}
+	if expires.Before(time.Now()) {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+func cookieSameSite() http.SameSite {
+	switch strings.ToLower(os.Getenv("COOKIE_SAMESITE")) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
@@ -0,0 +1,29 @@
+package utils
+
+import "testing"
+
+func TestValidCSRFToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	token := GenerateCSRFToken("7")
+
+	tests := []struct {
+		name      string
+		token     string
+		sessionID string
+		want      bool
+	}{
+		{"own session", token, "7", true},
+		{"other session", token, "8", false},
+		{"no session", GenerateCSRFToken(""), "", false},
+		{"other purpose", SignValue("unlock:7"), "7", false},
+		{"tampered", token + "x", "7", false},
+		{"garbage", "csrf", "7", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidCSRFToken(tt.token, tt.sessionID); got != tt.want {
+				t.Errorf("ValidCSRFToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
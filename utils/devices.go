@@ -0,0 +1,43 @@
+package utils
+
+import "strings"
+
+// DescribeDevice turns a User-Agent header into a short label such as "Chrome on Windows"
+func DescribeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	ua := strings.ToLower(userAgent)
+
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "chrome/") || strings.Contains(ua, "crios/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari/"):
+		browser = "Safari"
+	case strings.Contains(ua, "curl/"):
+		browser = "curl"
+	}
+
+	platform := "unknown platform"
+	switch {
+	case strings.Contains(ua, "android"):
+		platform = "Android"
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad"):
+		platform = "iOS"
+	case strings.Contains(ua, "windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "mac os"):
+		platform = "macOS"
+	case strings.Contains(ua, "linux"):
+		platform = "Linux"
+	}
+
+	return browser + " on " + platform
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// SendEmail sends a plain text email using the SMTP settings from the environment
+func SendEmail(to, subject, body string) error {
+	from := os.Getenv("EMAIL_FROM")
+	host := os.Getenv("SMTP_HOST")
+	port := os.Getenv("SMTP_PORT")
+	if from == "" || host == "" || port == "" {
+		return fmt.Errorf("email is not configured")
+	}
+
+	message := strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+		"",
+		body,
+	}, "\r\n")
+
+	auth := smtp.PlainAuth("", from, os.Getenv("EMAIL_PASSWORD"), host)
+	if err := smtp.SendMail(host+":"+port, auth, from, []string{to}, []byte(message)); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+// FrontendURL builds a link to the frontend for the given path
+func FrontendURL(path string) string {
+	return strings.TrimRight(os.Getenv("FRONTEND_URL"), "/") + path
+}
+
+// AppURL builds an absolute link to this service for the given path
+func AppURL(path string) string {
+	return strings.TrimRight(os.Getenv("APP_URL"), "/") + path
+}
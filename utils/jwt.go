@@ -10,20 +10,57 @@ import (
 )
 
 type Claims struct {
-	UserID string `json:"user_id"`
-	Role   string `json:"role"`
+	UserID   string   `json:"user_id"`
+	Role     string   `json:"role"`
+	Act      *Actor   `json:"act,omitempty"`
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	// SessionID links the token to the server-side session it was issued for
+	SessionID string `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
-func GenerateJWT(userID, role string) (string, error) {
-	expirationTime := time.Now().Add(60 * time.Minute)
+// Actor identifies the real user acting on behalf of the token subject
+type Actor struct {
+	UserID string `json:"sub"`
+}
+
+// IsImpersonation reports whether the token was issued to an admin acting as another user
+func (c *Claims) IsImpersonation() bool {
+	return c.Act != nil
+}
+
+// AccessTokenTTL is the lifetime of tokens issued at login
+const AccessTokenTTL = 60 * time.Minute
+
+// GenerateJWT issues a token for a session whose user just authenticated with the given methods
+func GenerateJWT(userID, role, sessionID string, amr ...string) (string, error) {
 	claims := &Claims{
-		UserID: userID,
-		Role:   role,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			Issuer:    "BlogPlatform",
-		},
+		UserID:    userID,
+		Role:      role,
+		AuthTime:  time.Now().Unix(),
+		AMR:       amr,
+		SessionID: sessionID,
+	}
+	return SignClaims(claims, AccessTokenTTL)
+}
+
+// TokenIssuer is the iss claim of every token this service issues
+const TokenIssuer = "BlogPlatform"
+
+// SignClaims sets the expiry and issuer on the claims and signs them, with the
+// RS256 key when one is configured so other services can verify the token
+// against the JWKS, and with JWT_SECRET otherwise
+func SignClaims(claims *Claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(ttl).Unix()
+	claims.Issuer = TokenIssuer
+
+	if keys := loadSigningKeys(); keys.private != nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = keys.privateID
+		return token.SignedString(keys.private)
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -34,10 +71,18 @@ func GenerateJWT(userID, role string) (string, error) {
 func ValidateJWT(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA:
+			kid, _ := token.Header["kid"].(string)
+			if key, ok := loadSigningKeys().public[kid]; ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("unknown signing key")
+		case *jwt.SigningMethodHMAC:
+			// Also accepted after switching to RS256 until older tokens expire
+			return []byte(os.Getenv("JWT_SECRET")), nil
 		}
-		return []byte(os.Getenv("JWT_SECRET")), nil
+		return nil, fmt.Errorf("unexpected signing method")
 	})
 
 	if err != nil {
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// JSONWebKey is the public half of a token signing key, as published in the JWKS
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+type signingKeys struct {
+	// private signs new tokens; it is nil when tokens are signed with JWT_SECRET
+	private   *rsa.PrivateKey
+	privateID string
+	// public holds every key tokens are still verified with, by key ID
+	public map[string]*rsa.PublicKey
+}
+
+var (
+	jwtKeys     signingKeys
+	jwtKeysOnce sync.Once
+)
+
+// loadSigningKeys reads the RS256 key pair from JWT_PRIVATE_KEY_FILE and the
+// public keys of retired key pairs from JWT_PUBLIC_KEY_FILES (comma separated),
+// which stay valid until the tokens they signed expire. Without a private key
+// tokens are signed with the shared JWT_SECRET.
+func loadSigningKeys() signingKeys {
+	jwtKeysOnce.Do(func() {
+		jwtKeys.public = map[string]*rsa.PublicKey{}
+
+		if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); path != "" {
+			key, err := readRSAPrivateKey(path)
+			if err != nil {
+				log.Fatalf("JWT signing key: %v", err)
+			}
+			jwtKeys.private = key
+			jwtKeys.privateID = keyThumbprint(&key.PublicKey)
+			jwtKeys.public[jwtKeys.privateID] = &key.PublicKey
+		}
+
+		for _, path := range strings.Split(os.Getenv("JWT_PUBLIC_KEY_FILES"), ",") {
+			if path = strings.TrimSpace(path); path == "" {
+				continue
+			}
+			key, err := readRSAPublicKey(path)
+			if err != nil {
+				log.Fatalf("JWT verification key: %v", err)
+			}
+			jwtKeys.public[keyThumbprint(key)] = key
+		}
+	})
+	return jwtKeys
+}
+
+// PublicKeySet returns the keys other services verify tokens with
+func PublicKeySet() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	keys := loadSigningKeys()
+	// The current key first, then retired ones
+	if keys.private != nil {
+		set.Keys = append(set.Keys, newJSONWebKey(keys.privateID, &keys.private.PublicKey))
+	}
+	var retired []string
+	for kid := range keys.public {
+		if kid != keys.privateID {
+			retired = append(retired, kid)
+		}
+	}
+	sort.Strings(retired)
+	for _, kid := range retired {
+		set.Keys = append(set.Keys, newJSONWebKey(kid, keys.public[kid]))
+	}
+	return set
+}
+
+func newJSONWebKey(kid string, key *rsa.PublicKey) JSONWebKey {
+	return JSONWebKey{
+		KeyType:   "RSA",
+		KeyID:     kid,
+		Use:       "sig",
+		Algorithm: "RS256",
+		Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// keyThumbprint is the RFC 7638 thumbprint of the key, used as its key ID
+func keyThumbprint(key *rsa.PublicKey) string {
+	jwk := newJSONWebKey("", key)
+	// Members in lexicographic order, without whitespace
+	data, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{jwk.Exponent, jwk.KeyType, jwk.Modulus})
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return key, nil
+}
+
+func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return key, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(path + ": no PEM data found")
+	}
+	return block, nil
+}
@@ -0,0 +1,332 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher produces and checks hashes in PHC string format
+// ($<id>$<params>$<salt>$<hash>), so each hash records the algorithm and
+// parameters that produced it
+type PasswordHasher interface {
+	// ID is the PHC identifier of the algorithm, e.g. "argon2id"
+	ID() string
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	// Validate checks the format and parameters of encoded without hashing
+	Validate(encoded string) error
+	// NeedsRehash reports whether encoded was produced with weaker parameters than the hasher's
+	NeedsRehash(encoded string) bool
+}
+
+var (
+	errMalformedHash = errors.New("malformed password hash")
+	// errHashTooCostly rejects parameters that would make one verification
+	// tie up the server, such as imported hashes asking for gigabytes of memory
+	errHashTooCostly = errors.New("password hash parameters exceed the allowed cost")
+)
+
+// Upper bounds on the parameters of hashes this service will verify
+const (
+	maxBcryptCost     = 16
+	maxHashMemoryKiB  = 256 * 1024
+	maxArgon2Passes   = 10
+	maxHashThreads    = 16
+	minHashKeyLength  = 16
+	maxHashKeyLength  = 64
+	minHashSaltLength = 8
+	maxHashSaltLength = 64
+)
+
+// maxBcryptPasswordLength is the longest password, in bytes, bcrypt accepts
+const maxBcryptPasswordLength = 72
+
+// BcryptHasher wraps bcrypt, whose modular crypt format ($2a$<cost>$...) PHC accepts as is
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) ID() string {
+	return "bcrypt"
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(bcryptInput(password), h.Cost)
+	return string(hash), err
+}
+
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	if err := h.Validate(encoded); err != nil {
+		return false, err
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), bcryptInput(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) Validate(encoded string) error {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil || len(encoded) != 60 {
+		return errMalformedHash
+	}
+	if cost > maxBcryptCost {
+		return errHashTooCostly
+	}
+	return nil
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+// bcryptInput pre-hashes passwords longer than bcrypt accepts. Peppered
+// passwords are already short, so this only affects unpeppered ones.
+func bcryptInput(password string) []byte {
+	if len(password) <= maxBcryptPasswordLength {
+		return []byte(password)
+	}
+	sum := sha256.Sum256([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+type Argon2idHasher struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  int
+	KeyLength   uint32
+}
+
+func (h *Argon2idHasher) ID() string {
+	return "argon2id"
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(h.SaltLength)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	m, t, p := params["m"], params["t"], params["p"]
+	computed := argon2.IDKey([]byte(password), salt, uint32(t), uint32(m), uint8(p), uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (h *Argon2idHasher) Validate(encoded string) error {
+	_, _, _, err := h.parse(encoded)
+	return err
+}
+
+// parse reads an argon2id hash and checks its parameters are within bounds
+func (h *Argon2idHasher) parse(encoded string) (map[string]int, []byte, []byte, error) {
+	params, salt, key, err := parsePHC(encoded, "argon2id", 6)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if strings.Split(encoded, "$")[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, nil, nil, errMalformedHash
+	}
+	m, t, p := params["m"], params["t"], params["p"]
+	if t <= 0 || p <= 0 || m < 8*p || !validSaltAndKey(salt, key) {
+		return nil, nil, nil, errMalformedHash
+	}
+	if m > maxHashMemoryKiB || t > maxArgon2Passes || p > maxHashThreads {
+		return nil, nil, nil, errHashTooCostly
+	}
+	return params, salt, key, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, key, err := parsePHC(encoded, "argon2id", 6)
+	return err != nil ||
+		params["m"] < int(h.Memory) ||
+		params["t"] < int(h.Iterations) ||
+		params["p"] < int(h.Parallelism) ||
+		len(key) < int(h.KeyLength)
+}
+
+type ScryptHasher struct {
+	LogN       int // CPU/memory cost is 2^LogN
+	R          int
+	P          int
+	SaltLength int
+	KeyLength  int
+}
+
+func (h *ScryptHasher) ID() string {
+	return "scrypt"
+}
+
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(h.SaltLength)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, h.KeyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *ScryptHasher) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	ln, r, p := params["ln"], params["r"], params["p"]
+	computed, err := scrypt.Key([]byte(password), salt, 1<<ln, r, p, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (h *ScryptHasher) Validate(encoded string) error {
+	_, _, _, err := h.parse(encoded)
+	return err
+}
+
+// parse reads a scrypt hash and checks its parameters are within bounds
+func (h *ScryptHasher) parse(encoded string) (map[string]int, []byte, []byte, error) {
+	params, salt, key, err := parsePHC(encoded, "scrypt", 5)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ln, r, p := params["ln"], params["r"], params["p"]
+	if ln <= 0 || r <= 0 || p <= 0 || !validSaltAndKey(salt, key) {
+		return nil, nil, nil, errMalformedHash
+	}
+	// scrypt needs 128*N*r bytes of memory and p times the work
+	if ln > 24 || r > 64 || p > maxHashThreads || (128<<ln)*r/1024 > maxHashMemoryKiB {
+		return nil, nil, nil, errHashTooCostly
+	}
+	return params, salt, key, nil
+}
+
+func (h *ScryptHasher) NeedsRehash(encoded string) bool {
+	params, _, key, err := parsePHC(encoded, "scrypt", 5)
+	return err != nil ||
+		params["ln"] < h.LogN ||
+		params["r"] < h.R ||
+		params["p"] < h.P ||
+		len(key) < h.KeyLength
+}
+
+// CurrentPasswordHasher returns the hasher selected by PASSWORD_HASHER
+// (argon2id, bcrypt or scrypt) that new hashes are created with
+func CurrentPasswordHasher() PasswordHasher {
+	return passwordHasherByID(os.Getenv("PASSWORD_HASHER"))
+}
+
+// hasherForHash picks the hasher that produced the encoded hash
+func hasherForHash(encoded string) (PasswordHasher, error) {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, errMalformedHash
+	}
+	switch parts[1] {
+	case "2a", "2b", "2y":
+		return passwordHasherByID("bcrypt"), nil
+	case "argon2id", "scrypt":
+		return passwordHasherByID(parts[1]), nil
+	default:
+		return nil, fmt.Errorf("unsupported password hash algorithm %q", parts[1])
+	}
+}
+
+func passwordHasherByID(id string) PasswordHasher {
+	switch id {
+	case "bcrypt":
+		return &BcryptHasher{Cost: envInt("PASSWORD_BCRYPT_COST", bcrypt.DefaultCost)}
+	case "scrypt":
+		return &ScryptHasher{LogN: envInt("PASSWORD_SCRYPT_LOG_N", 15), R: 8, P: 1, SaltLength: 16, KeyLength: 32}
+	default:
+		// OWASP recommended minimum for argon2id
+		return &Argon2idHasher{
+			Memory:      uint32(envInt("PASSWORD_ARGON2_MEMORY_KIB", 19456)),
+			Iterations:  uint32(envInt("PASSWORD_ARGON2_ITERATIONS", 2)),
+			Parallelism: 1,
+			SaltLength:  16,
+			KeyLength:   32,
+		}
+	}
+}
+
+// pepperPassword mixes in the server-side PASSWORD_PEPPER, which never touches the database
+func pepperPassword(password string) (string, bool) {
+	pepper := os.Getenv("PASSWORD_PEPPER")
+	if pepper == "" {
+		return password, false
+	}
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), true
+}
+
+// parsePHC splits $<id>[$v=<version>]$<params>$<salt>$<hash> into its parts
+func parsePHC(encoded, id string, fields int) (map[string]int, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != fields || parts[1] != id {
+		return nil, nil, nil, errMalformedHash
+	}
+
+	params := map[string]int{}
+	for _, param := range strings.Split(parts[fields-3], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, nil, errMalformedHash
+		}
+		value, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, nil, nil, errMalformedHash
+		}
+		params[kv[0]] = value
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[fields-2])
+	if err != nil {
+		return nil, nil, nil, errMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[fields-1])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, errMalformedHash
+	}
+	return params, salt, key, nil
+}
+
+func validSaltAndKey(salt, key []byte) bool {
+	return len(salt) >= minHashSaltLength && len(salt) <= maxHashSaltLength &&
+		len(key) >= minHashKeyLength && len(key) <= maxHashKeyLength
+}
+
+func randomSalt(length int) ([]byte, error) {
+	salt := make([]byte, length)
+	_, err := rand.Read(salt)
+	return salt, err
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testHashers() []PasswordHasher {
+	return []PasswordHasher{
+		&BcryptHasher{Cost: 4},
+		&Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		&ScryptHasher{LogN: 4, R: 8, P: 1, SaltLength: 16, KeyLength: 32},
+	}
+}
+
+func TestPasswordHashersRoundTrip(t *testing.T) {
+	for _, hasher := range testHashers() {
+		t.Run(hasher.ID(), func(t *testing.T) {
+			hash, err := hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ValidatePasswordHash(hash); err != nil {
+				t.Errorf("ValidatePasswordHash() = %v", err)
+			}
+			if ok, err := hasher.Verify("correct horse", hash); !ok || err != nil {
+				t.Errorf("Verify(correct) = %v, %v", ok, err)
+			}
+			if ok, _ := hasher.Verify("wrong horse", hash); ok {
+				t.Error("Verify(wrong) = true")
+			}
+		})
+	}
+}
+
+func TestBcryptLongPasswords(t *testing.T) {
+	hasher := &BcryptHasher{Cost: 4}
+	long := strings.Repeat("correct horse ", 10)
+	hash, err := hasher.Hash(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := hasher.Verify(long, hash); !ok {
+		t.Error("Verify(long) = false")
+	}
+	// Unlike plain bcrypt, bytes past the 72nd still count
+	if ok, _ := hasher.Verify(long[:maxBcryptPasswordLength]+"x", hash); ok {
+		t.Error("Verify(same prefix) = true")
+	}
+}
+
+func TestValidatePasswordHash(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	bcryptHash, _ := (&BcryptHasher{Cost: 4}).Hash("secret")
+
+	tests := []struct {
+		name string
+		hash string
+		want error
+	}{
+		{"argon2id", fmt.Sprintf("$argon2id$v=19$m=19456,t=2,p=1$%s$%s", salt, key), nil},
+		{"argon2id huge memory", fmt.Sprintf("$argon2id$v=19$m=4194304,t=2,p=1$%s$%s", salt, key), errHashTooCostly},
+		{"argon2id many passes", fmt.Sprintf("$argon2id$v=19$m=19456,t=1000,p=1$%s$%s", salt, key), errHashTooCostly},
+		{"argon2id many threads", fmt.Sprintf("$argon2id$v=19$m=19456,t=2,p=255$%s$%s", salt, key), errHashTooCostly},
+		{"argon2id unknown version", fmt.Sprintf("$argon2id$v=16$m=19456,t=2,p=1$%s$%s", salt, key), errMalformedHash},
+		{"argon2id short salt", fmt.Sprintf("$argon2id$v=19$m=19456,t=2,p=1$%s$%s", "c2FsdA", key), errMalformedHash},
+		{"argon2id huge key", fmt.Sprintf("$argon2id$v=19$m=19456,t=2,p=1$%s$%s", salt, strings.Repeat("A", 1400)), errMalformedHash},
+		{"scrypt", fmt.Sprintf("$scrypt$ln=15,r=8,p=1$%s$%s", salt, key), nil},
+		{"scrypt huge N", fmt.Sprintf("$scrypt$ln=30,r=8,p=1$%s$%s", salt, key), errHashTooCostly},
+		{"scrypt huge memory", fmt.Sprintf("$scrypt$ln=20,r=64,p=1$%s$%s", salt, key), errHashTooCostly},
+		{"scrypt zero r", fmt.Sprintf("$scrypt$ln=15,r=0,p=1$%s$%s", salt, key), errMalformedHash},
+		{"bcrypt", bcryptHash, nil},
+		{"bcrypt high cost", strings.Replace(bcryptHash, "$04$", "$31$", 1), errHashTooCostly},
+		{"bcrypt truncated", bcryptHash[:40], errMalformedHash},
+		{"missing params", "$argon2id$v=19$" + salt + "$" + key, errMalformedHash},
+		{"plain text", "hunter2", errMalformedHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidatePasswordHash(tt.hash); !errors.Is(err, tt.want) {
+				t.Errorf("ValidatePasswordHash() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if err := ValidatePasswordHash("$md5$abc$def"); err == nil {
+		t.Error("unsupported algorithm accepted")
+	}
+}
+
+func TestVerifyPasswordRejectsCostlyHashes(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	if ok, _ := VerifyPassword("secret", fmt.Sprintf("$argon2id$v=19$m=4194304,t=100,p=1$%s$%s", salt, key)); ok {
+		t.Error("VerifyPassword() = true")
+	}
+}
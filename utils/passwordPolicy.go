@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Most common passwords, always rejected in addition to PASSWORD_BLOCKLIST_FILE
+var commonPasswords = []string{
+	"123456", "123456789", "12345678", "12345", "1234567", "1234567890", "111111", "000000",
+	"password", "password1", "password123", "passw0rd", "qwerty", "qwerty123", "qwertyuiop",
+	"abc123", "iloveyou", "admin", "admin123", "welcome", "welcome1", "letmein", "monkey",
+	"dragon", "football", "baseball", "sunshine", "princess", "master", "trustno1", "changeme",
+}
+
+// PasswordRuleViolation describes one password policy rule that was not met
+type PasswordRuleViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password failed
+type PasswordPolicyError struct {
+	Violations []PasswordRuleViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return "password does not meet the policy: " + strings.Join(messages, "; ")
+}
+
+// MaxPasswordLength bounds the work spent hashing and scoring a password
+const MaxPasswordLength = 256
+
+type PasswordPolicy struct {
+	MinLength int
+	// MinScore is the lowest accepted PasswordStrength score
+	MinScore  int
+	Blocklist map[string]struct{}
+	// BreachChecker is optional; when set, passwords found in breaches are rejected
+	BreachChecker BreachedPasswordChecker
+}
+
+var (
+	defaultPolicy     *PasswordPolicy
+	defaultPolicyOnce sync.Once
+)
+
+// DefaultPasswordPolicy returns the policy configured by PASSWORD_MIN_LENGTH,
+// PASSWORD_MIN_SCORE, PASSWORD_BLOCKLIST_FILE and BREACHED_PASSWORD_CHECKER
+func DefaultPasswordPolicy() *PasswordPolicy {
+	defaultPolicyOnce.Do(func() {
+		defaultPolicy = &PasswordPolicy{
+			MinLength:     envInt("PASSWORD_MIN_LENGTH", 10),
+			MinScore:      envInt("PASSWORD_MIN_SCORE", 3),
+			Blocklist:     map[string]struct{}{},
+			BreachChecker: NewBreachedPasswordChecker(),
+		}
+		for _, password := range commonPasswords {
+			defaultPolicy.Blocklist[password] = struct{}{}
+		}
+		if path := os.Getenv("PASSWORD_BLOCKLIST_FILE"); path != "" {
+			if err := defaultPolicy.LoadBlocklist(path); err != nil {
+				log.Printf("Error loading password blocklist: %v", err)
+			}
+		}
+	})
+	return defaultPolicy
+}
+
+// LoadBlocklist adds the passwords listed one per line in the file
+func (p *PasswordPolicy) LoadBlocklist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" && !strings.HasPrefix(password, "#") {
+			p.Blocklist[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// Validate checks the password against every rule. username and email are the
+// account's own details, which the password must not contain.
+func (p *PasswordPolicy) Validate(password, username, email string) error {
+	var violations []PasswordRuleViolation
+	lowered := strings.ToLower(password)
+
+	// Overlong passwords are rejected before any of the costlier checks
+	if len([]rune(password)) > MaxPasswordLength {
+		return &PasswordPolicyError{Violations: []PasswordRuleViolation{{
+			Rule:    "max_length",
+			Message: "Password must be at most " + strconv.Itoa(MaxPasswordLength) + " characters long",
+		}}}
+	}
+
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations, PasswordRuleViolation{
+			Rule:    "min_length",
+			Message: "Password must be at least " + strconv.Itoa(p.MinLength) + " characters long",
+		})
+	}
+
+	if _, blocked := p.Blocklist[lowered]; blocked {
+		violations = append(violations, PasswordRuleViolation{
+			Rule:    "common_password",
+			Message: "Password is too common or has appeared in a data breach",
+		})
+	}
+
+	if p.BreachChecker != nil {
+		// A checker outage should not block sign-ups, so errors are only logged
+		count, err := p.BreachChecker.BreachCount(password)
+		if err != nil {
+			log.Printf("Error checking breached passwords: %v", err)
+		} else if count > 0 {
+			violations = append(violations, PasswordRuleViolation{
+				Rule:    "breached_password",
+				Message: "Password has appeared in " + strconv.Itoa(count) + " known data breaches",
+			})
+		}
+	}
+
+	// Reject passwords built from the account's own details
+	localPart := strings.SplitN(email, "@", 2)[0]
+	for _, input := range []string{username, localPart, email} {
+		if len(input) >= 3 && strings.Contains(lowered, strings.ToLower(input)) {
+			violations = append(violations, PasswordRuleViolation{
+				Rule:    "personal_info",
+				Message: "Password must not contain your username or email",
+			})
+			break
+		}
+	}
+
+	if PasswordStrength(password, p.Blocklist, username, localPart) < p.MinScore {
+		violations = append(violations, PasswordRuleViolation{
+			Rule:    "strength",
+			Message: "Password is too easy to guess",
+		})
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func envInt(name string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
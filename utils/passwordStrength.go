@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Keyboard rows used to spot walks such as "qwerty" or "asdf"
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// Dictionary words are only looked for up to this length
+const maxDictionaryWordLength = 64
+
+// Common character substitutions undone before dictionary matching
+var leetReplacer = strings.NewReplacer("0", "o", "1", "l", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+// PasswordStrength scores a password from 0 (trivial) to 4 (strong) in the style of
+// zxcvbn. It estimates how many guesses an attacker needs, discounting repeated
+// characters, sequences, keyboard walks, dictionary words and the user's own details.
+func PasswordStrength(password string, dictionary map[string]struct{}, userInputs ...string) int {
+	bits := passwordGuessBits(password, dictionary, userInputs)
+
+	// Same thresholds as zxcvbn: 10^3, 10^6, 10^8 and 10^10 guesses
+	switch {
+	case bits < 10:
+		return 0
+	case bits < 20:
+		return 1
+	case bits < 26.6:
+		return 2
+	case bits < 33.2:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// passwordGuessBits estimates log2 of the number of guesses needed
+func passwordGuessBits(password string, dictionary map[string]struct{}, userInputs []string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+	// Anything past the maximum length is not scored
+	if len(runes) > MaxPasswordLength {
+		runes = runes[:MaxPasswordLength]
+		password = string(runes)
+	}
+	bitsPerChar := math.Log2(float64(charsetSize(runes)))
+
+	// Characters inside a dictionary word or user input are covered by one guess over the word list
+	covered := make([]bool, len(runes))
+	bits := 0.0
+	normalized := []rune(leetReplacer.Replace(strings.ToLower(password)))
+	if len(normalized) == len(runes) {
+		wordBits := math.Log2(float64(len(dictionary) + len(userInputs) + 1))
+		for _, input := range userInputs {
+			if len([]rune(input)) >= 3 && markMatches(normalized, []rune(strings.ToLower(input)), covered) {
+				bits += wordBits
+			}
+		}
+
+		// Look up the password's substrings in the dictionary rather than
+		// scanning the dictionary, which may hold millions of entries
+		matched := map[string]bool{}
+		for i := 0; i+4 <= len(normalized); i++ {
+			for j := i + 4; j <= len(normalized) && j-i <= maxDictionaryWordLength; j++ {
+				word := string(normalized[i:j])
+				if _, ok := dictionary[word]; !ok {
+					continue
+				}
+				for k := i; k < j; k++ {
+					covered[k] = true
+				}
+				if !matched[word] {
+					matched[word] = true
+					bits += wordBits
+				}
+			}
+		}
+	}
+
+	// Recent years are among the first things guessed
+	for i := 0; i+4 <= len(runes); i++ {
+		if year, err := strconv.Atoi(string(runes[i : i+4])); err == nil && year >= 1900 && year <= 2099 && !covered[i] {
+			for j := i; j < i+4; j++ {
+				covered[j] = true
+			}
+			bits += math.Log2(200)
+		}
+	}
+
+	// Remaining characters cost full entropy unless they continue a repeat, sequence or keyboard walk
+	for i, r := range runes {
+		if covered[i] {
+			continue
+		}
+		if i > 0 && continuesPattern(runes[i-1], r) {
+			bits += 1
+			continue
+		}
+		bits += bitsPerChar
+	}
+	return bits
+}
+
+func charsetSize(runes []rune) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range runes {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	return size
+}
+
+// markMatches flags every occurrence of word in password and reports whether any was found
+func markMatches(password, word []rune, covered []bool) bool {
+	found := false
+	for i := 0; i+len(word) <= len(password); i++ {
+		if string(password[i:i+len(word)]) == string(word) {
+			for j := i; j < i+len(word); j++ {
+				covered[j] = true
+			}
+			found = true
+		}
+	}
+	return found
+}
+
+// continuesPattern reports whether next repeats prev, follows it alphabetically or
+// numerically, or sits next to it on a keyboard row
+func continuesPattern(prev, next rune) bool {
+	prev, next = unicode.ToLower(prev), unicode.ToLower(next)
+	if prev == next || next-prev == 1 || prev-next == 1 {
+		return true
+	}
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, prev)
+		if i >= 0 && ((i+1 < len(row) && rune(row[i+1]) == next) || (i > 0 && rune(row[i-1]) == next)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordStrength(t *testing.T) {
+	dictionary := map[string]struct{}{"password": {}, "dragon": {}, "sunshine": {}}
+
+	tests := []struct {
+		password string
+		inputs   []string
+		want     int
+	}{
+		{"", nil, 0},
+		{"password", nil, 0},
+		{"p@ssw0rd", nil, 0},
+		{"aaaaaaaaaaaa", nil, 1},
+		{"qwertyuiop", nil, 1},
+		{"dragon2024", nil, 0},
+		{"alice-secret", []string{"alice"}, 4},
+		{"correct horse battery staple", nil, 4},
+		{"Xk9#mQ2$vL7!", nil, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := PasswordStrength(tt.password, dictionary, tt.inputs...); got != tt.want {
+				t.Errorf("PasswordStrength(%q) = %d, want %d", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordStrengthLargeDictionary(t *testing.T) {
+	dictionary := make(map[string]struct{}, 1000000)
+	for i := 0; i < 1000000; i++ {
+		dictionary["word"+strconv.Itoa(i)] = struct{}{}
+	}
+
+	start := time.Now()
+	PasswordStrength(strings.Repeat("word123456", MaxPasswordLength/10), dictionary)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("scoring took %v", elapsed)
+	}
+}
+
+func TestPasswordPolicyMaxLength(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 10, MinScore: 3, Blocklist: map[string]struct{}{}}
+
+	if err := policy.Validate(strings.Repeat("Xk9#mQ2$vL7!", 20), "alice", "alice@example.com"); err != nil {
+		t.Errorf("240 characters: %v", err)
+	}
+
+	err := policy.Validate(strings.Repeat("Xk9#mQ2$vL7!", 22), "alice", "alice@example.com")
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) || len(policyErr.Violations) != 1 || policyErr.Violations[0].Rule != "max_length" {
+		t.Errorf("264 characters: %v", err)
+	}
+}
@@ -3,8 +3,6 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/base64"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 // GenerateStrongPassword creates a random password
@@ -27,14 +25,49 @@ func GeneratePasswordResetToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-// HashPassword securely hashes a password
+// HashPassword securely hashes a password with the current hasher and pepper
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(bytes), err
+	peppered, _ := pepperPassword(password)
+	return CurrentPasswordHasher().Hash(peppered)
 }
 
 // CheckPasswordHash verifies a password against its hash
 func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	ok, _ := VerifyPassword(password, hash)
+	return ok
+}
+
+// VerifyPassword checks a password against a hash from any supported algorithm and
+// reports whether it should be rehashed because the algorithm, its parameters or
+// the pepper have changed since it was created
+func VerifyPassword(password, hash string) (ok bool, needsRehash bool) {
+	hasher, err := hasherForHash(hash)
+	if err != nil {
+		return false, false
+	}
+
+	peppered, hasPepper := pepperPassword(password)
+	if ok, _ := hasher.Verify(peppered, hash); ok {
+		current := CurrentPasswordHasher()
+		return true, hasher.ID() != current.ID() || current.NeedsRehash(hash)
+	}
+
+	// Hashes created before a pepper was configured are upgraded on next login
+	if hasPepper {
+		if ok, _ := hasher.Verify(password, hash); ok {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// ValidatePasswordHash checks that hash is well formed, was produced by a
+// supported algorithm and has parameters within bounds, so it can be stored as
+// is. It never computes a hash.
+func ValidatePasswordHash(hash string) error {
+	hasher, err := hasherForHash(hash)
+	if err != nil {
+		return err
+	}
+	return hasher.Validate(hash)
 }
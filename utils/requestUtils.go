@@ -2,7 +2,13 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 )
 
 // SendJSONResponse sends a JSON response with the given status code
@@ -20,3 +26,126 @@ func SendErrorResponse(w http.ResponseWriter, status int, message string) {
 		"error": message,
 	})
 }
+
+// SendPasswordPolicyError sends a 400 response listing each failed password rule
+func SendPasswordPolicyError(w http.ResponseWriter, err *PasswordPolicyError) {
+	SendJSONResponse(w, http.StatusBadRequest, map[string]interface{}{
+		"error":      "Password does not meet the password policy",
+		"violations": err.Violations,
+	})
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is only honoured
+// when the request comes from a proxy listed in TRUSTED_PROXIES, and is read
+// from the right so that hops added by the client itself are ignored.
+func ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	trusted := trustedProxies()
+	if !isTrustedProxy(remote, trusted) {
+		return remote
+	}
+
+	// Each proxy appends the address it received the request from
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		client = hop
+		if !isTrustedProxy(hop, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+// FromTrustedProxy reports whether the request was sent by a proxy listed in
+// TRUSTED_PROXIES, whose X-Forwarded-* headers can be believed
+func FromTrustedProxy(r *http.Request) bool {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	return isTrustedProxy(remote, trustedProxies())
+}
+
+// trustedProxies parses TRUSTED_PROXIES, a comma separated list of addresses
+// and CIDR ranges of the reverse proxies in front of the service
+func trustedProxies() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func isTrustedProxy(address string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPaginationLinks adds RFC 8288 Link headers pointing at the next and
+// previous pages of a cursor paginated listing
+func SetPaginationLinks(w http.ResponseWriter, r *http.Request, nextCursor, prevCursor string) {
+	links := []struct{ rel, cursor string }{{"next", nextCursor}, {"prev", prevCursor}}
+	for _, l := range links {
+		if l.cursor == "" {
+			continue
+		}
+		query := r.URL.Query()
+		query.Set("cursor", l.cursor)
+		query.Del("page")
+		link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"%s\"", link.String(), l.rel))
+	}
+}
+
+// SendScimResponse sends a SCIM resource with the application/scim+json media type
+func SendScimResponse(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// SendScimError sends an error in the SCIM error format (RFC 7644 section 3.12)
+func SendScimError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{"urn:ietf:params:scim:api:messages:2.0:Error"},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	SendScimResponse(w, status, body)
+}
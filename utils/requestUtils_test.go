@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"no proxies trusted ignores header", "", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"untrusted peer ignores header", "10.0.0.0/8", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.0/8", "10.0.0.2:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed left hop is skipped", "10.0.0.0/8", "10.0.0.2:4000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "10.0.0.0/8", "10.0.0.2:4000", []string{"198.51.100.1, 10.0.0.5"}, "198.51.100.1"},
+		{"repeated headers", "10.0.0.0/8", "10.0.0.2:4000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"single trusted address", "10.0.0.2", "10.0.0.2:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"garbage hop stops the walk", "10.0.0.0/8", "10.0.0.2:4000", []string{"198.51.100.1, not-an-ip"}, "10.0.0.2"},
+		{"only trusted hops", "10.0.0.0/8", "10.0.0.2:4000", []string{"10.0.0.9"}, "10.0.0.9"},
+		{"no header from trusted proxy", "10.0.0.0/8", "10.0.0.2:4000", nil, "10.0.0.2"},
+		{"ipv6", "::1", "[::1]:4000", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.trusted)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
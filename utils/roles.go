@@ -0,0 +1,18 @@
+package utils
+
+// Role hierarchy: Admin > Editor > Viewer
+var roleHierarchy = map[string]int{
+	"Viewer": 1,
+	"Editor": 2,
+	"Admin":  3,
+}
+
+// RoleRank is the position of the role in the hierarchy; unknown roles rank 0
+func RoleRank(role string) int {
+	return roleHierarchy[role]
+}
+
+// HasRole reports whether userRole is requiredRole or ranks above it
+func HasRole(userRole, requiredRole string) bool {
+	return RoleRank(userRole) >= RoleRank(requiredRole)
+}
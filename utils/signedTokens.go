@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SignValue returns an opaque token carrying value and an HMAC signature
+func SignValue(value string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value))
+	return payload + "." + signPayload(payload)
+}
+
+// VerifySignedValue checks the signature of a token created by SignValue and returns its value
+func VerifySignedValue(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed token")
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(signPayload(parts[0]))) {
+		return "", fmt.Errorf("invalid token signature")
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed token")
+	}
+	return string(value), nil
+}
+
+func signPayload(payload string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateNonce creates a random URL-safe string for single-use tokens
+func GenerateNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"net/mail"
+	"regexp"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,30}$`)
+
+// ValidUsername reports whether username uses only the allowed characters and length
+func ValidUsername(username string) bool {
+	return usernamePattern.MatchString(username)
+}
+
+// ValidEmail reports whether email is a bare address such as user@example.com
+func ValidEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}